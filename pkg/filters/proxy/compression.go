@@ -42,6 +42,7 @@ const (
 	keyAcceptEncoding  = "Accept-Encoding"
 	keyContentEncoding = "Content-Encoding"
 	keyContentLength   = "Content-Length"
+	keyContentRange    = "Content-Range"
 	keyVary            = "Vary"
 )
 
@@ -56,7 +57,7 @@ func (c *compression) compress(req *http.Request, resp *http.Response) bool {
 		return false
 	}
 
-	if c.alreadyGziped(resp) {
+	if c.alreadyEncoded(resp) || c.partialContent(resp) {
 		return false
 	}
 
@@ -73,16 +74,27 @@ func (c *compression) compress(req *http.Request, resp *http.Response) bool {
 	return true
 }
 
-func (c *compression) alreadyGziped(resp *http.Response) bool {
+// alreadyEncoded returns whether the body is already encoded by the
+// backend, in gzip or any other coding, compressing it again corrupts it.
+func (c *compression) alreadyEncoded(resp *http.Response) bool {
 	for _, ce := range resp.Header.Values(keyContentEncoding) {
-		if strings.Contains(ce, "gzip") {
-			return true
+		for _, coding := range strings.Split(ce, ",") {
+			coding = strings.TrimSpace(coding)
+			if coding != "" && !strings.EqualFold(coding, "identity") {
+				return true
+			}
 		}
 	}
 
 	return false
 }
 
+// partialContent returns whether the body is a part of the content, the
+// range is about the unencoded content, so it must not be compressed.
+func (c *compression) partialContent(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusPartialContent || resp.Header.Get(keyContentRange) != ""
+}
+
 func (c *compression) acceptGzip(req *http.Request) bool {
 	acceptEncodings := req.Header.Values(keyAcceptEncoding)
 
@@ -18,10 +18,13 @@
 package proxy
 
 import (
+	"bytes"
 	"io"
 	"net/http"
 	"strings"
 	"testing"
+
+	"github.com/megaease/easegress/pkg/util/readers"
 )
 
 func TestAcceptGzip(t *testing.T) {
@@ -49,23 +52,28 @@ func TestAcceptGzip(t *testing.T) {
 	}
 }
 
-func TestAlreadyGziped(t *testing.T) {
+func TestAlreadyEncoded(t *testing.T) {
 	c := newCompression(&CompressionSpec{MinLength: 100})
 
 	resp := &http.Response{Header: http.Header{}}
 
-	if c.alreadyGziped(resp) {
-		t.Error("already gziped should be false")
+	if c.alreadyEncoded(resp) {
+		t.Error("already encoded should be false")
+	}
+
+	resp.Header.Add(keyContentEncoding, "identity")
+	if c.alreadyEncoded(resp) {
+		t.Error("already encoded should be false")
 	}
 
-	resp.Header.Add(keyContentEncoding, "text")
-	if c.alreadyGziped(resp) {
-		t.Error("already gziped should be false")
+	resp.Header.Set(keyContentEncoding, "br")
+	if !c.alreadyEncoded(resp) {
+		t.Error("already encoded should be true")
 	}
 
-	resp.Header.Add(keyContentEncoding, "gzip")
-	if !c.alreadyGziped(resp) {
-		t.Error("already gziped should be true")
+	resp.Header.Set(keyContentEncoding, "identity, gzip")
+	if !c.alreadyEncoded(resp) {
+		t.Error("already encoded should be true")
 	}
 }
 
@@ -97,3 +105,47 @@ func TestCompress(t *testing.T) {
 		t.Error("data length should not be zero")
 	}
 }
+
+func TestCompressPassThrough(t *testing.T) {
+	c := newCompression(&CompressionSpec{MinLength: 100})
+
+	req, _ := http.NewRequest(http.MethodGet, "https://megaease.com", nil)
+	rawBody := strings.Repeat("this is the raw body. ", 100)
+
+	// the body is already gzipped by the backend.
+	gzipped, _ := io.ReadAll(readers.NewGZipCompressReader(io.NopCloser(strings.NewReader(rawBody))))
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{keyContentEncoding: []string{"gzip"}},
+		ContentLength: int64(len(gzipped)),
+		Body:          io.NopCloser(bytes.NewReader(gzipped)),
+	}
+	if c.compress(req, resp) {
+		t.Error("gzipped body should not be compressed again")
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(data, gzipped) {
+		t.Error("gzipped body should be passed through")
+	}
+	if resp.ContentLength != int64(len(gzipped)) {
+		t.Error("content length should be kept")
+	}
+
+	// partial content
+	resp = &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		Header:        http.Header{keyContentRange: []string{"bytes 0-1199/2200"}},
+		ContentLength: 1200,
+		Body:          io.NopCloser(strings.NewReader(rawBody[:1200])),
+	}
+	if c.compress(req, resp) {
+		t.Error("partial content should not be compressed")
+	}
+	if resp.Header.Get(keyContentEncoding) != "" {
+		t.Error("partial content should not have content encoding")
+	}
+	data, _ = io.ReadAll(resp.Body)
+	if string(data) != rawBody[:1200] {
+		t.Error("partial content should be passed through")
+	}
+}
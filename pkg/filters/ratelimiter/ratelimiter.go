@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/megaease/easegress/pkg/context"
@@ -264,6 +265,7 @@ func (rl *RateLimiter) Handle(ctx *context.Context) string {
 
 			resp.SetStatusCode(http.StatusTooManyRequests)
 			resp.HTTPHeader().Set("X-EG-Rate-Limiter", "too-many-requests")
+			resp.HTTPHeader().Set("Retry-After", retryAfterSeconds(u.rl.RetryAfter()))
 
 			ctx.SetOutputResponse(resp)
 			return resultRateLimited
@@ -286,6 +288,16 @@ func (rl *RateLimiter) Handle(ctx *context.Context) string {
 	return ""
 }
 
+// retryAfterSeconds converts d to the value of the Retry-After header,
+// which is in seconds, so it is rounded up.
+func retryAfterSeconds(d time.Duration) string {
+	secs := (d + time.Second - 1) / time.Second
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(int64(secs), 10)
+}
+
 // Status returns Status generated by Runtime.
 func (rl *RateLimiter) Status() interface{} {
 	return nil
@@ -19,12 +19,20 @@ package redirector
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/codectool"
 	"github.com/megaease/easegress/pkg/util/stringtool"
 )
 
@@ -32,7 +40,12 @@ const (
 	// Kind is the kind of Redirector.
 	Kind = "Redirector"
 
-	resultRedirected = "redirected"
+	resultRedirected   = "redirected"
+	resultLoopDetected = "loopDetected"
+
+	// redirectCountHeader is the header carrying the count of redirects
+	// the request has gone through.
+	redirectCountHeader = "X-Eg-Redirect-Count"
 )
 
 const (
@@ -53,7 +66,7 @@ var statusCodeMap = map[int]string{
 var kind = &filters.Kind{
 	Name:        Kind,
 	Description: "Redirector redirect HTTP requests.",
-	Results:     []string{resultRedirected},
+	Results:     []string{resultRedirected, resultLoopDetected},
 	DefaultSpec: func() filters.Spec {
 		return &Spec{
 			MatchPart:  matchPartURI,
@@ -72,18 +85,76 @@ func init() {
 type (
 	// Redirector is filter to redirect HTTP requests.
 	Redirector struct {
-		spec *Spec
-		re   *regexp.Regexp
+		spec        *Spec
+		re          *regexp.Regexp
+		redirectMap atomic.Value // map[string]*RedirectTarget
+		stats       *stats
+	}
+
+	stats struct {
+		total         uint64
+		matched       uint64
+		passedThrough uint64
+		loopDetected  uint64
+
+		lock       sync.Mutex
+		redirected map[int]uint64
+	}
+
+	// Status is the status of Redirector.
+	Status struct {
+		Total         uint64         `json:"total"`
+		Matched       uint64         `json:"matched"`
+		Redirected    map[int]uint64 `json:"redirected"`
+		PassedThrough uint64         `json:"passedThrough"`
+		LoopDetected  uint64         `json:"loopDetected"`
 	}
 
 	// Spec describes the Redirector.
 	Spec struct {
 		filters.BaseSpec `json:",inline"`
 
-		Match       string `json:"match" jsonschema:"required"`
+		Match       string `json:"match,omitempty" jsonschema:"omitempty"`
 		MatchPart   string `json:"matchPart,omitempty" jsonschema:"omitempty,enum=uri,enum=path,enum=full"` // default uri
-		Replacement string `json:"replacement" jsonschema:"required"`
+		Replacement string `json:"replacement,omitempty" jsonschema:"omitempty"`
 		StatusCode  int    `json:"statusCode,omitempty" jsonschema:"omitempty"` // default 301
+		// MaxRedirects caps the count of redirects carried by the
+		// X-Eg-Redirect-Count header, 0 means no limit.
+		MaxRedirects int `json:"maxRedirects,omitempty" jsonschema:"omitempty,minimum=0"`
+
+		// StripPrefix and AddPrefix compute the new location from the path
+		// of the request without regexp, the query is preserved, and the
+		// host is kept if IncludeHost is true. They are ignored if Match is
+		// not empty.
+		StripPrefix string `json:"stripPrefix,omitempty" jsonschema:"omitempty,pattern=^/"`
+		AddPrefix   string `json:"addPrefix,omitempty" jsonschema:"omitempty,pattern=^/"`
+		IncludeHost bool   `json:"includeHost,omitempty" jsonschema:"omitempty"`
+
+		// QueryCondition makes the request redirected only if it has the
+		// query param matching the condition, otherwise it passes through.
+		QueryCondition *QueryCondition `json:"queryCondition,omitempty" jsonschema:"omitempty"`
+
+		// RedirectMapFile is a YAML file mapping the exact paths to their
+		// redirect targets, it is checked before the regexp and the
+		// prefixes, and reloaded when the spec is updated.
+		RedirectMapFile string `json:"redirectMapFile,omitempty" jsonschema:"omitempty"`
+	}
+
+	// RedirectTarget is the target of a path in the redirect map, the
+	// StatusCode of the spec is used if its StatusCode is 0.
+	RedirectTarget struct {
+		Location   string `json:"location"`
+		StatusCode int    `json:"statusCode,omitempty"`
+	}
+
+	// QueryCondition is the condition on a query param of the request, the
+	// param only needs to be present if both Value and Regexp are empty.
+	QueryCondition struct {
+		Key    string `json:"key" jsonschema:"required"`
+		Value  string `json:"value,omitempty" jsonschema:"omitempty"`
+		Regexp string `json:"regexp,omitempty" jsonschema:"omitempty,format=regexp"`
+
+		re *regexp.Regexp
 	}
 )
 
@@ -95,6 +166,12 @@ func (s *Spec) Validate() error {
 	if !stringtool.StrInSlice(s.MatchPart, []string{matchPartURI, matchPartFull, matchPartPath}) {
 		return errors.New("invalid match part of Redirector, only uri, full and path are supported")
 	}
+	if qc := s.QueryCondition; qc != nil && qc.Value != "" && qc.Regexp != "" {
+		return errors.New("value and regexp of the query condition of Redirector are mutually exclusive")
+	}
+	if s.Match == "" && (s.StripPrefix != "" || s.AddPrefix != "" || s.RedirectMapFile != "") {
+		return nil
+	}
 	if s.Match == "" || s.Replacement == "" {
 		return errors.New("match and replacement of Redirector can't be empty")
 	}
@@ -122,16 +199,94 @@ func (r *Redirector) Spec() filters.Spec {
 
 // Init initializes Redirector.
 func (r *Redirector) Init() {
+	r.stats = &stats{redirected: map[int]uint64{}}
 	r.reload()
 }
 
 // Inherit inherits previous generation of Redirector.
 func (r *Redirector) Inherit(previousGeneration filters.Filter) {
-	r.Init()
+	prev := previousGeneration.(*Redirector)
+	// keep the redirect map if the file fails to reload.
+	if m := prev.redirectMap.Load(); m != nil && prev.spec.RedirectMapFile == r.spec.RedirectMapFile {
+		r.redirectMap.Store(m)
+	}
+	r.reload()
+	// keep the counters across generations.
+	r.stats = prev.stats
 }
 
 func (r *Redirector) reload() {
-	r.re = regexp.MustCompile(r.spec.Match)
+	if r.spec.Match != "" {
+		r.re = regexp.MustCompile(r.spec.Match)
+	}
+	if qc := r.spec.QueryCondition; qc != nil && qc.Regexp != "" {
+		qc.re = regexp.MustCompile(qc.Regexp)
+	}
+	if r.spec.RedirectMapFile != "" {
+		if m, err := loadRedirectMap(r.spec.RedirectMapFile); err != nil {
+			logger.Errorf("%s: failed to load redirect map: %v", r.spec.Name(), err)
+		} else {
+			r.redirectMap.Store(m)
+		}
+	}
+}
+
+// loadRedirectMap loads the redirect map from the YAML file.
+func loadRedirectMap(file string) (map[string]*RedirectTarget, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]*RedirectTarget{}
+	if err = codectool.UnmarshalYAML(data, &m); err != nil {
+		return nil, err
+	}
+	for path, target := range m {
+		if target == nil || target.Location == "" {
+			return nil, fmt.Errorf("empty location of path %s", path)
+		}
+		if _, ok := statusCodeMap[target.StatusCode]; target.StatusCode != 0 && !ok {
+			return nil, fmt.Errorf("invalid status code %d of path %s", target.StatusCode, path)
+		}
+	}
+	return m, nil
+}
+
+// mapLocation returns the location and the status code of the request
+// in the redirect map, false is returned if the path isn't in the map.
+func (r *Redirector) mapLocation(req *httpprot.Request) (string, int, bool) {
+	m, _ := r.redirectMap.Load().(map[string]*RedirectTarget)
+	target := m[req.URL().Path]
+	if target == nil {
+		return "", 0, false
+	}
+	code := target.StatusCode
+	if code == 0 {
+		code = r.spec.StatusCode
+	}
+	return target.Location, code, true
+}
+
+// match returns if any value of the query param matches the condition.
+func (qc *QueryCondition) match(req *httpprot.Request) bool {
+	values, ok := req.URL().Query()[qc.Key]
+	if !ok {
+		return false
+	}
+	if qc.Value == "" && qc.re == nil {
+		return true
+	}
+
+	for _, v := range values {
+		if qc.re != nil && qc.re.MatchString(v) {
+			return true
+		}
+		if qc.re == nil && qc.Value == v {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Redirector) getMatchInput(req *httpprot.Request) string {
@@ -146,36 +301,148 @@ func (r *Redirector) getMatchInput(req *httpprot.Request) string {
 	}
 }
 
-func (r *Redirector) updateResponse(resp *httpprot.Response, newLocation string) {
-	resp.SetStatusCode(r.spec.StatusCode)
-	resp.SetPayload([]byte(statusCodeMap[r.spec.StatusCode]))
+// hasPathPrefix returns if the path starts with the prefix at the boundary
+// of a segment.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// prefixLocation computes the new location by stripping and adding the
+// prefixes of the path, false is returned if the request is not matched,
+// that's the path doesn't have the prefix to strip, or it already has the
+// prefix to add when only adding is configured.
+func (r *Redirector) prefixLocation(req *httpprot.Request) (string, bool) {
+	path := req.URL().Path
+	if strip := r.spec.StripPrefix; strip != "" {
+		if !hasPathPrefix(path, strip) {
+			return "", false
+		}
+		path = "/" + strings.TrimPrefix(path[len(strip):], "/")
+	} else if hasPathPrefix(path, r.spec.AddPrefix) {
+		return "", false
+	}
+
+	if add := strings.TrimSuffix(r.spec.AddPrefix, "/"); add != "" {
+		if path == "/" {
+			path = add
+		} else {
+			path = add + path
+		}
+	}
+
+	location := path
+	if q := req.URL().RawQuery; q != "" {
+		location += "?" + q
+	}
+	if r.spec.IncludeHost {
+		location = req.Scheme() + "://" + req.Host() + location
+	}
+	return location, true
+}
+
+func (r *Redirector) updateResponse(resp *httpprot.Response, newLocation string, code int) {
+	resp.SetStatusCode(code)
+	resp.SetPayload([]byte(statusCodeMap[code]))
 	resp.Header().Add("Location", newLocation)
 }
 
 // Handle Redirector Context.
 func (r *Redirector) Handle(ctx *context.Context) string {
+	atomic.AddUint64(&r.stats.total, 1)
+
 	req := ctx.GetInputRequest().(*httpprot.Request)
-	matchInput := r.getMatchInput(req)
-	newLocation := r.re.ReplaceAllString(matchInput, r.spec.Replacement)
-
-	// if matchInput is not matched, newLocation will be the same as matchInput
-	// consider we have multiple Redirector filters, we should not redirect the request
-	// if the request is not matched by the current Redirector filter
-	// so we return "" to indicate the request is not matched by the current Redirector filter
-	// and the request will be handled by the next filter.
-	if newLocation == matchInput {
+
+	if qc := r.spec.QueryCondition; qc != nil && !qc.match(req) {
+		atomic.AddUint64(&r.stats.passedThrough, 1)
 		return ""
 	}
 
+	var newLocation string
+	code := r.spec.StatusCode
+	if location, c, ok := r.mapLocation(req); ok {
+		atomic.AddUint64(&r.stats.matched, 1)
+		newLocation, code = location, c
+	} else if r.re == nil {
+		location, ok := r.prefixLocation(req)
+		if !ok {
+			atomic.AddUint64(&r.stats.passedThrough, 1)
+			return ""
+		}
+		atomic.AddUint64(&r.stats.matched, 1)
+		newLocation = location
+	} else {
+		matchInput := r.getMatchInput(req)
+		if !r.re.MatchString(matchInput) {
+			atomic.AddUint64(&r.stats.passedThrough, 1)
+			return ""
+		}
+		newLocation = r.re.ReplaceAllString(matchInput, r.spec.Replacement)
+
+		// if matchInput is not matched, newLocation will be the same as matchInput
+		// consider we have multiple Redirector filters, we should not redirect the request
+		// if the request is not matched by the current Redirector filter
+		// so we return "" to indicate the request is not matched by the current Redirector filter
+		// and the request will be handled by the next filter.
+		if newLocation == matchInput {
+			atomic.AddUint64(&r.stats.passedThrough, 1)
+			return ""
+		}
+		atomic.AddUint64(&r.stats.matched, 1)
+	}
+
+	count := 0
+	if r.spec.MaxRedirects > 0 {
+		count, _ = strconv.Atoi(req.HTTPHeader().Get(redirectCountHeader))
+		if count >= r.spec.MaxRedirects {
+			atomic.AddUint64(&r.stats.loopDetected, 1)
+			resp, _ := httpprot.NewResponse(nil)
+			resp.SetStatusCode(http.StatusLoopDetected)
+			resp.SetPayload([]byte(http.StatusText(http.StatusLoopDetected)))
+			ctx.SetOutputResponse(resp)
+			return resultLoopDetected
+		}
+	}
+
 	resp, _ := httpprot.NewResponse(nil)
-	r.updateResponse(resp, newLocation)
+	r.updateResponse(resp, newLocation, code)
+	if r.spec.MaxRedirects > 0 {
+		// set the header of the request too, so that the following
+		// Redirectors in the pipeline see the new count.
+		v := strconv.Itoa(count + 1)
+		resp.Header().Set(redirectCountHeader, v)
+		req.Header().Set(redirectCountHeader, v)
+	}
 	ctx.SetOutputResponse(resp)
+	r.stats.addRedirected(resp.StatusCode())
 	return resultRedirected
 }
 
+func (s *stats) addRedirected(code int) {
+	s.lock.Lock()
+	s.redirected[code]++
+	s.lock.Unlock()
+}
+
 // Status returns status.
 func (r *Redirector) Status() interface{} {
-	return nil
+	s := &Status{
+		Total:         atomic.LoadUint64(&r.stats.total),
+		Matched:       atomic.LoadUint64(&r.stats.matched),
+		PassedThrough: atomic.LoadUint64(&r.stats.passedThrough),
+		LoopDetected:  atomic.LoadUint64(&r.stats.loopDetected),
+		Redirected:    map[int]uint64{},
+	}
+
+	r.stats.lock.Lock()
+	for code, n := range r.stats.redirected {
+		s.Redirected[code] = n
+	}
+	r.stats.lock.Unlock()
+
+	return s
 }
 
 // Close closes Redirector.
@@ -20,6 +20,8 @@ package redirector
 import (
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/megaease/easegress/pkg/context"
@@ -210,6 +212,254 @@ func TestRedirector(t *testing.T) {
 	}
 }
 
+func TestRedirectorStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(r *Redirector, reqURL string) string {
+		req, _ := http.NewRequest(http.MethodGet, reqURL, nil)
+		httpReq, _ := httpprot.NewRequest(req)
+		ctx := context.New(nil)
+		ctx.SetInputRequest(httpReq)
+		return r.Handle(ctx)
+	}
+
+	r := &Redirector{spec: getSpec("^/users/([0-9]+)", "path", "/display/$1", 301)}
+	r.Init()
+	assert.Equal(&Status{Redirected: map[int]uint64{}}, r.Status())
+
+	assert.Equal(resultRedirected, handle(r, "http://a.com/users/1"))
+	assert.Equal(resultRedirected, handle(r, "http://a.com/users/2"))
+	assert.Equal("", handle(r, "http://a.com/orders/1"))
+
+	// counters are kept across generations
+	r2 := &Redirector{spec: getSpec("^/(users|display)/([0-9]+)", "path", "/display/$2", 302)}
+	r2.Inherit(r)
+	assert.Equal(resultRedirected, handle(r2, "http://a.com/users/3"))
+	// matched, but the location is not changed
+	assert.Equal("", handle(r2, "http://a.com/display/4"))
+
+	status := r2.Status().(*Status)
+	assert.Equal(uint64(5), status.Total)
+	assert.Equal(uint64(3), status.Matched)
+	assert.Equal(map[int]uint64{301: 2, 302: 1}, status.Redirected)
+	assert.Equal(uint64(2), status.PassedThrough)
+	assert.Equal(status.Total, status.Matched+status.PassedThrough)
+}
+
+func TestRedirectorMaxRedirects(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getSpec("^/v([0-9]+)/(.*)$", "path", "/v$1/next/$2", 302)
+	spec.MaxRedirects = 3
+	r := &Redirector{spec: spec}
+	r.Init()
+
+	// simulate the chained redirects, the client sends the count back.
+	location, count := "http://a.com/v1/api", ""
+	for i := 1; i <= spec.MaxRedirects; i++ {
+		req, _ := http.NewRequest(http.MethodGet, location, nil)
+		if count != "" {
+			req.Header.Set(redirectCountHeader, count)
+		}
+		httpReq, _ := httpprot.NewRequest(req)
+		ctx := context.New(nil)
+		ctx.SetInputRequest(httpReq)
+		assert.Equal(resultRedirected, r.Handle(ctx))
+
+		resp := ctx.GetOutputResponse().(*httpprot.Response)
+		count = resp.HTTPHeader().Get(redirectCountHeader)
+		assert.Equal(fmt.Sprint(i), count)
+		location = "http://a.com" + resp.HTTPHeader().Get("Location")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, location, nil)
+	req.Header.Set(redirectCountHeader, count)
+	httpReq, _ := httpprot.NewRequest(req)
+	ctx := context.New(nil)
+	ctx.SetInputRequest(httpReq)
+	assert.Equal(resultLoopDetected, r.Handle(ctx))
+
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusLoopDetected, resp.StatusCode())
+	assert.Empty(resp.HTTPHeader().Get("Location"))
+	assert.Equal(uint64(1), r.Status().(*Status).LoopDetected)
+}
+
+func TestRedirectorPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	redirect := func(spec *Spec, reqURL string) (string, string) {
+		r := &Redirector{spec: spec}
+		r.Init()
+		req, _ := http.NewRequest(http.MethodGet, reqURL, nil)
+		httpReq, _ := httpprot.NewRequest(req)
+		ctx := context.New(nil)
+		ctx.SetInputRequest(httpReq)
+		result := r.Handle(ctx)
+		if result != resultRedirected {
+			return result, ""
+		}
+		resp := ctx.GetOutputResponse().(*httpprot.Response)
+		return result, resp.HTTPHeader().Get("Location")
+	}
+
+	// strip only
+	spec := &Spec{StripPrefix: "/api", MatchPart: matchPartURI, StatusCode: 301}
+	assert.NoError(spec.Validate())
+	_, location := redirect(spec, "http://a.com/api/users?page=1")
+	assert.Equal("/users?page=1", location)
+	_, location = redirect(spec, "http://a.com/api")
+	assert.Equal("/", location)
+	result, _ := redirect(spec, "http://a.com/apidocs")
+	assert.Equal("", result)
+
+	// add only
+	spec = &Spec{AddPrefix: "/v2/", MatchPart: matchPartURI, StatusCode: 301}
+	assert.NoError(spec.Validate())
+	_, location = redirect(spec, "http://a.com/users?page=1")
+	assert.Equal("/v2/users?page=1", location)
+	_, location = redirect(spec, "http://a.com/")
+	assert.Equal("/v2", location)
+	result, _ = redirect(spec, "http://a.com/v2/users")
+	assert.Equal("", result)
+
+	// combined, with host
+	spec = &Spec{StripPrefix: "/old", AddPrefix: "/new", IncludeHost: true, MatchPart: matchPartURI, StatusCode: 302}
+	assert.NoError(spec.Validate())
+	_, location = redirect(spec, "http://a.com:8080/old/users?page=1")
+	assert.Equal("http://a.com:8080/new/users?page=1", location)
+	result, _ = redirect(spec, "http://a.com:8080/users")
+	assert.Equal("", result)
+
+	// Match takes precedence
+	spec = getSpec("^/old/(.*)$", "path", "/regexp/$1", 301)
+	spec.StripPrefix, spec.AddPrefix = "/old", "/new"
+	assert.NoError(spec.Validate())
+	_, location = redirect(spec, "http://a.com/old/users")
+	assert.Equal("/regexp/users", location)
+}
+
+func TestRedirectorQueryCondition(t *testing.T) {
+	assert := assert.New(t)
+
+	redirect := func(r *Redirector, reqURL string) string {
+		req, _ := http.NewRequest(http.MethodGet, reqURL, nil)
+		httpReq, _ := httpprot.NewRequest(req)
+		ctx := context.New(nil)
+		ctx.SetInputRequest(httpReq)
+		return r.Handle(ctx)
+	}
+
+	spec := getSpec("^/(.*)$", "path", "/legacy/$1", 302)
+	spec.QueryCondition = &QueryCondition{Key: "legacy", Value: "1"}
+	assert.NoError(spec.Validate())
+	r := &Redirector{spec: spec}
+	r.Init()
+
+	assert.Equal(resultRedirected, redirect(r, "http://a.com/users?legacy=1"))
+	assert.Equal(resultRedirected, redirect(r, "http://a.com/users?legacy=0&legacy=1"))
+	assert.Equal("", redirect(r, "http://a.com/users?legacy=0"))
+	assert.Equal("", redirect(r, "http://a.com/users"))
+	assert.Equal(uint64(2), r.Status().(*Status).PassedThrough)
+
+	// regexp
+	spec = getSpec("^/(.*)$", "path", "/legacy/$1", 302)
+	spec.QueryCondition = &QueryCondition{Key: "v", Regexp: "^[12]$"}
+	assert.NoError(spec.Validate())
+	r = &Redirector{spec: spec}
+	r.Init()
+
+	assert.Equal(resultRedirected, redirect(r, "http://a.com/users?v=2"))
+	assert.Equal("", redirect(r, "http://a.com/users?v=3"))
+	assert.Equal("", redirect(r, "http://a.com/users"))
+
+	// presence only
+	spec = &Spec{StripPrefix: "/api", MatchPart: matchPartURI, StatusCode: 301}
+	spec.QueryCondition = &QueryCondition{Key: "legacy"}
+	assert.NoError(spec.Validate())
+	r = &Redirector{spec: spec}
+	r.Init()
+
+	assert.Equal(resultRedirected, redirect(r, "http://a.com/api/users?legacy"))
+	assert.Equal("", redirect(r, "http://a.com/api/users?other=1"))
+
+	spec.QueryCondition = &QueryCondition{Key: "legacy", Value: "1", Regexp: "1"}
+	assert.Error(spec.Validate())
+}
+
+func TestRedirectorRedirectMapFile(t *testing.T) {
+	assert := assert.New(t)
+
+	file := filepath.Join(t.TempDir(), "redirects.yaml")
+	writeMap := func(content string) {
+		assert.NoError(os.WriteFile(file, []byte(content), 0o644))
+	}
+	writeMap(`
+/old/about: {location: /about}
+/old/shop: {location: "https://shop.megaease.com/", statusCode: 308}
+`)
+
+	redirect := func(r *Redirector, reqURL string) (string, int, string) {
+		req, _ := http.NewRequest(http.MethodGet, reqURL, nil)
+		httpReq, _ := httpprot.NewRequest(req)
+		ctx := context.New(nil)
+		ctx.SetInputRequest(httpReq)
+		result := r.Handle(ctx)
+		if result != resultRedirected {
+			return result, 0, ""
+		}
+		resp := ctx.GetOutputResponse().(*httpprot.Response)
+		return result, resp.StatusCode(), resp.HTTPHeader().Get("Location")
+	}
+
+	spec := getSpec("^/old/(.*)$", matchPartPath, "/new/$1", 301)
+	spec.RedirectMapFile = file
+	assert.NoError(spec.Validate())
+	r := &Redirector{spec: spec}
+	r.Init()
+
+	// exact-match hits from the file.
+	_, code, location := redirect(r, "http://a.com/old/about?x=1")
+	assert.Equal(301, code)
+	assert.Equal("/about", location)
+	_, code, location = redirect(r, "http://a.com/old/shop")
+	assert.Equal(308, code)
+	assert.Equal("https://shop.megaease.com/", location)
+
+	// a miss falls through to the regexp, and then passes through.
+	_, code, location = redirect(r, "http://a.com/old/contact")
+	assert.Equal(301, code)
+	assert.Equal("/new/contact", location)
+	result, _, _ := redirect(r, "http://a.com/contact")
+	assert.Equal("", result)
+
+	// the map is reloaded by the next generation.
+	writeMap(`/old/contact: {location: /contact, statusCode: 302}`)
+	r2 := &Redirector{spec: spec}
+	r2.Inherit(r)
+	_, code, location = redirect(r2, "http://a.com/old/contact")
+	assert.Equal(302, code)
+	assert.Equal("/contact", location)
+
+	// the previous map is kept if the file fails to reload.
+	writeMap(`/old/contact: {statusCode: 302}`)
+	r3 := &Redirector{spec: spec}
+	r3.Inherit(r2)
+	_, _, location = redirect(r3, "http://a.com/old/contact")
+	assert.Equal("/contact", location)
+
+	// the map only, a miss passes through.
+	writeMap(`/old/about: {location: /about}`)
+	spec = &Spec{RedirectMapFile: file, MatchPart: matchPartURI, StatusCode: 301}
+	assert.NoError(spec.Validate())
+	r = &Redirector{spec: spec}
+	r.Init()
+	_, _, location = redirect(r, "http://a.com/old/about")
+	assert.Equal("/about", location)
+	result, _, _ = redirect(r, "http://a.com/old/shop")
+	assert.Equal("", result)
+}
+
 func TestSpecValidate(t *testing.T) {
 	assert := assert.New(t)
 	{
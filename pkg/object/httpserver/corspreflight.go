@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+// isCORSPreflight returns whether the request is a CORS preflight request,
+// that's an OPTIONS request with the Origin and the
+// Access-Control-Request-Method headers.
+func isCORSPreflight(stdr *http.Request) bool {
+	return stdr.Method == http.MethodOptions &&
+		stdr.Header.Get("Origin") != "" &&
+		stdr.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// buildCORSPreflightResponse replies the preflight request with 204, the
+// allowed methods are the methods of the matching paths. The requests from
+// the origins not in CORSAllowedOrigins are replied with 403.
+func (mi *muxInstance) buildCORSPreflightResponse(ctx *context.Context, stdr *http.Request, allow string) {
+	origin := stdr.Header.Get("Origin")
+
+	allowOrigin := "*"
+	if origins := mi.spec.CORSAllowedOrigins; len(origins) > 0 && !stringtool.StrInSlice("*", origins) {
+		if !stringtool.StrInSlice(origin, origins) {
+			ctx.AddTag(stringtool.Cat("cors origin ", origin, " is not allowed"))
+			mi.buildErrorResponse(ctx, http.StatusForbidden)
+			return
+		}
+		allowOrigin = origin
+	}
+
+	resp := buildFailureResponse(ctx, http.StatusNoContent)
+	header := resp.HTTPHeader()
+	header.Set("Access-Control-Allow-Origin", allowOrigin)
+	if allowOrigin != "*" {
+		header.Set("Vary", "Origin")
+	}
+	header.Set("Access-Control-Allow-Methods", allow)
+	if len(mi.spec.CORSAllowedHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(mi.spec.CORSAllowedHeaders, ", "))
+	}
+	if mi.spec.CORSMaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(mi.spec.CORSMaxAge)))
+	}
+}
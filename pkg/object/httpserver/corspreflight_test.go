@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := ""
+	handle := func(name string, ctx *context.Context) {
+		backend = name
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 10
+rules:
+- paths:
+  - path: /api
+    methods: [GET, POST]
+    backend: api-pipeline
+  - path: /api
+    methods: [DELETE]
+    backend: api-pipeline
+  - path: /options
+    methods: [OPTIONS]
+    backend: options-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(method, path, origin string) *httptest.ResponseRecorder {
+		backend = ""
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+path, http.NoBody)
+		if origin != "" {
+			stdr.Header.Set("Origin", origin)
+			stdr.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	// disabled
+	stdw := serve(http.MethodOptions, "/api", "https://app.megaease.com")
+	assert.Equal(http.StatusMethodNotAllowed, stdw.Code)
+
+	reloadTestMux(t, m, yamlConfig+`
+handleCORSPreflight: true
+corsAllowedHeaders: [Content-Type, Authorization]
+corsMaxAge: 600
+`)
+
+	// twice to serve from the route cache.
+	for i := 0; i < 2; i++ {
+		stdw = serve(http.MethodOptions, "/api", "https://app.megaease.com")
+		assert.Equal(http.StatusNoContent, stdw.Code)
+		assert.Empty(backend)
+		assert.Equal("*", stdw.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal("GET, POST, DELETE", stdw.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal("Content-Type, Authorization", stdw.Header().Get("Access-Control-Allow-Headers"))
+		assert.Equal("600", stdw.Header().Get("Access-Control-Max-Age"))
+	}
+
+	// not a preflight request
+	stdw = serve(http.MethodOptions, "/api", "")
+	assert.Equal(http.StatusMethodNotAllowed, stdw.Code)
+
+	// other method mismatches
+	stdw = serve(http.MethodPut, "/api", "https://app.megaease.com")
+	assert.Equal(http.StatusMethodNotAllowed, stdw.Code)
+
+	// paths accepting OPTIONS are routed normally
+	stdw = serve(http.MethodOptions, "/options", "https://app.megaease.com")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("options-pipeline", backend)
+
+	// allowed origins
+	reloadTestMux(t, m, yamlConfig+`
+handleCORSPreflight: true
+corsAllowedOrigins: [https://app.megaease.com]
+`)
+
+	stdw = serve(http.MethodOptions, "/api", "https://app.megaease.com")
+	assert.Equal(http.StatusNoContent, stdw.Code)
+	assert.Equal("https://app.megaease.com", stdw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal("Origin", stdw.Header().Get("Vary"))
+	assert.Empty(stdw.Header().Get("Access-Control-Allow-Headers"))
+	assert.Empty(stdw.Header().Get("Access-Control-Max-Age"))
+
+	stdw = serve(http.MethodOptions, "/api", "https://evil.example.com")
+	assert.Equal(http.StatusForbidden, stdw.Code)
+	assert.Empty(stdw.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/codectool"
+)
+
+// debugEchoHeader is the header triggering the debug echo response when
+// DebugEcho of the server is enabled.
+const debugEchoHeader = "X-Eg-Debug-Echo"
+
+// debugEcho is the body of the debug echo response.
+type debugEcho struct {
+	Host    string      `json:"host"`
+	RealIP  string      `json:"realIP"`
+	Headers http.Header `json:"headers"`
+}
+
+// buildDebugEchoResponse replies the received headers and the real IP of
+// the request, which is helpful to troubleshoot header propagation.
+func buildDebugEchoResponse(ctx *context.Context, req *httpprot.Request) {
+	body, err := codectool.MarshalJSON(&debugEcho{
+		Host:    req.Host(),
+		RealIP:  req.RealIP(),
+		Headers: req.HTTPHeader(),
+	})
+	if err != nil {
+		logger.Errorf("BUG: marshal debug echo failed: %v", err)
+	}
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.Header().Set("Content-Type", "application/json")
+	resp.SetPayload(body)
+	ctx.SetResponse(context.DefaultNamespace, resp)
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugEcho(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte("routed"))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+debugEcho: %v
+rules:
+- paths:
+  - path: /api
+    backend: api-pipeline
+`
+
+	serve := func(m *mux, trigger bool) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+		stdr.Header.Set("X-Real-Ip", "192.168.1.1")
+		stdr.Header.Set("X-Request-Id", "abc")
+		if trigger {
+			stdr.Header.Set(debugEchoHeader, "1")
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	m := newTestMux(t, fmt.Sprintf(yamlConfig, true), handle)
+
+	stdw := serve(m, true)
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("application/json", stdw.Header().Get("Content-Type"))
+	echo := &debugEcho{}
+	assert.NoError(codectool.UnmarshalJSON(stdw.Body.Bytes(), echo))
+	assert.Equal("www.megaease.com", echo.Host)
+	assert.Equal("192.168.1.1", echo.RealIP)
+	assert.Equal("abc", echo.Headers.Get("X-Request-Id"))
+
+	// normal routing without the trigger header
+	stdw = serve(m, false)
+	assert.Equal("routed", stdw.Body.String())
+
+	// the trigger header is ignored if the flag is off
+	reloadTestMux(t, m, fmt.Sprintf(yamlConfig, false))
+	stdw = serve(m, true)
+	assert.Equal("routed", stdw.Body.String())
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+// ErrorResponse customizes the responses of the requests rejected by the
+// server itself, e.g. 404 for no matching route or 413 for too large body.
+type ErrorResponse struct {
+	Codes       []int  `json:"codes" jsonschema:"required,minItems=1,uniqueItems=true,format=httpcode-array"`
+	ContentType string `json:"contentType,omitempty" jsonschema:"omitempty"`
+	Body        string `json:"body,omitempty" jsonschema:"omitempty"`
+}
+
+func newErrorResponses(specs []*ErrorResponse) map[int]*ErrorResponse {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	m := make(map[int]*ErrorResponse)
+	for _, er := range specs {
+		for _, code := range er.Codes {
+			// the first one wins if a code is configured more than once.
+			if _, ok := m[code]; !ok {
+				m[code] = er
+			}
+		}
+	}
+	return m
+}
+
+// buildErrorResponse builds the response for a request rejected by the
+// server, all rejections must be built by this function so that they share
+// the customized error responses.
+func (mi *muxInstance) buildErrorResponse(ctx *context.Context, statusCode int) *httpprot.Response {
+	resp := buildFailureResponse(ctx, statusCode)
+
+	er := mi.errorResponses[statusCode]
+	if er == nil {
+		return resp
+	}
+
+	if er.ContentType != "" {
+		resp.Header().Set("Content-Type", er.ContentType)
+	}
+	resp.SetPayload([]byte(er.Body))
+	return resp
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponses(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+clientMaxBodySize: 4
+errorResponses:
+- codes: [413]
+  contentType: text/html
+  body: <h1>Payload Too Large</h1>
+- codes: [404, 413]
+  body: not found
+rules:
+- paths:
+  - path: /upload
+    backend: upload-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(path, body string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com"+path, strings.NewReader(body))
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	stdw := serve("/upload", "hello world")
+	assert.Equal(http.StatusRequestEntityTooLarge, stdw.Code)
+	assert.Equal("text/html", stdw.Header().Get("Content-Type"))
+	assert.Equal("<h1>Payload Too Large</h1>", stdw.Body.String())
+
+	stdw = serve("/unknown", "")
+	assert.Equal(http.StatusNotFound, stdw.Code)
+	assert.Equal("not found", stdw.Body.String())
+
+	stdw = serve("/upload", "hi")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Empty(stdw.Body.String())
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+// autoETagApplicable returns whether the ETag of the response can be
+// generated, only complete 200 responses to GET and HEAD requests are
+// applicable, as the body must be buffered for the hash.
+func autoETagApplicable(req *httpprot.Request, resp *httpprot.Response) bool {
+	if req.Method() != http.MethodGet && req.Method() != http.MethodHead {
+		return false
+	}
+	return resp != nil && !resp.IsStream() && resp.StatusCode() == http.StatusOK
+}
+
+// setWeakETag sets the weak ETag computed from the body of the response,
+// an ETag set by the backend is kept.
+func setWeakETag(resp *httpprot.Response) {
+	if resp.HTTPHeader().Get("ETag") != "" {
+		return
+	}
+	sum := sha256.Sum256(resp.RawPayload())
+	resp.HTTPHeader().Set("ETag", `W/"`+hex.EncodeToString(sum[:16])+`"`)
+}
+
+// etagMatch compares the ETags of the If-None-Match header to etag by the
+// weak comparison.
+func etagMatch(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(v), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// replyNotModified replaces the response with 304 if the If-None-Match
+// header of the request matches its ETag, and returns whether it is
+// replaced.
+func replyNotModified(req *httpprot.Request, resp *httpprot.Response) bool {
+	ifNoneMatch := req.HTTPHeader().Get("If-None-Match")
+	if ifNoneMatch == "" || !etagMatch(ifNoneMatch, resp.HTTPHeader().Get("ETag")) {
+		return false
+	}
+
+	resp.SetStatusCode(http.StatusNotModified)
+	resp.SetPayload(nil)
+	resp.HTTPHeader().Del("Content-Length")
+	return true
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETagMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(etagMatch(`W/"abc"`, `W/"abc"`))
+	assert.True(etagMatch(`"abc"`, `W/"abc"`))
+	assert.True(etagMatch(`"x", W/"abc"`, `W/"abc"`))
+	assert.True(etagMatch(`*`, `W/"abc"`))
+	assert.False(etagMatch(`W/"abd"`, `W/"abc"`))
+	assert.False(etagMatch(`*`, ``))
+}
+
+func TestAutoETag(t *testing.T) {
+	assert := assert.New(t)
+
+	handled := 0
+	body := "hello"
+	handle := func(name string, ctx *context.Context) {
+		handled++
+		resp, _ := httpprot.NewResponse(nil)
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		if req.Path() == "/tagged" {
+			resp.Header().Set("ETag", `"v1"`)
+		}
+		resp.SetPayload([]byte(body))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /cached
+    autoETag: true
+    responseCache:
+      expiration: 1m
+    backend: api-pipeline
+  - pathPrefix: /
+    autoETag: true
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(method, path, ifNoneMatch string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+path, http.NoBody)
+		if ifNoneMatch != "" {
+			stdr.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	w := serve(http.MethodGet, "/api", "")
+	assert.Equal(http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Regexp(`^W/"[0-9a-f]{32}"$`, etag)
+
+	w = serve(http.MethodGet, "/api", etag)
+	assert.Equal(http.StatusNotModified, w.Code)
+	assert.Empty(w.Body.String())
+	assert.Equal(etag, w.Header().Get("ETag"))
+
+	// the ETag changes with the body
+	body = "world"
+	w = serve(http.MethodGet, "/api", etag)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("world", w.Body.String())
+	assert.NotEqual(etag, w.Header().Get("ETag"))
+
+	// the ETag of the backend is kept
+	w = serve(http.MethodGet, "/tagged", "")
+	assert.Equal(`"v1"`, w.Header().Get("ETag"))
+	w = serve(http.MethodGet, "/tagged", `"v1"`)
+	assert.Equal(http.StatusNotModified, w.Code)
+
+	// only GET and HEAD responses get ETags
+	w = serve(http.MethodPost, "/api", "")
+	assert.Empty(w.Header().Get("ETag"))
+
+	// conditional requests are replied from the response cache too
+	handled = 0
+	w = serve(http.MethodGet, "/cached", "")
+	assert.Equal(http.StatusOK, w.Code)
+	etag = w.Header().Get("ETag")
+	w = serve(http.MethodGet, "/cached", etag)
+	assert.Equal(http.StatusNotModified, w.Code)
+	w = serve(http.MethodGet, "/cached", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("world", w.Body.String())
+	assert.Equal(1, handled)
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+var errTooManyHandshakes = fmt.Errorf("too many concurrent TLS handshakes")
+
+type (
+	// handshakeLimitListener accepts the TLS connections, and rejects the
+	// handshakes exceeding the max concurrent handshakes, so that a
+	// handshake flood doesn't exhaust the CPU.
+	handshakeLimitListener struct {
+		net.Listener
+	}
+
+	// handshakeConn is the underlying connection of a TLS connection, it
+	// holds a handshake slot from the ClientHello to the end of the
+	// handshake, or to its close if the handshake fails.
+	handshakeConn struct {
+		net.Conn
+		mu    sync.Mutex
+		slots chan struct{} // non-nil if a slot is held
+	}
+)
+
+// newHandshakeLimitListener returns the TLS listener of the config, at
+// most max handshakes are processed concurrently.
+func newHandshakeLimitListener(inner net.Listener, config *tls.Config, max uint32) net.Listener {
+	// the same as http.Server.ServeTLS.
+	for _, proto := range []string{"h2", "http/1.1"} {
+		if !stringtool.StrInSlice(proto, config.NextProtos) {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+	}
+
+	slots := make(chan struct{}, max)
+	config.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+		hc := chi.Conn.(*handshakeConn)
+		if !hc.acquire(slots) {
+			return nil, errTooManyHandshakes
+		}
+
+		// the session ticket keys of config are still used by the clone.
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.VerifyConnection = func(tls.ConnectionState) error {
+			hc.release()
+			return nil
+		}
+		return c, nil
+	}
+
+	l := &handshakeLimitListener{Listener: inner}
+	return tls.NewListener(l, config)
+}
+
+// Accept accepts one connection.
+func (l *handshakeLimitListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &handshakeConn{Conn: c}, nil
+}
+
+// acquire acquires a slot without waiting, false is returned if all slots
+// are in use.
+func (hc *handshakeConn) acquire(slots chan struct{}) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		hc.slots = slots
+		return true
+	default:
+		return false
+	}
+}
+
+func (hc *handshakeConn) release() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if hc.slots != nil {
+		<-hc.slots
+		hc.slots = nil
+	}
+}
+
+// Close closes the connection.
+func (hc *handshakeConn) Close() error {
+	err := hc.Conn.Close()
+	hc.release()
+	return err
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServerCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHandshakeLimitListener(t *testing.T) {
+	assert := assert.New(t)
+
+	// the handshakes are blocked in picking the certificate until release
+	// is closed, so they are in progress concurrently.
+	cert := newTestServerCert(t)
+	var inProgress, maxInProgress int32
+	release := make(chan struct{})
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			n := atomic.AddInt32(&inProgress, 1)
+			defer atomic.AddInt32(&inProgress, -1)
+			for {
+				m := atomic.LoadInt32(&maxInProgress)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInProgress, m, n) {
+					break
+				}
+			}
+			<-release
+			return &cert, nil
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}),
+		TLSConfig: config,
+	}
+	go srv.Serve(newHandshakeLimitListener(ln, config, 2))
+	defer srv.Close()
+
+	addr := ln.Addr().String()
+	dial := func() (*tls.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+		})
+	}
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := dial()
+			if err == nil {
+				conn.Close()
+			}
+			results <- err
+		}()
+	}
+	assert.Eventually(func() bool {
+		return atomic.LoadInt32(&inProgress) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the excess handshakes are rejected.
+	for i := 0; i < 3; i++ {
+		_, err := dial()
+		assert.Error(err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		assert.NoError(<-results)
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(&maxInProgress))
+
+	// the slots are released after the handshakes, and HTTP2 is still
+	// negotiated.
+	conn, err := dial()
+	assert.NoError(err)
+	assert.Equal("h2", conn.ConnectionState().NegotiatedProtocol)
+	conn.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("https://" + addr)
+		assert.NoError(err)
+		resp.Body.Close()
+	}
+}
@@ -54,9 +54,10 @@ func (hs *HTTPServer) Kind() string {
 // DefaultSpec returns the default spec of HTTPServer.
 func (hs *HTTPServer) DefaultSpec() interface{} {
 	return &Spec{
-		KeepAlive:        true,
-		KeepAliveTimeout: "60s",
-		MaxConnections:   10240,
+		KeepAlive:            true,
+		KeepAliveTimeout:     "60s",
+		MaxConnections:       10240,
+		StripHostTrailingDot: true,
 	}
 }
 
@@ -87,6 +88,18 @@ func (hs *HTTPServer) Status() *supervisor.Status {
 	}
 }
 
+// ExportRoutes is the wrapper of mux's ExportRoutes.
+func (hs *HTTPServer) ExportRoutes() []RouteInfo {
+	return hs.runtime.mux.ExportRoutes()
+}
+
+// Drain marks HTTPServer as draining, the in-flight and following
+// responses close their connections, so that keep-alive clients move on
+// to other instances. It is also done when HTTPServer is closed.
+func (hs *HTTPServer) Drain() {
+	hs.runtime.mux.drain()
+}
+
 // Close closes HTTPServer.
 func (hs *HTTPServer) Close() {
 	hs.runtime.Close()
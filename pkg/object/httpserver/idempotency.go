@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httpserver/routers"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/fasttime"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+const (
+	defaultIdempotencyHeader     = "Idempotency-Key"
+	defaultIdempotencyTTL        = time.Hour
+	defaultIdempotencyMaxEntries = 10240
+
+	// idempotentReplayedHeader is set to the replayed responses.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+type idempotencyCache struct {
+	header string
+	ttl    time.Duration
+	cache  *lru.Cache
+
+	lock sync.Mutex
+	// inFlight are the keys being handled, the channel is closed when
+	// the handling is done.
+	inFlight map[string]chan struct{}
+}
+
+func newIdempotencyCache(spec *routers.Idempotency) *idempotencyCache {
+	ic := &idempotencyCache{
+		header:   spec.Header,
+		ttl:      defaultIdempotencyTTL,
+		inFlight: map[string]chan struct{}{},
+	}
+	if ic.header == "" {
+		ic.header = defaultIdempotencyHeader
+	}
+	if spec.TTL != "" {
+		// the format of TTL has been checked in validation.
+		ic.ttl, _ = time.ParseDuration(spec.TTL)
+	}
+
+	maxEntries := int(spec.MaxEntries)
+	if maxEntries == 0 {
+		maxEntries = defaultIdempotencyMaxEntries
+	}
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		logger.Errorf("BUG: new lru cache failed: %v", err)
+	}
+	ic.cache = cache
+
+	return ic
+}
+
+// newIdempotencyCaches creates the idempotency caches of all paths, the
+// key of the result map is the idempotency spec of the path.
+func newIdempotencyCaches(rules routers.Rules) map[*routers.Idempotency]*idempotencyCache {
+	caches := map[*routers.Idempotency]*idempotencyCache{}
+	for _, rule := range rules {
+		for _, path := range rule.Paths {
+			if path.Idempotency != nil {
+				caches[path.Idempotency] = newIdempotencyCache(path.Idempotency)
+			}
+		}
+	}
+	return caches
+}
+
+// key returns the cache key of the request, empty if the request doesn't
+// have an idempotency key, or its body is a stream which can't be hashed.
+// The key is scoped to the caller, identified by the Authorization header,
+// or the client IP if there isn't one, so that the same keys of different
+// callers don't collide.
+func (ic *idempotencyCache) key(req *httpprot.Request) string {
+	k := req.HTTPHeader().Get(ic.header)
+	if k == "" || req.IsStream() {
+		return ""
+	}
+
+	caller := req.RealIP()
+	if auth := req.HTTPHeader().Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		caller = hex.EncodeToString(sum[:])
+	}
+	return stringtool.Cat(req.Method(), " ", req.Host(), req.Path(), " ", caller, " ", k)
+}
+
+// bodyHash returns the hash of the request body, a retry with the same
+// key must have the same body.
+func bodyHash(req *httpprot.Request) string {
+	sum := sha256.Sum256(req.RawPayload())
+	return hex.EncodeToString(sum[:])
+}
+
+func (ic *idempotencyCache) get(key string) *cachedResponse {
+	v, ok := ic.cache.Get(key)
+	if !ok {
+		return nil
+	}
+
+	cr := v.(*cachedResponse)
+	if fasttime.Now().After(cr.expireAt) {
+		ic.cache.Remove(key)
+		return nil
+	}
+	return cr
+}
+
+// begin returns the cached response of the key if there is one, otherwise
+// the caller becomes the one handling the key, and must call end after
+// the handling. Concurrent requests with the same key wait for the one
+// handling it, and then replay its response.
+func (ic *idempotencyCache) begin(key string) *cachedResponse {
+	for {
+		ic.lock.Lock()
+		if cr := ic.get(key); cr != nil {
+			ic.lock.Unlock()
+			return cr
+		}
+
+		done, ok := ic.inFlight[key]
+		if !ok {
+			ic.inFlight[key] = make(chan struct{})
+			ic.lock.Unlock()
+			return nil
+		}
+		ic.lock.Unlock()
+
+		// the response may not be cacheable, so check again after the
+		// handling is done, and the request may handle the key itself.
+		<-done
+	}
+}
+
+// end caches the response of the key with the hash of the request body if
+// it is a complete one, server errors are not cached, so that the request
+// can be retried, and wakes up the requests waiting for the key.
+func (ic *idempotencyCache) end(key, bodyHash string, resp *httpprot.Response) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	if resp != nil && !resp.IsStream() && resp.StatusCode() < http.StatusInternalServerError {
+		ic.cache.Add(key, &cachedResponse{
+			statusCode: resp.StatusCode(),
+			header:     resp.HTTPHeader().Clone(),
+			body:       append([]byte(nil), resp.RawPayload()...),
+			expireAt:   fasttime.Now().Add(ic.ttl),
+			bodyHash:   bodyHash,
+		})
+	}
+
+	close(ic.inFlight[key])
+	delete(ic.inFlight, key)
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotency(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	block := make(chan struct{})
+	handle := func(name string, ctx *context.Context) {
+		n := atomic.AddInt32(&calls, 1)
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		if req.HTTPHeader().Get("X-Block") != "" {
+			<-block
+		}
+		resp, _ := httpprot.NewResponse(nil)
+		if req.HTTPHeader().Get("X-Fail") != "" {
+			resp.SetStatusCode(http.StatusInternalServerError)
+		} else {
+			resp.SetStatusCode(http.StatusCreated)
+		}
+		resp.SetPayload(fmt.Sprintf("payment %d", n))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /payments
+    idempotency:
+      ttl: 1m
+    backend: payment-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	body := "amount=10"
+	serve := func(key string, headers ...string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/payments", strings.NewReader(body))
+		stdr.RemoteAddr = "192.168.1.1:1234"
+		if key != "" {
+			stdr.Header.Set("Idempotency-Key", key)
+		}
+		for _, h := range headers {
+			stdr.Header.Set(h, "true")
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	// the first request
+	w := serve("key-1")
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.Equal("payment 1", w.Body.String())
+	assert.Empty(w.Header().Get(idempotentReplayedHeader))
+
+	// the retry is replayed
+	w = serve("key-1")
+	assert.Equal(http.StatusCreated, w.Code)
+	assert.Equal("payment 1", w.Body.String())
+	assert.Equal("true", w.Header().Get(idempotentReplayedHeader))
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	// a different key, and no key
+	assert.Equal("payment 2", serve("key-2").Body.String())
+	assert.Equal("payment 3", serve("").Body.String())
+	assert.Equal("payment 4", serve("").Body.String())
+
+	// server errors are not cached
+	assert.Equal(http.StatusInternalServerError, serve("key-3", "X-Fail").Code)
+	assert.Equal(http.StatusCreated, serve("key-3").Code)
+	assert.Equal(int32(6), atomic.LoadInt32(&calls))
+
+	// concurrent duplicates are coalesced
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = serve("key-4", "X-Block").Body.String()
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(block)
+	wg.Wait()
+
+	assert.Equal(int32(7), atomic.LoadInt32(&calls))
+	for _, body := range bodies {
+		assert.Equal("payment 7", body)
+	}
+
+	// a retry with a different body is rejected.
+	body = "amount=20"
+	w = serve("key-1")
+	assert.Equal(http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(int32(7), atomic.LoadInt32(&calls))
+	body = "amount=10"
+
+	// the same key of another caller is a different key.
+	serveAs := func(key, remoteAddr, auth string) string {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/payments", strings.NewReader(body))
+		stdr.RemoteAddr = remoteAddr
+		stdr.Header.Set("Idempotency-Key", key)
+		if auth != "" {
+			stdr.Header.Set("Authorization", auth)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Body.String()
+	}
+	assert.Equal("payment 8", serveAs("key-1", "192.168.1.2:1234", ""))
+	assert.Equal("payment 8", serveAs("key-1", "192.168.1.2:5678", ""))
+	assert.Equal("payment 9", serveAs("key-1", "192.168.1.2:1234", "Bearer alice"))
+	assert.Equal("payment 10", serveAs("key-1", "192.168.1.2:1234", "Bearer bob"))
+	assert.Equal("payment 9", serveAs("key-1", "192.168.1.3:1234", "Bearer alice"))
+}
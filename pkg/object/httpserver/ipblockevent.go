@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/fasttime"
+)
+
+const (
+	defaultIPBlockEventDedupWindow = 10 * time.Minute
+
+	// maxIPBlockEventEntries is the max count of the IPs remembered for
+	// deduplication, the least recently blocked ones are evicted when it
+	// is reached.
+	maxIPBlockEventEntries = 100000
+)
+
+type (
+	// IPBlockEventsSpec describes the events fired when an IP is blocked
+	// for the first time within DedupWindow.
+	IPBlockEventsSpec struct {
+		DedupWindow string `json:"dedupWindow,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+
+	// IPBlockEvent is the event fired when an IP is newly blocked.
+	IPBlockEvent struct {
+		Server string    `json:"server"`
+		IP     string    `json:"ip"`
+		Reason string    `json:"reason"`
+		Path   string    `json:"path"`
+		Time   time.Time `json:"time"`
+	}
+
+	ipBlockNotifier struct {
+		server string
+		window time.Duration
+
+		// lock makes the lookup and the update of lastFired atomic, so
+		// that an event is never fired twice.
+		lock      sync.Mutex
+		lastFired *lru.Cache
+
+		// now and listener are replaced in unit tests.
+		now      func() time.Time
+		listener func(event *IPBlockEvent)
+	}
+)
+
+func newIPBlockNotifier(server string, spec *IPBlockEventsSpec) *ipBlockNotifier {
+	if spec == nil {
+		return nil
+	}
+
+	lastFired, err := lru.New(maxIPBlockEventEntries)
+	if err != nil {
+		logger.Errorf("BUG: new lru cache failed: %v", err)
+	}
+
+	n := &ipBlockNotifier{
+		server:    server,
+		window:    defaultIPBlockEventDedupWindow,
+		lastFired: lastFired,
+		now:       fasttime.Now,
+		listener:  logIPBlockEvent,
+	}
+	if spec.DedupWindow != "" {
+		n.window, _ = time.ParseDuration(spec.DedupWindow)
+	}
+	return n
+}
+
+// logIPBlockEvent writes the event as a JSON line to the log, so that it
+// could be consumed by security tools.
+func logIPBlockEvent(event *IPBlockEvent) {
+	data, err := codectool.MarshalJSON(event)
+	if err != nil {
+		logger.Errorf("BUG: marshal ip block event failed: %v", err)
+		return
+	}
+	logger.Warnf("ip block event: %s", data)
+}
+
+// notify fires the event if the IP is not blocked within the window, it
+// does nothing if n is nil.
+func (n *ipBlockNotifier) notify(ip, reason, path string) {
+	if n == nil {
+		return
+	}
+
+	now := n.now()
+
+	n.lock.Lock()
+	if last, ok := n.lastFired.Get(ip); ok && now.Sub(last.(time.Time)) < n.window {
+		n.lock.Unlock()
+		return
+	}
+	n.lastFired.Add(ip, now)
+	n.lock.Unlock()
+
+	n.listener(&IPBlockEvent{
+		Server: n.server,
+		IP:     ip,
+		Reason: reason,
+		Path:   path,
+		Time:   now,
+	})
+}
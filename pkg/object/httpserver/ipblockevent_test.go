@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPBlockNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var n *ipBlockNotifier
+	n.notify("192.168.1.1", "", "/")
+
+	n = newIPBlockNotifier("test", &IPBlockEventsSpec{DedupWindow: "1m"})
+	now := time.Now()
+	n.now = func() time.Time { return now }
+	var events []*IPBlockEvent
+	n.listener = func(event *IPBlockEvent) {
+		events = append(events, event)
+	}
+
+	n.notify("192.168.1.1", "reason", "/api")
+	assert.Len(events, 1)
+	assert.Equal(&IPBlockEvent{Server: "test", IP: "192.168.1.1", Reason: "reason", Path: "/api", Time: now}, events[0])
+
+	// repeats within the window
+	now = now.Add(30 * time.Second)
+	n.notify("192.168.1.1", "reason", "/api")
+	assert.Len(events, 1)
+
+	// new IP
+	n.notify("192.168.1.2", "reason", "/api")
+	assert.Len(events, 2)
+
+	// the window expires
+	now = now.Add(30 * time.Second)
+	n.notify("192.168.1.1", "reason", "/api")
+	assert.Len(events, 3)
+
+	// the remembered IPs are bounded.
+	for i := 0; i < maxIPBlockEventEntries+10; i++ {
+		n.notify(strconv.Itoa(i), "reason", "/api")
+	}
+	assert.Equal(maxIPBlockEventEntries, n.lastFired.Len())
+	// the least recently blocked IP is evicted, so it fires again.
+	events = nil
+	n.notify("0", "reason", "/api")
+	assert.Len(events, 1)
+}
+
+func TestIPBlockEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+ipFilter:
+  blockIPs: [192.168.1.0/24]
+ipBlockEvents:
+  dedupWindow: 1m
+rules:
+- paths:
+  - path: /admin
+    ipFilter:
+      blockIPs: [10.0.0.1]
+    backend: admin-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, nil)
+
+	var events []*IPBlockEvent
+	m.inst.Load().(*muxInstance).ipBlockNotifier.listener = func(event *IPBlockEvent) {
+		events = append(events, event)
+	}
+
+	serve := func(ip string) {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/admin", http.NoBody)
+		stdr.Header.Set("X-Real-Ip", ip)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		assert.Equal(http.StatusForbidden, stdw.Code)
+	}
+
+	serve("192.168.1.1")
+	serve("192.168.1.1")
+	serve("10.0.0.1")
+
+	assert.Len(events, 2)
+	assert.Equal("192.168.1.1", events[0].IP)
+	assert.Equal("/admin", events[0].Path)
+	assert.Equal("blocked by the ip filter of the server, block entry: 192.168.1.0/24", events[0].Reason)
+	assert.Equal("10.0.0.1", events[1].IP)
+	assert.Equal("blocked by the ip filter of the route", events[1].Reason)
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/context"
+)
+
+const (
+	defaultMaintenanceHTMLBody = `<!DOCTYPE html>
+<html>
+<head><title>Service Unavailable</title></head>
+<body><h1>Service Unavailable</h1><p>The service is under maintenance, please try again later.</p></body>
+</html>
+`
+	defaultMaintenanceJSONBody = `{"code":503,"message":"the service is under maintenance"}`
+)
+
+// MaintenanceSpec is the spec of the maintenance mode, all requests are
+// replied with 503 when it is enabled. Browser clients get an HTML page
+// while others get a JSON body.
+type MaintenanceSpec struct {
+	Enabled  bool   `json:"enabled" jsonschema:"omitempty"`
+	HTMLBody string `json:"htmlBody,omitempty" jsonschema:"omitempty"`
+	JSONBody string `json:"jsonBody,omitempty" jsonschema:"omitempty"`
+}
+
+// buildMaintenanceResponse builds the 503 response according to the Accept
+// header of the request.
+func buildMaintenanceResponse(ctx *context.Context, spec *MaintenanceSpec, accept string) {
+	resp := buildFailureResponse(ctx, http.StatusServiceUnavailable)
+
+	if acceptsHTML(accept) {
+		body := spec.HTMLBody
+		if body == "" {
+			body = defaultMaintenanceHTMLBody
+		}
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.SetPayload([]byte(body))
+		return
+	}
+
+	body := spec.JSONBody
+	if body == "" {
+		body = defaultMaintenanceJSONBody
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.SetPayload([]byte(body))
+}
+
+// acceptsHTML reports whether HTML is preferred to JSON by the Accept header,
+// the media ranges are checked in order and the quality values are ignored.
+func acceptsHTML(accept string) bool {
+	for _, mr := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(mr, ";")
+		switch strings.TrimSpace(strings.ToLower(mediaType)) {
+		case "text/html", "application/xhtml+xml":
+			return true
+		case "application/json":
+			return false
+		}
+	}
+	return false
+}
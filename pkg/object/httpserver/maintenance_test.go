@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenance(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		t.Fatal("request should not be forwarded to backend in maintenance mode")
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+maintenance:
+  enabled: true
+  jsonBody: '{"message":"down for maintenance"}'
+rules:
+- paths:
+  - pathPrefix: /
+    backend: pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(accept string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/index", http.NoBody)
+		stdr.Header.Set("Accept", accept)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	stdw := serve("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	assert.Equal(http.StatusServiceUnavailable, stdw.Code)
+	assert.Equal("text/html; charset=utf-8", stdw.Header().Get("Content-Type"))
+	assert.Equal(defaultMaintenanceHTMLBody, stdw.Body.String())
+
+	stdw = serve("application/json")
+	assert.Equal(http.StatusServiceUnavailable, stdw.Code)
+	assert.Equal("application/json", stdw.Header().Get("Content-Type"))
+	assert.Equal(`{"message":"down for maintenance"}`, stdw.Body.String())
+}
+
+func TestAcceptsHTML(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(acceptsHTML("text/html"))
+	assert.True(acceptsHTML("Text/HTML; q=0.9, application/json"))
+	assert.False(acceptsHTML("application/json, text/html"))
+	assert.False(acceptsHTML("*/*"))
+	assert.False(acceptsHTML(""))
+}
@@ -19,11 +19,18 @@ package httpserver
 
 import (
 	"bytes"
+	stdcontext "context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"text/template"
@@ -41,25 +48,72 @@ import (
 	"github.com/megaease/easegress/pkg/protocols/httpprot/httpstat"
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/codectool"
 	"github.com/megaease/easegress/pkg/util/fasttime"
 	"github.com/megaease/easegress/pkg/util/ipfilter"
 	"github.com/megaease/easegress/pkg/util/readers"
 	"github.com/megaease/easegress/pkg/util/stringtool"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	pathKindAny    = "any"
+	pathKindExact  = "exact"
+	pathKindPrefix = "prefix"
+	pathKindRegexp = "regexp"
 )
 
 const (
 	defaultAccessLogFormat = "[{{Time}}] [{{RemoteAddr}} {{RealIP}} {{Method}} {{URI}} {{Proto}} {{StatusCode}}] [{{Duration}} rx:{{ReqSize}}B tx:{{RespSize}}B] [{{Tags}}]"
+
+	// predefined access log formats.
+	accessLogFormatJSON     = "json"
+	accessLogFormatCommon   = "common"
+	accessLogFormatCombined = "combined"
+
+	// clfTimeFormat is the time format of the NCSA Common Log Format.
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+	// drainingHeader is set to the responses sent while draining if
+	// DrainingHeader is true.
+	drainingHeader = "X-Eg-Draining"
+
+	// eventStreamMediaType is the media type of Server-Sent Events.
+	eventStreamMediaType = "text/event-stream"
 )
 
 type (
 	mux struct {
-		httpStat *httpstat.HTTPStat
-		topN     *httpstat.TopN
+		// inFlight is the count of in-flight requests, it is the first
+		// field to guarantee the 64-bit alignment required by atomic.
+		inFlight int64
+
+		httpStat       *httpstat.HTTPStat
+		topN           *httpstat.TopN
+		routeCacheStat *routeCacheStat
+		// draining is shared by the mux instances, it is set when the
+		// server is about to be closed.
+		draining *atomic.Bool
 
 		inst atomic.Value // *muxInstance
 	}
 
+	// routeCacheStat is shared by the mux instances, so the counters are
+	// kept across reloads.
+	routeCacheStat struct {
+		hits   uint64
+		misses uint64
+	}
+
+	// RouteCacheStatus is the status of the route cache.
+	RouteCacheStatus struct {
+		Hits     uint64 `json:"hits"`
+		Misses   uint64 `json:"misses"`
+		Size     int    `json:"size"`
+		Capacity uint32 `json:"capacity"`
+	}
+
 	muxInstance struct {
 		superSpec          *supervisor.Spec
 		spec               *Spec
@@ -70,78 +124,179 @@ type (
 
 		muxMapper context.MuxMapper
 
-		cache *lru.ARCCache
+		cache          *lru.ARCCache
+		cacheTTL       time.Duration
+		routeCacheStat *routeCacheStat
+		draining       *atomic.Bool
 
 		tracer   *tracing.Tracer
 		ipFilter *ipfilter.IPFilter
+		uaFilter *userAgentFilter
+
+		serviceHours *serviceHours
+		tarpit       *tarpit
+
+		ipBlockNotifier *ipBlockNotifier
+		wellKnownFiles  wellKnownFiles
+		xForwarded      *xForwardedHeaders
+		trustedCIDRs    *trustedCIDRs
+		optionsAllow    string
+		connectAllow    string
+		clientCAs       *x509.CertPool
 
 		router routers.Router
+
+		responseCaches map[*routers.ResponseCache]*responseCache
+
+		idempotencyCaches map[*routers.Idempotency]*idempotencyCache
+
+		requestBodyReadTimeout time.Duration
+		requestTimeout         time.Duration
+		errorResponses         map[int]*ErrorResponse
+
+		slowRequestThreshold time.Duration
+		// warnf logs the slow requests, it is replaced in unit tests.
+		warnf func(template string, args ...interface{})
 	}
 
 	cachedRoute struct {
 		code  int
 		route routers.Route
+		// allow is the Allow header of code 405.
+		allow string
+	}
+
+	// routeCacheEntry is the entry of the route cache, the cached routes
+	// like notFound are shared, so the expiry time is kept here.
+	routeCacheEntry struct {
+		route    *cachedRoute
+		expireAt time.Time
+	}
+
+	// RouteInfo is the serializable description of a route.
+	RouteInfo struct {
+		Host         string   `json:"host,omitempty"`
+		Hosts        []string `json:"hosts,omitempty"`
+		HostRegexp   string   `json:"hostRegexp,omitempty"`
+		HostWildcard string   `json:"hostWildcard,omitempty"`
+		PathKind     string   `json:"pathKind"`
+		Path         string   `json:"path,omitempty"`
+		Methods      []string `json:"methods,omitempty"`
+		Backend      string   `json:"backend"`
+		// Backends are the weighted backends, Backend is the first of them
+		// if they are used.
+		Backends   routers.WeightedBackends `json:"backends,omitempty"`
+		IPFiltered bool                     `json:"ipFiltered"`
 	}
 
 	accessLogFormatter struct {
+		// name is the name of the predefined format, it is empty
+		// if template is used.
+		name     string
 		template *template.Template
 	}
 
 	accessLog struct {
-		Time        string
-		RemoteAddr  string
-		RealIP      string
-		Method      string
-		URI         string
-		Proto       string
-		StatusCode  int
-		Duration    time.Duration
-		ReqSize     uint64
-		RespSize    uint64
-		ReqHeaders  string
-		RespHeaders string
-		Tags        string
+		Time        string        `json:"time"`
+		RemoteAddr  string        `json:"remoteAddr"`
+		RealIP      string        `json:"realIP"`
+		User        string        `json:"user"`
+		Method      string        `json:"method"`
+		URI         string        `json:"uri"`
+		Proto       string        `json:"proto"`
+		StatusCode  int           `json:"statusCode"`
+		Duration    time.Duration `json:"duration"`
+		ReqSize     uint64        `json:"reqSize"`
+		RespSize    uint64        `json:"respSize"`
+		Referer     string        `json:"referer"`
+		UserAgent   string        `json:"userAgent"`
+		ReqHeaders  string        `json:"reqHeaders"`
+		RespHeaders string        `json:"respHeaders"`
+		Tags        string        `json:"tags"`
+
+		startAt time.Time
 	}
 )
 
 var (
-	notFound         = &cachedRoute{code: http.StatusNotFound}
-	forbidden        = &cachedRoute{code: http.StatusForbidden}
-	methodNotAllowed = &cachedRoute{code: http.StatusMethodNotAllowed}
-	badRequest       = &cachedRoute{code: http.StatusBadRequest}
+	notFound   = &cachedRoute{code: http.StatusNotFound}
+	forbidden  = &cachedRoute{code: http.StatusForbidden}
+	badRequest = &cachedRoute{code: http.StatusBadRequest}
 )
 
-func (mi *muxInstance) getRouteFromCache(req *httpprot.Request) *cachedRoute {
-	if mi.cache != nil {
-		key := stringtool.Cat(req.Host(), req.Method(), req.Path())
+// routeCacheEnabled returns whether the routes of the requests with the
+// method are cached, the NoCacheMethods are always routed.
+func (mi *muxInstance) routeCacheEnabled(method string) bool {
+	return mi.cache != nil && !stringtool.StrInSlice(method, mi.spec.NoCacheMethods)
+}
+
+func (mi *muxInstance) getRouteFromCache(context *routers.RouteContext) *cachedRoute {
+	if mi.routeCacheEnabled(context.Request.Method()) {
+		key := stringtool.Cat(context.GetHost(), context.Request.Method(), context.Path)
 		if value, ok := mi.cache.Get(key); ok {
-			return value.(*cachedRoute)
+			entry := value.(*routeCacheEntry)
+			if !entry.expireAt.IsZero() && fasttime.Now().After(entry.expireAt) {
+				mi.cache.Remove(key)
+				return nil
+			}
+			atomic.AddUint64(&mi.routeCacheStat.hits, 1)
+			return entry.route
 		}
 	}
 	return nil
 }
 
-func (mi *muxInstance) putRouteToCache(req *httpprot.Request, rc *cachedRoute) {
-	if mi.cache != nil {
-		key := stringtool.Cat(req.Host(), req.Method(), req.Path())
-		mi.cache.Add(key, rc)
+func (mi *muxInstance) putRouteToCache(context *routers.RouteContext, rc *cachedRoute) {
+	// the not found and method not allowed results are re-evaluated
+	// every time, as the backends may come and go.
+	if rc.route == nil && mi.spec.CachePositiveOnly {
+		return
+	}
+	if mi.routeCacheEnabled(context.Request.Method()) {
+		key := stringtool.Cat(context.GetHost(), context.Request.Method(), context.Path)
+		entry := &routeCacheEntry{route: rc}
+		if mi.cacheTTL > 0 {
+			entry.expireAt = fasttime.Now().Add(mi.cacheTTL)
+		}
+		// concurrent requests missing the same key may all put the route,
+		// the last one wins, which is fine as they got the same result.
+		atomic.AddUint64(&mi.routeCacheStat.misses, 1)
+		mi.cache.Add(key, entry)
+	}
+}
+
+// newRouteContext creates the route context of the request, the escaped
+// path is used for matching if MatchEscapedPath is true.
+func (mi *muxInstance) newRouteContext(req *httpprot.Request) *routers.RouteContext {
+	context := routers.NewContext(req)
+	context.CaseInsensitiveHost = mi.spec.CaseInsensitiveHost
+	context.StripHostTrailingDot = mi.spec.StripHostTrailingDot
+	context.ClientCAs = mi.clientCAs
+	context.ForwardedProtoTrusted = mi.trustedCIDRs.trustedPeer(req)
+	if mi.spec.MatchEscapedPath {
+		context.Path = req.Std().URL.EscapedPath()
 	}
+	return context
 }
 
 func newMux(httpStat *httpstat.HTTPStat, topN *httpstat.TopN,
 	metrics *metrics, mapper context.MuxMapper) *mux {
 	m := &mux{
-		httpStat: httpStat,
-		topN:     topN,
+		httpStat:       httpStat,
+		topN:           topN,
+		routeCacheStat: &routeCacheStat{},
+		draining:       &atomic.Bool{},
 	}
 
 	m.inst.Store(&muxInstance{
-		spec:      &Spec{},
-		tracer:    tracing.NoopTracer,
-		muxMapper: mapper,
-		httpStat:  httpStat,
-		topN:      topN,
-		metrics:   metrics,
+		spec:           &Spec{},
+		tracer:         tracing.NoopTracer,
+		muxMapper:      mapper,
+		httpStat:       httpStat,
+		topN:           topN,
+		routeCacheStat: m.routeCacheStat,
+		draining:       m.draining,
+		metrics:        metrics,
 	})
 
 	return m
@@ -173,6 +328,9 @@ func (m *mux) reload(superSpec *supervisor.Spec, muxMapper context.MuxMapper) {
 	if spec.RouterKind != "" {
 		routerKind = spec.RouterKind
 	}
+	if routerKind == "Ordered" && spec.PathMatchMode == pathMatchModeLongest {
+		routerKind = "OrderedLongest"
+	}
 
 	inst := &muxInstance{
 		superSpec:          superSpec,
@@ -180,13 +338,64 @@ func (m *mux) reload(superSpec *supervisor.Spec, muxMapper context.MuxMapper) {
 		muxMapper:          muxMapper,
 		httpStat:           m.httpStat,
 		topN:               m.topN,
+		routeCacheStat:     m.routeCacheStat,
+		draining:           m.draining,
 		metrics:            oldInst.metrics,
 		ipFilter:           ipfilter.New(spec.IPFilterSpec),
+		uaFilter:           newUserAgentFilter(spec.UserAgentFilter),
+		serviceHours:       newServiceHours(spec.ServiceHours),
+		tarpit:             newTarpit(spec.Tarpit),
+		ipBlockNotifier:    newIPBlockNotifier(superSpec.Name(), spec.IPBlockEvents),
+		wellKnownFiles:     newWellKnownFiles(spec.WellKnownFiles),
+		xForwarded:         newXForwardedHeaders(spec.XForwardedHeaders),
+		trustedCIDRs:       newTrustedCIDRs(spec.TrustedCIDRs),
 		tracer:             tracer,
 		accessLogFormatter: newAccessLogFormatter(spec.AccessLogFormat),
+		warnf:              logger.Warnf,
+	}
+	if spec.RequestBodyReadTimeout != "" {
+		inst.requestBodyReadTimeout, _ = time.ParseDuration(spec.RequestBodyReadTimeout)
+	}
+	if spec.RequestTimeout != "" {
+		inst.requestTimeout, _ = time.ParseDuration(spec.RequestTimeout)
+	}
+	if spec.SlowRequestThreshold != "" {
+		inst.slowRequestThreshold, _ = time.ParseDuration(spec.SlowRequestThreshold)
+	}
+	policies := routers.IPFilterPolicies{}
+	for name, s := range spec.IPFilterPolicies {
+		policies[name] = ipfilter.New(s)
+	}
+	reusable := oldInst.reusableRules(spec)
+	for i, rule := range spec.Rules {
+		if old := reusable[ruleFingerprint(rule)]; old != nil {
+			spec.Rules[i] = old
+			continue
+		}
+		rule.Init(policies)
+		for _, path := range rule.Paths {
+			if path.IsCatchAllRegexp() {
+				logger.Warnf("%s: pathRegexp %s matches any path and shadows the following paths",
+					superSpec.Name(), path.PathRegexp)
+			}
+		}
+	}
+	if spec.RewriteHost != nil {
+		spec.RewriteHost.Init()
 	}
-	spec.Rules.Init()
-	inst.router = routers.Create(routerKind, spec.Rules)
+	inst.router = routers.Inherit(routerKind, spec.Rules, oldInst.router)
+	if spec.ClientCertSoftVerify {
+		inst.clientCAs = spec.clientCAs()
+	}
+	if spec.HandleOptionsAsterisk {
+		inst.optionsAllow = aggregateAllowedMethods(spec.Rules, spec.RouteConnect)
+	}
+	if !spec.RouteConnect {
+		inst.connectAllow = aggregateAllowedMethods(spec.Rules, false)
+	}
+	inst.responseCaches = newResponseCaches(spec.Rules)
+	inst.idempotencyCaches = newIdempotencyCaches(spec.Rules)
+	inst.errorResponses = newErrorResponses(spec.ErrorResponses)
 
 	if spec.CacheSize > 0 {
 		arc, err := lru.NewARC(int(spec.CacheSize))
@@ -195,10 +404,105 @@ func (m *mux) reload(superSpec *supervisor.Spec, muxMapper context.MuxMapper) {
 		}
 		inst.cache = arc
 	}
+	if spec.CacheTTL != "" {
+		inst.cacheTTL, _ = time.ParseDuration(spec.CacheTTL)
+	}
 	m.inst.Store(inst)
 }
 
+// reusableRules returns the initialized rules of the instance keyed by
+// their fingerprints, so that the unchanged rules of the new spec can be
+// reused without compiling their regexps and IP filters again. Nothing is
+// reusable if the IP filter policies referenced by the rules are changed.
+func (mi *muxInstance) reusableRules(spec *Spec) map[string]*routers.Rule {
+	if !reflect.DeepEqual(mi.spec.IPFilterPolicies, spec.IPFilterPolicies) {
+		return nil
+	}
+
+	rules := map[string]*routers.Rule{}
+	for _, rule := range mi.spec.Rules {
+		if fp := ruleFingerprint(rule); fp != "" {
+			rules[fp] = rule
+		}
+	}
+	return rules
+}
+
+// ruleFingerprint returns the fingerprint of the spec of the rule, empty
+// if it fails.
+func ruleFingerprint(rule *routers.Rule) string {
+	data, err := codectool.MarshalJSON(rule)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// RouteCacheStatus returns the status of the route cache, nil is returned
+// if the route cache is disabled.
+func (m *mux) RouteCacheStatus() *RouteCacheStatus {
+	inst := m.inst.Load().(*muxInstance)
+	if inst.cache == nil {
+		return nil
+	}
+
+	return &RouteCacheStatus{
+		Hits:     atomic.LoadUint64(&m.routeCacheStat.hits),
+		Misses:   atomic.LoadUint64(&m.routeCacheStat.misses),
+		Size:     inst.cache.Len(),
+		Capacity: inst.spec.CacheSize,
+	}
+}
+
+// ExportRoutes returns the description of every route of the currently
+// active rules, in the order of their appearance in the spec.
+func (m *mux) ExportRoutes() []RouteInfo {
+	inst := m.inst.Load().(*muxInstance)
+	serverIPFiltered := inst.spec.IPFilterSpec != nil
+
+	routes := []RouteInfo{}
+	for _, rule := range inst.spec.Rules {
+		for _, path := range rule.Paths {
+			ri := RouteInfo{
+				Host:         rule.Host,
+				Hosts:        rule.Hosts,
+				HostRegexp:   rule.HostRegexp,
+				HostWildcard: rule.HostWildcard,
+				Methods:      path.Methods,
+				Backend:      path.GetBackend(),
+				Backends:     path.GetBackends(),
+				IPFiltered:   serverIPFiltered || rule.IPFilterSpec != nil || path.IPFilterSpec != nil || path.IPFilterRef != "",
+			}
+
+			switch {
+			case path.Path != "":
+				ri.PathKind, ri.Path = pathKindExact, path.Path
+			case path.PathPrefix != "":
+				ri.PathKind, ri.Path = pathKindPrefix, path.PathPrefix
+			case path.PathRegexp != "":
+				ri.PathKind, ri.Path = pathKindRegexp, path.PathRegexp
+			default:
+				ri.PathKind = pathKindAny
+			}
+
+			routes = append(routes, ri)
+		}
+	}
+
+	return routes
+}
+
+// drain marks the mux as draining, the responses sent since then close
+// the connections, so that keep-alive clients reconnect elsewhere.
+func (m *mux) drain() {
+	m.draining.Store(true)
+}
+
 func (m *mux) ServeHTTP(stdw http.ResponseWriter, stdr *http.Request) {
+	// The deferred decrement runs on all exit paths, including panics.
+	inFlight := atomic.AddInt64(&m.inFlight, 1)
+	defer atomic.AddInt64(&m.inFlight, -1)
+
 	// HTTP-01 challenges requires HTTP server to listen on port 80, but we
 	// don't know which HTTP server listen on this port (consider there's an
 	// nginx sitting in front of Easegress), so all HTTP servers need to
@@ -209,7 +513,7 @@ func (m *mux) ServeHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 	}
 
 	// Forward to the current muxInstance to handle the request.
-	m.inst.Load().(*muxInstance).serveHTTP(stdw, stdr)
+	m.inst.Load().(*muxInstance).serveHTTP(stdw, stdr, inFlight)
 }
 
 func buildFailureResponse(ctx *context.Context, statusCode int) *httpprot.Response {
@@ -219,30 +523,141 @@ func buildFailureResponse(ctx *context.Context, statusCode int) *httpprot.Respon
 	return resp
 }
 
-func (mi *muxInstance) sendResponse(ctx *context.Context, stdw http.ResponseWriter) (int, uint64, http.Header) {
+// bodyReader records the error of reading the response body, to tell it
+// from the error of writing to the client.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return n, err
+}
+
+// copyAndFlush copies the body to the client like io.Copy, but flushes
+// after each write, so that every chunk is sent without delay.
+func copyAndFlush(stdw http.ResponseWriter, body io.Reader) (int64, error) {
+	flusher, _ := stdw.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			nw, werr := stdw.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// sendResponse sends the response to the client, the body is omitted if
+// headOnly is true, but Content-Length is preserved. The returned bool is
+// true if the connection should be aborted, as reading the body failed
+// after the header is sent.
+func (mi *muxInstance) sendResponse(ctx *context.Context, stdw http.ResponseWriter, headOnly bool) (int, uint64, http.Header, bool) {
 	var resp *httpprot.Response
 	if v := ctx.GetResponse(context.DefaultNamespace); v == nil {
 		logger.Errorf("%s: response is nil", mi.superSpec.Name())
-		resp = buildFailureResponse(ctx, http.StatusServiceUnavailable)
+		resp = mi.buildErrorResponse(ctx, http.StatusServiceUnavailable)
 	} else if r, ok := v.(*httpprot.Response); !ok {
 		logger.Errorf("%s: expect an HTTP response", mi.superSpec.Name())
-		resp = buildFailureResponse(ctx, http.StatusServiceUnavailable)
+		resp = mi.buildErrorResponse(ctx, http.StatusServiceUnavailable)
 	} else {
 		resp = r
 	}
 
+	// Server-Sent Events must reach the client as soon as they are
+	// produced, so they are never spooled or buffered, nor are the other
+	// streaming responses spooled.
+	contentType := resp.HTTPHeader().Get("Content-Type")
+	eventStream := matchMediaType(contentType, []string{eventStreamMediaType})
+
+	// Read the stream body before sending the header, so that the backend
+	// is released before a slow client finishes reading, and a failure
+	// of the backend could still be replied with 502.
+	var spooled io.Reader
+	if mi.spec.ResponseSpoolThreshold > 0 && resp.IsStream() && !headOnly && !matchMediaType(contentType, streamingMediaTypes) {
+		var cleanup func()
+		var err error
+		spooled, cleanup, err = spoolBody(resp.GetPayload(), mi.spec.ResponseSpoolThreshold)
+		defer cleanup()
+		if err != nil {
+			logger.Errorf("%s: failed to spool response body: %v", mi.superSpec.Name(), err)
+			ctx.AddTag("response body spooling failed")
+			resp = mi.buildErrorResponse(ctx, http.StatusBadGateway)
+		}
+	}
+
+	if mi.spec.DefaultErrorBody && resp.StatusCode() >= 400 && !resp.IsStream() && len(resp.RawPayload()) == 0 {
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resp.SetPayload([]byte(http.StatusText(resp.StatusCode())))
+	}
+
+	// Remove the headers leaked by the backend.
+	for _, h := range mi.spec.StripResponseHeaders {
+		resp.HTTPHeader().Del(h)
+	}
+
 	// Send the response
 	header := stdw.Header()
 	for k, v := range resp.HTTPHeader() {
 		header[k] = v
 	}
+	if mi.draining.Load() {
+		header.Set("Connection", "close")
+		if mi.spec.DrainingHeader {
+			header.Set(drainingHeader, "true")
+		}
+	}
+	if headOnly {
+		if header.Get("Content-Length") == "" && !resp.IsStream() {
+			header.Set("Content-Length", strconv.Itoa(len(resp.RawPayload())))
+		}
+		stdw.WriteHeader(resp.StatusCode())
+		return resp.StatusCode(), uint64(resp.MetaSize()), header, false
+	}
+
 	stdw.WriteHeader(resp.StatusCode())
-	respBodySize, _ := io.Copy(stdw, resp.GetPayload())
+	payload := resp.GetPayload()
+	if spooled != nil {
+		payload = spooled
+	}
+	body := &bodyReader{r: payload}
+	var respBodySize int64
+	if eventStream {
+		respBodySize, _ = copyAndFlush(stdw, body)
+	} else {
+		respBodySize, _ = io.Copy(stdw, body)
+	}
+
+	abort := false
+	if body.err != nil {
+		logger.Errorf("%s: failed to read response body: %v", mi.superSpec.Name(), body.err)
+		ctx.AddTag("response body truncated")
+		abort = mi.spec.AbortOnResponseBodyError
+	}
 
-	return resp.StatusCode(), uint64(respBodySize) + uint64(resp.MetaSize()), header
+	return resp.StatusCode(), uint64(respBodySize) + uint64(resp.MetaSize()), header, abort
 }
 
-func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
+// serveHTTP serves the request, inFlight is the count of in-flight
+// requests of the server including this one.
+func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request, inFlight int64) {
 	// Replace the body of the original request with a ByteCountReader, so
 	// that we can calculate the actual request size.
 	body := readers.NewByteCountReader(stdr.Body)
@@ -257,28 +672,78 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 
 	// httpprot.NewRequest never returns an error.
 	req, _ := httpprot.NewRequest(stdr)
+	mi.trustedCIDRs.resolveRealIP(req)
 
 	// Calculate the meta size now, as everything could be modified.
 	reqMetaSize := req.MetaSize()
 	ctx.SetRequest(context.DefaultNamespace, req)
 
-	// get topN here, as the path could be modified later.
-	topN := mi.topN.Stat(req.Path())
+	// get topN and the path here, as the path could be modified later.
+	reqPath := req.Path()
+	topN := mi.topN.Stat(reqPath)
+
+	// Route requests without a Host header, like those from HTTP/1.0
+	// clients, to the default host.
+	if stdr.Host == "" && mi.spec.DefaultHost != "" {
+		stdr.Host = mi.spec.DefaultHost
+	}
+
+	// Strip the trailing slash before the route context is created, so
+	// that the path matched and the key of the route cache agree.
+	if mi.spec.StripTrailingSlash {
+		stripTrailingSlash(stdr.URL)
+	}
+
+	method := stdr.Method
+	routeCtx := mi.newRouteContext(req)
+
+	// Skip the routing of requests with too many query params, as the
+	// routing may parse the query, and requests with disallowed methods.
+	route := badRequest
+	maxQueryParams := int(mi.spec.MaxQueryParams)
+	tooManyQueryParams := maxQueryParams > 0 && countQueryParams(stdr.URL.RawQuery) > maxQueryParams
+	methodDisallowed := len(mi.spec.AllowedMethods) > 0 && !stringtool.StrInSlice(method, mi.spec.AllowedMethods)
+	connectRejected := method == http.MethodConnect && !mi.spec.RouteConnect
+	if !tooManyQueryParams && !methodDisallowed && !connectRejected {
+		route = mi.search(routeCtx)
+	}
+
+	// For a HEAD request to a path only accepting GET, route it as a GET
+	// request, and omit the body of the response.
+	headOnly := false
+	if route.code == http.StatusMethodNotAllowed && mi.spec.AutoHead && method == http.MethodHead {
+		req.SetMethod(http.MethodGet)
+		getRouteCtx := mi.newRouteContext(req)
+		if getRoute := mi.search(getRouteCtx); getRoute.code == 0 {
+			routeCtx, route, headOnly = getRouteCtx, getRoute, true
+		} else {
+			req.SetMethod(method)
+		}
+	}
 
-	routeCtx := routers.NewContext(req)
-	route := mi.search(routeCtx)
 	var respHeader http.Header
+	var tees *teeRequests
+	drainBody := true
+
+	// backend is the backend selected for the request, it is empty if the
+	// request is rejected before the selection.
+	backend := ""
 
 	defer func() {
 		metric, _ := ctx.GetData("HTTP_METRIC").(*httpstat.Metric)
 
+		abort := false
 		if metric == nil {
-			statusCode, respSize, header := mi.sendResponse(ctx, stdw)
+			statusCode, respSize, header, bodyFailed := mi.sendResponse(ctx, stdw, headOnly)
+			abort = bodyFailed
 			ctx.Finish()
+			tees.finish(statusCode)
 
 			// Drain off the body if it has not been, so that we can get the
 			// correct body size.
-			io.Copy(io.Discard, body)
+			if drainBody {
+				io.Copy(io.Discard, body)
+			}
 
 			metric = &httpstat.Metric{
 				StatusCode: statusCode,
@@ -288,14 +753,19 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 			respHeader = header
 		} else { // hijacked, websocket and etc.
 			ctx.Finish()
+			tees.finish(metric.StatusCode)
 		}
 
 		metric.Duration = fasttime.Since(startAt)
 		topN.Stat(metric)
 		mi.httpStat.Stat(metric)
 		if route.code == 0 {
-			mi.exportPrometheusMetrics(metric, route.route.GetBackend())
+			if backend == "" {
+				backend = route.route.GetBackend()
+			}
+			mi.exportPrometheusMetrics(metric, backend)
 		}
+		mi.logSlowRequest(method, reqPath, backend, metric.Duration)
 
 		span.End()
 
@@ -305,78 +775,491 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 				Time:        fasttime.Format(startAt, fasttime.RFC3339Milli),
 				RemoteAddr:  stdr.RemoteAddr,
 				RealIP:      req.RealIP(),
-				Method:      stdr.Method,
+				User:        basicAuthUser(stdr),
+				Method:      method,
 				URI:         stdr.RequestURI,
 				Proto:       stdr.Proto,
 				StatusCode:  metric.StatusCode,
 				Duration:    metric.Duration,
 				ReqSize:     metric.ReqSize,
 				RespSize:    metric.RespSize,
+				Referer:     stdr.Referer(),
+				UserAgent:   stdr.UserAgent(),
 				Tags:        ctx.Tags(),
 				ReqHeaders:  printHeader(stdr.Header),
 				RespHeaders: printHeader(respHeader),
+				startAt:     startAt,
 			}
 			return mi.accessLogFormatter.format(log)
 		})
+
+		// net/http closes the connection, or resets the stream of HTTP/2,
+		// for this panic without logging.
+		if abort {
+			panic(http.ErrAbortHandler)
+		}
 	}()
 
+	if max := mi.concurrencyLimit(route); max > 0 && inFlight > max {
+		ctx.AddTag(stringtool.Cat("concurrent requests exceed ", strconv.FormatInt(max, 10)))
+		mi.buildErrorResponse(ctx, http.StatusServiceUnavailable)
+		return
+	}
+
+	if mt := mi.spec.Maintenance; mt != nil && mt.Enabled {
+		ctx.AddTag("maintenance")
+		buildMaintenanceResponse(ctx, mt, stdr.Header.Get("Accept"))
+		return
+	}
+
+	if mi.spec.DebugEcho && stdr.Header.Get(debugEchoHeader) != "" {
+		ctx.AddTag("debug echo")
+		buildDebugEchoResponse(ctx, req)
+		return
+	}
+
+	if mi.spec.HandleOptionsAsterisk && isOptionsAsterisk(stdr) {
+		ctx.AddTag("options asterisk")
+		buildOptionsAsteriskResponse(ctx, mi.optionsAllow)
+		return
+	}
+
+	if mi.wellKnownFiles.serve(ctx, req) {
+		ctx.AddTag("well-known file")
+		return
+	}
+
+	if ok, retryAfter := mi.serviceHours.allow(req.Path()); !ok {
+		ctx.AddTag("out of service hours")
+		resp := mi.buildErrorResponse(ctx, mi.serviceHours.statusCode())
+		secs := (retryAfter + time.Second - 1) / time.Second
+		resp.HTTPHeader().Set("Retry-After", strconv.Itoa(int(secs)))
+		return
+	}
+
+	if mi.spec.RejectEmptyHost && stdr.Host == "" {
+		ctx.AddTag("host is empty")
+		mi.buildErrorResponse(ctx, http.StatusBadRequest)
+		return
+	}
+
+	if methodDisallowed {
+		ctx.AddTag(stringtool.Cat("method ", method, " is not allowed"))
+		resp := mi.buildErrorResponse(ctx, http.StatusMethodNotAllowed)
+		resp.HTTPHeader().Set("Allow", strings.Join(mi.spec.AllowedMethods, ", "))
+		return
+	}
+
+	if connectRejected {
+		ctx.AddTag("method CONNECT is not routed")
+		resp := mi.buildErrorResponse(ctx, http.StatusMethodNotAllowed)
+		resp.HTTPHeader().Set("Allow", mi.connectAllow)
+		return
+	}
+
+	if tooManyQueryParams {
+		ctx.AddTag(stringtool.Cat("query params exceed ", strconv.Itoa(maxQueryParams)))
+		mi.buildErrorResponse(ctx, http.StatusBadRequest)
+		return
+	}
+
+	if mi.spec.MaxPathDepth > 0 && pathDepth(req.Path()) > int(mi.spec.MaxPathDepth) {
+		ctx.AddTag(stringtool.Cat("path depth exceeds ", strconv.Itoa(int(mi.spec.MaxPathDepth))))
+		mi.buildErrorResponse(ctx, http.StatusBadRequest)
+		return
+	}
+
+	if ua := stdr.UserAgent(); !mi.uaFilter.allow(ua) {
+		ctx.AddTag(stringtool.Cat("user agent ", ua, " is blocked"))
+		mi.buildErrorResponse(ctx, mi.uaFilter.statusCode())
+		return
+	}
+
+	if route.code == http.StatusMethodNotAllowed && mi.spec.HandleCORSPreflight && isCORSPreflight(stdr) {
+		ctx.AddTag("cors preflight")
+		mi.buildCORSPreflightResponse(ctx, stdr, route.allow)
+		return
+	}
+
 	if route.code != 0 {
+		if route == forbidden {
+			mi.notifyIPBlocked(req)
+			mi.tarpit.hold(stdr.Context())
+		}
 		logger.Errorf("%s: status code of result route for [%s %s]: %d", mi.superSpec.Name(), req.Method(), req.RequestURI, route.code)
-		buildFailureResponse(ctx, route.code)
+		resp := mi.buildErrorResponse(ctx, route.code)
+		if route.allow != "" {
+			resp.HTTPHeader().Set("Allow", route.allow)
+		}
+		return
+	}
+	tagBaggage(span, route.route, routeCtx)
+
+	if headers, code := route.route.GetRequiredHeaders(); len(headers) > 0 {
+		for _, h := range headers {
+			if req.HTTPHeader().Get(h) == "" {
+				ctx.AddTag(stringtool.Cat("required header ", h, " is missing"))
+				mi.buildErrorResponse(ctx, code)
+				return
+			}
+		}
+	}
+
+	if encodings := route.route.GetAllowedRequestEncodings(); len(encodings) > 0 {
+		if ce := req.HTTPHeader().Get("Content-Encoding"); !matchContentEncoding(ce, encodings) {
+			ctx.AddTag(stringtool.Cat("unsupported content encoding ", ce))
+			resp := mi.buildErrorResponse(ctx, http.StatusUnsupportedMediaType)
+			// RFC 7694, the codings accepted are listed in Accept-Encoding.
+			resp.Header().Set("Accept-Encoding", strings.Join(encodings, ", "))
+			return
+		}
+	}
+
+	if types := route.route.GetRequireContentTypeOnWrite(); len(types) > 0 && isWriteMethod(req.Method()) {
+		if ct := req.HTTPHeader().Get("Content-Type"); !matchMediaType(ct, types) {
+			ctx.AddTag(stringtool.Cat("unsupported content type ", ct))
+			mi.buildErrorResponse(ctx, http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	if sl := route.route.GetSignedLink(); sl.Expired(req) {
+		ctx.AddTag("signed link expired")
+		mi.buildErrorResponse(ctx, sl.ExpiredStatusCode)
 		return
 	}
 
-	backend := route.route.GetBackend()
+	if gr := route.route.GetGeoRestrict(); gr.Block(req) {
+		ctx.AddTag("geo restricted")
+		resp := mi.buildErrorResponse(ctx, http.StatusUnavailableForLegalReasons)
+		if gr.Body != "" {
+			resp.SetPayload([]byte(gr.Body))
+		}
+		return
+	}
+
+	backend = route.route.GetBackend()
+	backendReplaced := false
+	if rf := route.route.GetRefererFilter(); !rf.Allow(stdr.Referer()) {
+		ctx.AddTag(stringtool.Cat("referer ", stdr.Referer(), " is blocked"))
+		if rf.Backend == "" {
+			mi.buildErrorResponse(ctx, rf.GetStatusCode())
+			return
+		}
+		backend, backendReplaced = rf.Backend, true
+	} else if b := route.route.GetCanary().Select(req); b != "" {
+		ctx.AddTag("canary")
+		backend, backendReplaced = b, true
+	} else if b := route.route.GetConnBackend(stdr.TLS != nil); b != "" {
+		backend = b
+	} else if b := route.route.GetBackends().Select(req); b != "" {
+		backend = b
+	}
+
 	handler, ok := mi.muxMapper.GetHandler(backend)
 	if !ok {
 		logger.Errorf("%s: backend(Pipeline) %q for [%s %s] not found", mi.superSpec.Name(), req.Method(), req.RequestURI, backend)
-		buildFailureResponse(ctx, http.StatusServiceUnavailable)
+		mi.buildErrorResponse(ctx, http.StatusServiceUnavailable)
 		return
 	}
 	logger.Debugf("%s: the matched backend(Pipeline) for [%s %s] is %q", mi.superSpec.Name(), req.Method(), req.RequestURI, backend)
 
+	path := req.Path()
 	route.route.Rewrite(routeCtx)
+	if mi.spec.MatchEscapedPath && req.Path() != path {
+		// The path is rewritten from the escaped path.
+		u := req.Std().URL
+		if p, err := url.PathUnescape(u.Path); err == nil {
+			u.RawPath, u.Path = u.Path, p
+		}
+	}
+	if rh := route.route.GetRewriteHost(); rh != nil {
+		rh.Rewrite(req)
+	} else {
+		mi.spec.RewriteHost.Rewrite(req)
+	}
 	if mi.spec.XForwardedFor {
 		appendXForwardedFor(req)
 	}
+	mi.xForwarded.set(req)
+	if mi.spec.RequestReceivedAt {
+		setRequestReceivedAt(req, startAt)
+	}
 
 	maxBodySize := route.route.GetClientMaxBodySize()
 	if maxBodySize == 0 {
 		maxBodySize = mi.spec.ClientMaxBodySize
 	}
+	if max := mi.spec.MaxBodySize; max > 0 {
+		if stdr.ContentLength > max {
+			ctx.AddTag(stringtool.Cat("request body exceeds ", strconv.FormatInt(max, 10)))
+			mi.buildErrorResponse(ctx, http.StatusRequestEntityTooLarge)
+			return
+		}
+		// The length of chunked bodies is unknown, limit the reading.
+		if stdr.ContentLength < 0 {
+			stdr.Body = http.MaxBytesReader(stdw, stdr.Body, max)
+		}
+	}
+	if mi.requestBodyReadTimeout > 0 && stdr.Body != http.NoBody {
+		dr := readers.NewDeadlineReader(stdr.Body, mi.requestBodyReadTimeout, bodyReadAborter(stdr))
+		defer dr.Stop()
+		stdr.Body = dr
+	}
+	if backends := route.route.GetTeeBackends(); len(backends) > 0 && route.route.SampleTee() {
+		tees = mi.startTees(span, backends, req, maxBodySize)
+	}
 	err := req.FetchPayload(maxBodySize)
+	if err == readers.ErrDeadlineExceeded {
+		// The client is too slow, don't wait for the rest of the body.
+		logger.Errorf("%s: failed to read request body: %v", mi.superSpec.Name(), err)
+		drainBody = false
+		resp := mi.buildErrorResponse(ctx, http.StatusRequestTimeout)
+		resp.Header().Set("Connection", "close")
+		return
+	}
 	if err == httpprot.ErrRequestEntityTooLarge {
 		logger.Errorf("%s: %s, you may need to increase 'clientMaxBodySize' or set it to -1", mi.superSpec.Name(), err.Error())
-		buildFailureResponse(ctx, http.StatusRequestEntityTooLarge)
+		mi.buildErrorResponse(ctx, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if mbe := (*http.MaxBytesError)(nil); errors.As(err, &mbe) {
+		ctx.AddTag(stringtool.Cat("request body exceeds ", strconv.FormatInt(mbe.Limit, 10)))
+		mi.buildErrorResponse(ctx, http.StatusRequestEntityTooLarge)
 		return
 	}
 	if err != nil {
 		logger.Errorf("%s: failed to read request body: %v", mi.superSpec.Name(), err)
-		buildFailureResponse(ctx, http.StatusBadRequest)
+		mi.buildErrorResponse(ctx, http.StatusBadRequest)
 		return
 	}
 
-	// global filter
-	globalFilter := mi.getGlobalFilter()
-	if globalFilter == nil {
-		handler.Handle(ctx)
+	respCache := mi.responseCaches[route.route.GetResponseCache()]
+	respCacheKey := ""
+	// responses of the placeholder or canary backend must not be cached.
+	if respCache != nil && !backendReplaced && respCache.cacheable(req) {
+		respCacheKey = respCache.key(req)
+		if cr := respCache.get(respCacheKey, req); cr != nil {
+			ctx.AddTag("response cache hit")
+			resp := cr.toResponse()
+			if route.route.GetAutoETag() && autoETagApplicable(req, resp) {
+				replyNotModified(req, resp)
+			}
+			ctx.SetResponse(context.DefaultNamespace, resp)
+			return
+		}
+	}
+
+	if ic := mi.idempotencyCaches[route.route.GetIdempotency()]; ic != nil {
+		if key := ic.key(req); key != "" {
+			hash := bodyHash(req)
+			if cr := ic.begin(key); cr != nil {
+				if cr.bodyHash != hash {
+					ctx.AddTag("idempotency key reused with a different body")
+					mi.buildErrorResponse(ctx, http.StatusUnprocessableEntity)
+					return
+				}
+				ctx.AddTag("idempotent replay")
+				resp := cr.toResponse()
+				resp.Header().Set(idempotentReplayedHeader, "true")
+				ctx.SetResponse(context.DefaultNamespace, resp)
+				return
+			}
+			defer func() {
+				resp, _ := ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response)
+				ic.end(key, hash, resp)
+			}()
+		}
+	}
+
+	handle := func(ctx *context.Context) {
+		// global filter
+		globalFilter := mi.getGlobalFilter()
+		if globalFilter == nil {
+			handler.Handle(ctx)
+		} else {
+			globalFilter.Handle(ctx, handler)
+		}
+	}
+
+	// The deadline is propagated to backends by the context of the
+	// request, and the handler is abandoned if it doesn't stop in time.
+	// The timeout of the route overrides that of the server.
+	timeout := route.route.GetTimeout()
+	if timeout == 0 {
+		timeout = mi.requestTimeout
+	}
+	if timeout <= 0 {
+		handle(ctx)
 	} else {
-		globalFilter.Handle(ctx, handler)
+		timeoutCtx, cancel := stdcontext.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req.Request = req.Request.WithContext(timeoutCtx)
+
+		if !runWithTimeout(timeoutCtx, ctx, handle) {
+			// The abandoned context is still used by the handler, which
+			// finishes it and closes its response on return, so the
+			// timeout response is sent from a new context, and the body,
+			// which may be being read by the handler, is not drained.
+			ctx = context.New(span)
+			drainBody = false
+			ctx.AddTag(stringtool.Cat("request timeout ", timeout.String()))
+			mi.buildTimeoutResponse(ctx, route.route)
+			return
+		}
+	}
+
+	if timeout > 0 && req.Context().Err() == stdcontext.DeadlineExceeded {
+		ctx.AddTag(stringtool.Cat("request timeout ", timeout.String()))
+		mi.buildTimeoutResponse(ctx, route.route)
+		return
+	}
+
+	resp, _ := ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response)
+	if resp != nil {
+		route.route.RewriteLocation(resp.HTTPHeader())
+		if ct := route.route.GetForceResponseContentType(); ct != "" {
+			resp.HTTPHeader().Set("Content-Type", ct)
+		}
+		if cc := mi.spec.DefaultCacheControl; cc != "" && resp.HTTPHeader().Get("Cache-Control") == "" {
+			resp.HTTPHeader().Set("Cache-Control", cc)
+		}
+	}
+	autoETag := route.route.GetAutoETag() && autoETagApplicable(req, resp)
+	if autoETag {
+		setWeakETag(resp)
+	}
+
+	if respCacheKey != "" {
+		respCache.put(respCacheKey, req, resp)
+	}
+
+	// the backend is exposed after caching, so that it isn't replayed to
+	// the other clients.
+	if resp != nil && mi.exposeBackend(stdr) {
+		resp.HTTPHeader().Set(mi.spec.ExposeBackendHeader, backend)
+	}
+
+	// the full response is cached before it is replaced with 304.
+	if autoETag && replyNotModified(req, resp) {
+		ctx.AddTag("not modified")
+	}
+}
+
+// isWriteMethod returns if the method writes to the resource.
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
+	}
+	return false
+}
+
+// matchMediaType returns if the media type of the Content-Type is one of
+// the types, the params like charset are ignored.
+func matchMediaType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if strings.EqualFold(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchContentEncoding returns if all codings of the Content-Encoding are
+// one of the encodings, the missing and identity ones are always matched.
+func matchContentEncoding(contentEncoding string, encodings []string) bool {
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.TrimSpace(coding)
+		if coding == "" || strings.EqualFold(coding, "identity") {
+			continue
+		}
+		matched := false
+		for _, e := range encodings {
+			if strings.EqualFold(coding, e) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// exposeBackend returns if the backend serving the request should be set
+// on its response.
+func (mi *muxInstance) exposeBackend(stdr *http.Request) bool {
+	if mi.spec.ExposeBackendHeader == "" {
+		return false
+	}
+	debug := mi.spec.ExposeBackendDebugHeader
+	return debug == "" || stdr.Header.Get(debug) != ""
+}
+
+// logSlowRequest logs the request if its duration exceeds the slow
+// request threshold.
+func (mi *muxInstance) logSlowRequest(method, path, backend string, d time.Duration) {
+	if mi.slowRequestThreshold <= 0 || d <= mi.slowRequestThreshold {
+		return
 	}
+	mi.warnf("%s: slow request %s %s to backend %q took %v, exceeding %v",
+		mi.superSpec.Name(), method, path, backend, d, mi.slowRequestThreshold)
+}
+
+// concurrencyLimit returns the max count of in-flight requests for the
+// request to the route, 0 means no limit. The slots reserved for high
+// priority routes, whose priority is greater than 0, are excluded for
+// the others, so that they are shed first.
+func (mi *muxInstance) concurrencyLimit(route *cachedRoute) int64 {
+	max := int64(mi.spec.MaxConcurrentRequests)
+	if max == 0 {
+		return 0
+	}
+	if route.route != nil && route.route.GetPriority() > 0 {
+		return max
+	}
+	return max - int64(mi.spec.HighPriorityReserve)
+}
+
+// notifyIPBlocked fires the event of the blocked IP of the request, the
+// blocking entry is reported if the IP is blocked by the server.
+func (mi *muxInstance) notifyIPBlocked(req *httpprot.Request) {
+	if mi.ipBlockNotifier == nil {
+		return
+	}
+
+	ip := req.RealIP()
+	reason := "blocked by the ip filter of the route"
+	if !mi.ipFilter.AllowClient(ip, req.TrustedIP()) {
+		reason = "blocked by the ip filter of the server"
+		if cidr, list := mi.ipFilter.MatchingCIDR(ip); list == ipfilter.ListBlock {
+			reason = stringtool.Cat(reason, ", block entry: ", cidr)
+		}
+	}
+	mi.ipBlockNotifier.notify(ip, reason, req.Path())
 }
 
 func (mi *muxInstance) search(context *routers.RouteContext) *cachedRoute {
 	req := context.Request
 	ip := req.RealIP()
 
-	if !mi.ipFilter.Allow(ip) {
+	// The server-level IP filter must be checked before the cache lookup,
+	// otherwise it would be bypassed by cached routes.
+	if !mi.ipFilter.AllowClient(ip, req.TrustedIP()) {
 		return forbidden
 	}
 
-	// The key of the cache is req.Host + req.Method + req.URL.Path,
+	// The key of the cache is context.GetHost() + req.Method + context.Path,
+	// the host in the key is the same as the one used for matching,
 	// and if a path is cached, we are sure it does not contain any
 	// headers, any queries, and any ipFilters.
-	r := mi.getRouteFromCache(req)
+	r := mi.getRouteFromCache(context)
 	if r != nil {
 		return r
 	}
@@ -386,7 +1269,7 @@ func (mi *muxInstance) search(context *routers.RouteContext) *cachedRoute {
 	if route := context.Route; context.Route != nil {
 		cr := &cachedRoute{code: 0, route: route}
 		if context.Cacheable {
-			mi.putRouteToCache(req, cr)
+			mi.putRouteToCache(context, cr)
 		}
 		return cr
 	}
@@ -399,15 +1282,150 @@ func (mi *muxInstance) search(context *routers.RouteContext) *cachedRoute {
 		return badRequest
 	}
 
+	// The negotiated protocol and the client cert are properties of the
+	// connection, so the result must not be cached.
+	if context.ALPNMismatch || context.ClientCertMismatch {
+		return notFound
+	}
+
 	if context.MethodMismatch {
-		mi.putRouteToCache(req, methodNotAllowed)
-		return methodNotAllowed
+		cr := &cachedRoute{
+			code:  http.StatusMethodNotAllowed,
+			allow: strings.Join(context.AllowedMethods.Names(), ", "),
+		}
+		mi.putRouteToCache(context, cr)
+		return cr
 	}
 
-	mi.putRouteToCache(req, notFound)
+	mi.putRouteToCache(context, notFound)
 	return notFound
 }
 
+// buildTimeoutResponse builds the response for a request not completed in
+// time, the timeout response of the route overrides that of the server.
+func (mi *muxInstance) buildTimeoutResponse(ctx *context.Context, route routers.Route) {
+	tr := route.GetTimeoutResponse()
+	if tr == nil {
+		tr = mi.spec.TimeoutResponse
+	}
+	if tr == nil {
+		mi.buildErrorResponse(ctx, http.StatusGatewayTimeout)
+		return
+	}
+
+	resp := buildFailureResponse(ctx, tr.StatusCode)
+	resp.SetPayload([]byte(tr.Body))
+}
+
+// bodyReadAborter returns the function to unblock the pending read of the
+// request body. For HTTP/1, the read deadline of the connection is set,
+// so the read fails at once, and the connection is closed by net/http
+// after the reply, as the rest of the body can't be read. For HTTP/2 and
+// the requests without a connection, the body is closed, which unblocks
+// the read of HTTP/2, the connection is shared by other streams.
+func bodyReadAborter(stdr *http.Request) func() {
+	if conn, ok := stdr.Context().Value(connContextKey{}).(net.Conn); ok && stdr.ProtoMajor == 1 {
+		return func() {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	body := stdr.Body
+	return func() {
+		body.Close()
+	}
+}
+
+// runWithTimeout runs handle with ctx in a new goroutine, and returns false
+// if it doesn't return before timeoutCtx is done. An abandoned handle
+// finishes ctx when it returns, and a panic of handle is re-raised in the
+// caller if handle is not abandoned.
+func runWithTimeout(timeoutCtx stdcontext.Context, ctx *context.Context, handle func(*context.Context)) bool {
+	done := make(chan struct{})
+	panicChan := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicChan <- p
+			}
+			close(done)
+		}()
+		handle(ctx)
+	}()
+
+	select {
+	case <-done:
+		select {
+		case p := <-panicChan:
+			panic(p)
+		default:
+			return true
+		}
+	case <-timeoutCtx.Done():
+		go func() {
+			<-done
+			select {
+			case p := <-panicChan:
+				logger.Errorf("abandoned handler panic: %v", p)
+			default:
+			}
+			ctx.Finish()
+		}()
+		return false
+	}
+}
+
+// tagBaggage attaches the baggage values used for routing to the span.
+func tagBaggage(span *tracing.Span, route routers.Route, context *routers.RouteContext) {
+	conds := route.GetBaggage()
+	if len(conds) == 0 {
+		return
+	}
+
+	members := context.GetBaggage()
+	for _, c := range conds {
+		span.SetAttributes(attribute.String("baggage."+c.Key, members.Get(c.Key)))
+	}
+}
+
+// stripTrailingSlash trims a single trailing slash from the path of u,
+// the root path "/" is kept.
+func stripTrailingSlash(u *url.URL) {
+	if len(u.Path) <= 1 || !strings.HasSuffix(u.Path, "/") {
+		return
+	}
+	u.Path = u.Path[:len(u.Path)-1]
+	if len(u.RawPath) > 1 && strings.HasSuffix(u.RawPath, "/") {
+		u.RawPath = u.RawPath[:len(u.RawPath)-1]
+	}
+}
+
+// pathDepth returns the count of the non-empty segments of the path, so
+// "/a/b", "/a/b/" and "/a//b" are all of depth 2.
+func pathDepth(path string) int {
+	depth := 0
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" {
+			depth++
+		}
+	}
+	return depth
+}
+
+// countQueryParams returns the count of the key-value pairs of the raw
+// query, the pairs of repeated keys are counted separately, and the empty
+// ones are ignored, so "a=1&a=2&&b" has 3 pairs.
+func countQueryParams(rawQuery string) int {
+	count := 0
+	for rawQuery != "" {
+		var pair string
+		pair, rawQuery, _ = strings.Cut(rawQuery, "&")
+		if pair != "" {
+			count++
+		}
+	}
+	return count
+}
+
 func appendXForwardedFor(r *httpprot.Request) {
 	const xForwardedFor = "X-Forwarded-For"
 
@@ -425,6 +1443,17 @@ func appendXForwardedFor(r *httpprot.Request) {
 	}
 }
 
+// setRequestReceivedAt sets the time the request is received in epoch
+// milliseconds, the time of the upstream proxy, which is earlier, is kept.
+func setRequestReceivedAt(r *httpprot.Request, receivedAt time.Time) {
+	const xRequestReceivedAt = "X-Request-Received-At"
+
+	if r.HTTPHeader().Get(xRequestReceivedAt) != "" {
+		return
+	}
+	r.Header().Set(xRequestReceivedAt, strconv.FormatInt(receivedAt.UnixMilli(), 10))
+}
+
 func (mi *muxInstance) getGlobalFilter() *globalfilter.GlobalFilter {
 	if mi.spec.GlobalFilter == "" {
 		return nil
@@ -469,8 +1498,11 @@ func (mi *muxInstance) exportPrometheusMetrics(stat *httpstat.Metric, backend st
 }
 
 func newAccessLogFormatter(format string) *accessLogFormatter {
-	if format == "" {
+	switch format {
+	case "":
 		format = defaultAccessLogFormat
+	case accessLogFormatJSON, accessLogFormatCommon, accessLogFormatCombined:
+		return &accessLogFormatter{name: format}
 	}
 	varReg := regexp.MustCompile(`\{\{([a-zA-z]*)\}\}`)
 	expr := varReg.ReplaceAllString(format, "{{.$1}}")
@@ -481,6 +1513,19 @@ func newAccessLogFormatter(format string) *accessLogFormatter {
 }
 
 func (formatter *accessLogFormatter) format(log *accessLog) string {
+	switch formatter.name {
+	case accessLogFormatJSON:
+		data, err := codectool.MarshalJSON(log)
+		if err != nil {
+			logger.Errorf("format access log failed: %v", err)
+		}
+		return string(data)
+	case accessLogFormatCommon:
+		return formatCommonLog(log)
+	case accessLogFormatCombined:
+		return stringtool.Cat(formatCommonLog(log), ` "`, clfEscape(log.Referer), `" "`, clfEscape(log.UserAgent), `"`)
+	}
+
 	var buf bytes.Buffer
 	if err := formatter.template.Execute(&buf, log); err != nil {
 		logger.Errorf("format access log failed: %v", err)
@@ -488,6 +1533,44 @@ func (formatter *accessLogFormatter) format(log *accessLog) string {
 	return buf.String()
 }
 
+// formatCommonLog formats the access log in the NCSA Common Log Format:
+// host ident authuser [date] "request" status bytes
+func formatCommonLog(log *accessLog) string {
+	size := "-"
+	if log.RespSize > 0 {
+		size = strconv.FormatUint(log.RespSize, 10)
+	}
+	requestLine := stringtool.Cat(log.Method, " ", log.URI, " ", log.Proto)
+	return stringtool.Cat(
+		clfField(log.RealIP), " - ", clfField(log.User),
+		" [", log.startAt.Format(clfTimeFormat), `] "`, clfEscape(requestLine), `" `,
+		strconv.Itoa(log.StatusCode), " ", size,
+	)
+}
+
+// clfField returns "-" for empty fields as the Common Log Format requires.
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clfEscape escapes a value to be put between double quotes, "-" is
+// returned for empty values.
+func clfEscape(s string) string {
+	if s == "" {
+		return "-"
+	}
+	q := strconv.Quote(s)
+	return q[1 : len(q)-1]
+}
+
+func basicAuthUser(req *http.Request) string {
+	user, _, _ := req.BasicAuth()
+	return user
+}
+
 func printHeader(header http.Header) string {
 	buf := bytes.Buffer{}
 	i := 0
@@ -18,16 +18,27 @@
 package httpserver
 
 import (
+	"bufio"
+	stdcontext "context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
+	"time"
 
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/httpserver/routers"
+	"github.com/megaease/easegress/pkg/util/ipfilter"
 
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/context/contexttest"
@@ -37,13 +48,54 @@ import (
 	"github.com/megaease/easegress/pkg/protocols/httpprot/httpstat"
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func init() {
 	logger.InitNop()
 }
 
+// newTestMux creates a mux loaded with yamlConfig, the requests routed to
+// any backend are handled by handle, or replied with an empty response if
+// handle is nil.
+func newTestMux(t *testing.T, yamlConfig string, handle func(name string, ctx *context.Context)) *mux {
+	t.Helper()
+
+	mm := &contexttest.MockedMuxMapper{}
+	mm.MockedGetHandler = func(name string) (context.Handler, bool) {
+		return &contexttest.MockedHandler{
+			MockedHandle: func(ctx *context.Context) string {
+				if handle == nil {
+					resp, _ := httpprot.NewResponse(nil)
+					ctx.SetOutputResponse(resp)
+					return ""
+				}
+				handle(name, ctx)
+				return ""
+			},
+		}, true
+	}
+
+	m := newMux(httpstat.New(), httpstat.NewTopN(10), newMockMetrics(), mm)
+	reloadTestMux(t, m, yamlConfig)
+	return m
+}
+
+// reloadTestMux reloads m with yamlConfig.
+func reloadTestMux(t *testing.T, m *mux, yamlConfig string) {
+	t.Helper()
+
+	superSpec, err := supervisor.NewSpec(yamlConfig)
+	if err != nil {
+		t.Fatalf("invalid spec: %v", err)
+	}
+	m.reload(superSpec, m.inst.Load().(*muxInstance).muxMapper)
+}
+
 func TestMuxReload(t *testing.T) {
 	assert := assert.New(t)
 	m := newMux(&httpstat.HTTPStat{}, &httpstat.TopN{}, newMockMetrics(), nil)
@@ -421,7 +473,7 @@ rules:
 	stdr, _ = http.NewRequest(http.MethodGet, "http://www.megaease.com/xyz", http.NoBody)
 	stdr.Header.Set("X-Real-Ip", "192.168.1.4")
 	req, _ = httpprot.NewRequest(stdr)
-	assert.Equal(methodNotAllowed, mi.search(routers.NewContext(req)))
+	assert.Equal(http.StatusMethodNotAllowed, mi.search(routers.NewContext(req)).code)
 
 	// has no required header
 	stdr, _ = http.NewRequest(http.MethodGet, "http://www.megaease.com/123", http.NoBody)
@@ -633,13 +685,2923 @@ rules:
 
 }
 
-func TestAccessLog(t *testing.T) {
-	log := &accessLog{
-		Method:  "GET",
-		URI:     "127.0.0.1",
-		ReqSize: 100,
+func TestRequiredHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /internal
+    requiredHeaders: [X-Internal-Auth, X-Tenant]
+    backend: internal-pipeline
+  - path: /custom
+    requiredHeaders: [X-Internal-Auth]
+    requiredHeadersStatusCode: 401
+    backend: internal-pipeline
+  - path: /public
+    requiredHeaders: []
+    backend: public-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(path string, headers map[string]string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		for k, v := range headers {
+			stdr.Header.Set(k, v)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	all := map[string]string{"X-Internal-Auth": "token", "X-Tenant": "t1"}
+	assert.Equal(http.StatusOK, serve("/internal", all))
+	assert.Equal(http.StatusBadRequest, serve("/internal", map[string]string{"X-Internal-Auth": "token"}))
+	assert.Equal(http.StatusUnauthorized, serve("/custom", nil))
+	assert.Equal(http.StatusOK, serve("/public", nil))
+}
+
+func TestRewriteLocationHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetStatusCode(http.StatusFound)
+		resp.Header().Set("Location", "http://internal-svc:8080/login?from=/api")
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /api
+    rewriteLocationHeader:
+      match: ^http://internal-svc:8080/
+      replacement: https://www.megaease.com/
+    backend: api-pipeline
+  - path: /raw
+    backend: api-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	stdw := serve("/api")
+	assert.Equal(http.StatusFound, stdw.Code)
+	assert.Equal("https://www.megaease.com/login?from=/api", stdw.Header().Get("Location"))
+
+	stdw = serve("/raw")
+	assert.Equal(http.StatusFound, stdw.Code)
+	assert.Equal("http://internal-svc:8080/login?from=/api", stdw.Header().Get("Location"))
+}
+
+func TestStripResponseHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.Header().Set("Server", "nginx/1.18.0")
+		resp.Header().Set("X-Powered-By", "PHP/7.4")
+		resp.Header().Set("X-Request-Id", "123")
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+stripResponseHeaders: [Server, x-powered-by]
+rules:
+- paths:
+  - path: /api
+    backend: api-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+	stdw := httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Empty(stdw.Header().Values("Server"))
+	assert.Empty(stdw.Header().Values("X-Powered-By"))
+	assert.Equal("123", stdw.Header().Get("X-Request-Id"))
+}
+
+type slowReader struct {
+	unblock chan struct{}
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.unblock:
+		return 0, io.EOF
+	case <-time.After(time.Second):
+		p[0] = 'a'
+		return 1, nil
+	}
+}
+
+func (r *slowReader) Close() error {
+	return nil
+}
+
+func TestRequestBodyReadTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+requestBodyReadTimeout: 50ms
+rules:
+- paths:
+  - path: /upload
+    backend: upload-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	body := &slowReader{unblock: make(chan struct{})}
+	defer close(body.unblock)
+
+	stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/upload", body)
+	stdr.ContentLength = 1024
+	stdw := httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal(http.StatusRequestTimeout, stdw.Code)
+	assert.Equal("close", stdw.Header().Get("Connection"))
+
+	stdr, _ = http.NewRequest(http.MethodPost, "http://www.megaease.com/upload", strings.NewReader("hello"))
+	stdw = httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal(http.StatusOK, stdw.Code)
+
+	// over a real connection, the read is aborted by the read deadline of
+	// the connection, which is closed after the reply.
+	srv := httptest.NewUnstartedServer(m)
+	srv.Config.ConnContext = connContext
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	assert.NoError(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	_, err = conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: www.megaease.com\r\nContent-Length: 1024\r\n\r\nhello"))
+	assert.NoError(err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	assert.NoError(err)
+	assert.Equal(http.StatusRequestTimeout, resp.StatusCode)
+	assert.Less(time.Since(start), time.Second)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	_, err = br.ReadByte()
+	assert.Equal(io.EOF, err)
+
+	// a keep-alive connection is not affected by the deadline of the
+	// previous requests.
+	client := srv.Client()
+	for i := 0; i < 2; i++ {
+		resp, err = client.Post(srv.URL+"/upload", "text/plain", strings.NewReader("hello"))
+		assert.NoError(err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestMaxPathDepth(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, pathDepth("/"))
+	assert.Equal(2, pathDepth("/a/b"))
+	assert.Equal(2, pathDepth("/a/b/"))
+	assert.Equal(2, pathDepth("/a//b"))
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+maxPathDepth: 3
+rules:
+- paths:
+  - pathPrefix: /
+    backend: pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(path string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusOK, serve("/a/b"))
+	assert.Equal(http.StatusOK, serve("/a/b/c"))
+	assert.Equal(http.StatusOK, serve("/a/b/c/"))
+	assert.Equal(http.StatusBadRequest, serve("/a/b/c/d"))
+	assert.Equal(http.StatusBadRequest, serve("/a/b/c/d/"))
+}
+
+func TestMaxQueryParams(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, countQueryParams(""))
+	assert.Equal(3, countQueryParams("a=1&a=2&&b"))
+	assert.Equal(2, countQueryParams("a=1&a=1&"))
+
+	handled := 0
+	handle := func(name string, ctx *context.Context) {
+		handled++
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+maxQueryParams: 3
+rules:
+- paths:
+  - pathPrefix: /
+    backend: pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(query string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/search?"+query, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusOK, serve("q=easegress"))
+	assert.Equal(http.StatusOK, serve("q=1&q=2&page=3"))
+	assert.Equal(http.StatusOK, serve("q=1&&q=2&page=3&"))
+	assert.Equal(3, handled)
+
+	// repeated keys are counted separately
+	assert.Equal(http.StatusBadRequest, serve("q=1&q=2&q=3&q=4"))
+	assert.Equal(http.StatusBadRequest, serve("a=1&b=2&c=3&d=4"))
+	assert.Equal(3, handled)
+}
+
+func TestAllowedMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	handled := 0
+	handle := func(name string, ctx *context.Context) {
+		handled++
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+allowedMethods: [GET, HEAD, POST]
+rules:
+- paths:
+  - pathPrefix: /
+    backend: pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com/api", http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	w := serve(http.MethodTrace)
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+	assert.Equal("GET, HEAD, POST", w.Header().Get("Allow"))
+	assert.Equal(http.StatusMethodNotAllowed, serve(http.MethodConnect).Code)
+	assert.Equal(0, handled)
+
+	assert.Equal(http.StatusOK, serve(http.MethodGet).Code)
+	assert.Equal(http.StatusOK, serve(http.MethodPost).Code)
+	assert.Equal(2, handled)
+}
+
+func TestConnect(t *testing.T) {
+	assert := assert.New(t)
+
+	handled := 0
+	handle := func(name string, ctx *context.Context) {
+		handled++
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /tunnel
+    methods: [CONNECT]
+    backend: tunnel-pipeline
+  - pathPrefix: /
+    methods: [GET, POST]
+    backend: pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	// CONNECT is rejected by default.
+	w := serve(http.MethodConnect, "/tunnel")
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+	assert.Equal("GET, POST, OPTIONS", w.Header().Get("Allow"))
+	assert.Equal(0, handled)
+
+	reloadTestMux(t, m, yamlConfig+"routeConnect: true\n")
+
+	assert.Equal(http.StatusOK, serve(http.MethodConnect, "/tunnel").Code)
+	assert.Equal(1, handled)
+	// paths without CONNECT in their methods don't accept it.
+	assert.Equal(http.StatusMethodNotAllowed, serve(http.MethodConnect, "/api").Code)
+	assert.Equal(http.StatusOK, serve(http.MethodGet, "/api").Code)
+	assert.Equal(2, handled)
+}
+
+func TestCaseInsensitivePathRouteCache(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := ""
+	handle := func(name string, ctx *context.Context) {
+		backend = name
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+rules:
+- paths:
+  - path: /API
+    backend: exact-pipeline
+  - path: /api
+    caseInsensitive: true
+    backend: any-case-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string) string {
+		backend = ""
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return backend
+	}
+
+	// twice to serve from the route cache, which is keyed by the raw path.
+	for i := 0; i < 2; i++ {
+		assert.Equal("exact-pipeline", serve("/API"))
+		assert.Equal("any-case-pipeline", serve("/api"))
+		assert.Equal("any-case-pipeline", serve("/Api"))
+	}
+
+	yamlConfig += "routerKind: RadixTree\n"
+	_, err := supervisor.NewSpec(yamlConfig)
+	assert.ErrorContains(err, "caseInsensitive of paths is not supported by the RadixTree router")
+}
+
+func TestDefaultCacheControl(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		if name == "private-pipeline" {
+			resp.Header().Set("Cache-Control", "private, no-store")
+		}
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+defaultCacheControl: public, max-age=60
+rules:
+- paths:
+  - path: /public
+    backend: public-pipeline
+  - path: /private
+    backend: private-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	assert.Equal("public, max-age=60", serve("/public").Header().Get("Cache-Control"))
+	assert.Equal("private, no-store", serve("/private").Header().Get("Cache-Control"))
+}
+
+func TestSignedLink(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - pathPrefix: /download
+    signedLink:
+      signatureParam: sig
+      timestampParam: ts
+      maxAge: 10m
+      expiredStatusCode: 410
+    backend: download-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(query string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/download/a.zip?"+query, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	now := time.Now()
+	assert.Equal(http.StatusOK, serve(fmt.Sprintf("sig=abc&ts=%d", now.Unix())))
+	assert.Equal(http.StatusGone, serve(fmt.Sprintf("sig=abc&ts=%d", now.Add(-time.Hour).Unix())))
+	assert.Equal(http.StatusBadRequest, serve("sig=abc"))
+}
+
+func TestQueryRouteNotCached(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := ""
+	handle := func(name string, ctx *context.Context) {
+		backend = name
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+rules:
+- paths:
+  - path: /experiment
+    queries:
+    - key: variant
+      values: [b]
+    backend: b-pipeline
+  - path: /experiment
+    headers:
+    - key: X-Variant
+      values: [c]
+    backend: c-pipeline
+  - path: /experiment
+    backend: a-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(query string, header string) string {
+		backend = ""
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/experiment"+query, http.NoBody)
+		if header != "" {
+			stdr.Header.Set("X-Variant", header)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return backend
+	}
+
+	// the route of the fallback path must not be cached, as it is chosen
+	// after the query and header of the request are checked.
+	for i := 0; i < 2; i++ {
+		assert.Equal("a-pipeline", serve("", ""))
+		assert.Equal("b-pipeline", serve("?variant=b", ""))
+		assert.Equal("c-pipeline", serve("", "c"))
+		assert.Equal("a-pipeline", serve("?variant=a", ""))
+	}
+}
+
+func TestStripTrailingSlash(t *testing.T) {
+	assert := assert.New(t)
+
+	backend, path := "", ""
+	handle := func(name string, ctx *context.Context) {
+		backend = name
+		path = ctx.GetInputRequest().(*httpprot.Request).Path()
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+stripTrailingSlash: true
+rules:
+- paths:
+  - path: /
+    backend: root-pipeline
+  - path: /foo
+    backend: foo-pipeline
+  - pathPrefix: /static/
+    backend: static-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(p string) int {
+		backend, path = "", ""
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+p, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	// twice to serve from the route cache.
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusOK, serve("/foo/"))
+		assert.Equal("foo-pipeline", backend)
+		assert.Equal("/foo", path)
+
+		assert.Equal(http.StatusOK, serve("/foo"))
+		assert.Equal("foo-pipeline", backend)
+
+		assert.Equal(http.StatusOK, serve("/"))
+		assert.Equal("root-pipeline", backend)
+		assert.Equal("/", path)
+
+		// only a single slash is stripped.
+		assert.Equal(http.StatusNotFound, serve("/foo//"))
+
+		// the prefix ending in a slash still matches its sub paths, but
+		// not itself, as its slash is stripped.
+		assert.Equal(http.StatusOK, serve("/static/css/"))
+		assert.Equal("static-pipeline", backend)
+		assert.Equal("/static/css", path)
+		assert.Equal(http.StatusNotFound, serve("/static/"))
+	}
+}
+
+func TestAbortOnResponseBodyError(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		// the backend fails after sending a part of the body, which
+		// is larger than the write buffer, so the header is sent.
+		resp.SetPayload(io.MultiReader(
+			strings.NewReader(strings.Repeat("a", 64*1024)),
+			iotest.ErrReader(fmt.Errorf("connection reset by backend")),
+		))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - pathPrefix: /
+    backend: test-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	get := func() (int, int, error) {
+		resp, err := http.Get(srv.URL + "/file")
+		if !assert.NoError(err) {
+			return 0, 0, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, len(body), err
+	}
+
+	// the truncated body looks complete to the client.
+	code, n, err := get()
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(64*1024, n)
+	assert.NoError(err)
+
+	reloadTestMux(t, m, yamlConfig+"abortOnResponseBodyError: true\n")
+
+	code, n, err = get()
+	assert.Equal(http.StatusOK, code)
+	assert.LessOrEqual(n, 64*1024)
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+}
+
+func TestEventStreamResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	pr, pw := io.Pipe()
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		resp.SetPayload(pr)
+		ctx.SetOutputResponse(resp)
+	}
+
+	// the event stream is not spooled even if the threshold is set.
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+responseSpoolThreshold: 1024
+rules:
+- paths:
+  - pathPrefix: /
+    backend: test-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	// the header is sent with the first event.
+	go pw.Write([]byte("data: 1\n\n"))
+	resp, err := http.Get(srv.URL + "/events")
+	assert.NoError(err)
+	defer resp.Body.Close()
+
+	// each event is received before the next one is produced.
+	readEvent := func(event string) {
+		buf := make([]byte, len(event))
+		_, err := io.ReadFull(resp.Body, buf)
+		assert.NoError(err)
+		assert.Equal(event, string(buf))
+	}
+	readEvent("data: 1\n\n")
+	go pw.Write([]byte("data: 2\n\n"))
+	readEvent("data: 2\n\n")
+	pw.Close()
+	_, err = io.ReadAll(resp.Body)
+	assert.NoError(err)
+}
+
+func TestCopyAndFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	w := httptest.NewRecorder()
+	body := iotest.OneByteReader(strings.NewReader("data: hello\n\n"))
+	n, err := copyAndFlush(w, body)
+	assert.NoError(err)
+	assert.Equal(int64(len("data: hello\n\n")), n)
+	assert.Equal("data: hello\n\n", w.Body.String())
+	assert.True(w.Flushed)
+
+	// the bytes written before the failure are counted.
+	w = httptest.NewRecorder()
+	body = io.MultiReader(strings.NewReader("data: 1\n\n"), iotest.ErrReader(fmt.Errorf("backend closed")))
+	n, err = copyAndFlush(w, body)
+	assert.Error(err)
+	assert.Equal(int64(len("data: 1\n\n")), n)
+}
+
+func TestConnBackend(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := ""
+	handle := func(name string, ctx *context.Context) {
+		backend = name
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+rules:
+- paths:
+  - path: /both
+    backend: default-pipeline
+    tlsBackend: full-pipeline
+    plaintextBackend: limited-pipeline
+  - path: /tls
+    backend: default-pipeline
+    tlsBackend: full-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string, secure bool) string {
+		backend = ""
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		if secure {
+			stdr.TLS = &tls.ConnectionState{}
+		}
+		m.ServeHTTP(httptest.NewRecorder(), stdr)
+		return backend
+	}
+
+	// twice to serve from the route cache.
+	for i := 0; i < 2; i++ {
+		assert.Equal("limited-pipeline", serve("/both", false))
+		assert.Equal("full-pipeline", serve("/both", true))
+		assert.Equal("default-pipeline", serve("/tls", false))
+		assert.Equal("full-pipeline", serve("/tls", true))
+	}
+}
+
+func TestWeightedBackends(t *testing.T) {
+	assert := assert.New(t)
+
+	counts := map[string]int{}
+	handle := func(name string, ctx *context.Context) {
+		counts[name]++
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+rules:
+- paths:
+  - pathPrefix: /
+    backends:
+    - name: v1
+      weight: 90
+    - name: v2
+      weight: 10
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	// the route is cached, but the backend is selected per request.
+	for i := 0; i < 1000; i++ {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		assert.Equal(http.StatusOK, stdw.Code)
+	}
+	assert.InDelta(900, counts["v1"], 100)
+	assert.InDelta(100, counts["v2"], 100)
+	assert.Equal(1000, counts["v1"]+counts["v2"])
+
+	_, err := supervisor.NewSpec(strings.NewReplacer("weight: 90", "weight: 0", "weight: 10", "weight: 0").Replace(yamlConfig))
+	assert.Error(err)
+}
+
+func TestStripHostTrailingDot(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := ""
+	handle := func(name string, ctx *context.Context) {
+		backend = name
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+rules:
+- host: example.com
+  paths:
+  - pathPrefix: /
+    backend: example-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(host string) int {
+		backend = ""
+		stdr, _ := http.NewRequest(http.MethodGet, "http://"+host+"/foo", http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	// stripHostTrailingDot is on by default.
+
+	// twice to serve from the route cache.
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusOK, serve("example.com."))
+		assert.Equal("example-pipeline", backend)
+		assert.Equal(http.StatusOK, serve("example.com.:8080"))
+		assert.Equal("example-pipeline", backend)
+		assert.Equal(http.StatusOK, serve("example.com"))
+		assert.Equal("example-pipeline", backend)
+
+		// only a single dot is stripped.
+		assert.Equal(http.StatusNotFound, serve("example.com.."))
+	}
+
+	reloadTestMux(t, m, yamlConfig+"stripHostTrailingDot: false\n")
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusNotFound, serve("example.com."))
+		assert.Equal(http.StatusOK, serve("example.com"))
+	}
+
+	// false must survive the round trip of the spec, as it is not the
+	// default.
+	superSpec, err := supervisor.NewSpec(m.inst.Load().(*muxInstance).superSpec.JSONConfig())
+	assert.NoError(err)
+	assert.False(superSpec.ObjectSpec().(*Spec).StripHostTrailingDot)
+}
+
+func TestRouteCacheStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newMux(httpstat.New(), httpstat.NewTopN(10), newMockMetrics(), nil)
+	assert.Nil(m.RouteCacheStatus())
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+rules:
+- paths:
+  - path: /foo
+    backend: foo-pipeline
+`
+	m = newTestMux(t, yamlConfig, nil)
+
+	serve := func(p string) {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+p, http.NoBody)
+		m.ServeHTTP(httptest.NewRecorder(), stdr)
+	}
+
+	serve("/foo")
+	serve("/foo")
+	serve("/foo")
+	serve("/bar")
+	assert.Equal(&RouteCacheStatus{Hits: 2, Misses: 2, Size: 2, Capacity: 100}, m.RouteCacheStatus())
+
+	// the counters are kept across reloads.
+	reloadTestMux(t, m, yamlConfig)
+	serve("/foo")
+	assert.Equal(&RouteCacheStatus{Hits: 2, Misses: 3, Size: 1, Capacity: 100}, m.RouteCacheStatus())
+}
+
+func TestExposeBackendHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - pathPrefix: /
+    backends:
+    - name: v1
+      weight: 90
+    - name: v2
+      weight: 10
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(debug bool) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/foo", http.NoBody)
+		if debug {
+			stdr.Header.Set("X-Debug", "1")
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	// off by default.
+	assert.Empty(serve(true).Header().Get("X-Backend"))
+
+	reloadTestMux(t, m, yamlConfig+"exposeBackendHeader: X-Backend\nexposeBackendDebugHeader: X-Debug\n")
+	for i := 0; i < 10; i++ {
+		assert.Contains([]string{"v1", "v2"}, serve(true).Header().Get("X-Backend"))
+		assert.Empty(serve(false).Header().Get("X-Backend"))
+	}
+
+	// without the gate.
+	reloadTestMux(t, m, yamlConfig+"exposeBackendHeader: X-Backend\n")
+	assert.Contains([]string{"v1", "v2"}, serve(false).Header().Get("X-Backend"))
+}
+
+func TestRouteCacheTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+cacheTTL: 100ms
+rules:
+- paths:
+  - path: /foo
+    backend: foo-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(p string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+p, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusOK, serve("/foo"))
+	assert.Equal(http.StatusNotFound, serve("/bar"))
+	assert.Equal(http.StatusOK, serve("/foo"))
+	assert.Equal(http.StatusNotFound, serve("/bar"))
+	assert.Equal(&RouteCacheStatus{Hits: 2, Misses: 2, Size: 2, Capacity: 100}, m.RouteCacheStatus())
+
+	// the expired routes are searched and cached again.
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(http.StatusOK, serve("/foo"))
+	assert.Equal(http.StatusNotFound, serve("/bar"))
+	assert.Equal(&RouteCacheStatus{Hits: 2, Misses: 4, Size: 2, Capacity: 100}, m.RouteCacheStatus())
+
+	// concurrent requests missing the same key all put the route.
+	time.Sleep(150 * time.Millisecond)
+	before := m.RouteCacheStatus()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(http.StatusOK, serve("/foo"))
+		}()
+	}
+	wg.Wait()
+	status := m.RouteCacheStatus()
+	assert.Equal(uint64(10), status.Hits+status.Misses-before.Hits-before.Misses)
+	assert.Equal(http.StatusOK, serve("/foo"))
+	assert.Equal(status.Hits+1, m.RouteCacheStatus().Hits)
+
+	// no expiry without cacheTTL.
+	reloadTestMux(t, m, strings.Replace(yamlConfig, "cacheTTL: 100ms\n", "", 1))
+	serve("/foo")
+	time.Sleep(150 * time.Millisecond)
+	hits := m.RouteCacheStatus().Hits
+	serve("/foo")
+	assert.Equal(hits+1, m.RouteCacheStatus().Hits)
+}
+
+func TestNoCacheMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+noCacheMethods: [POST]
+rules:
+- paths:
+  - path: /foo
+    backend: foo-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(method, p string) int {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+p, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusOK, serve(http.MethodGet, "/foo"))
+	assert.Equal(http.StatusOK, serve(http.MethodGet, "/foo"))
+	assert.Equal(&RouteCacheStatus{Hits: 1, Misses: 1, Size: 1, Capacity: 100}, m.RouteCacheStatus())
+
+	// POST is routed every time, for both found and not found routes.
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusOK, serve(http.MethodPost, "/foo"))
+		assert.Equal(http.StatusNotFound, serve(http.MethodPost, "/bar"))
+	}
+	assert.Equal(&RouteCacheStatus{Hits: 1, Misses: 1, Size: 1, Capacity: 100}, m.RouteCacheStatus())
+}
+
+func TestCachePositiveOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+cachePositiveOnly: true
+rules:
+- paths:
+  - path: /foo
+    methods: [GET]
+    backend: foo-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(method, p string) int {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+p, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusOK, serve(http.MethodGet, "/foo"))
+	assert.Equal(http.StatusOK, serve(http.MethodGet, "/foo"))
+	assert.Equal(&RouteCacheStatus{Hits: 1, Misses: 1, Size: 1, Capacity: 100}, m.RouteCacheStatus())
+
+	// not found and method not allowed are routed every time.
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusNotFound, serve(http.MethodGet, "/bar"))
+		assert.Equal(http.StatusMethodNotAllowed, serve(http.MethodPost, "/foo"))
+	}
+	assert.Equal(&RouteCacheStatus{Hits: 1, Misses: 1, Size: 1, Capacity: 100}, m.RouteCacheStatus())
+
+	// they are cached without the flag.
+	reloadTestMux(t, m, strings.Replace(yamlConfig, "cachePositiveOnly: true", "cachePositiveOnly: false", 1))
+	hits := m.RouteCacheStatus().Hits
+	assert.Equal(http.StatusNotFound, serve(http.MethodGet, "/bar"))
+	assert.Equal(http.StatusNotFound, serve(http.MethodGet, "/bar"))
+	assert.Equal(hits+1, m.RouteCacheStatus().Hits)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+maxBodySize: 10
+rules:
+- paths:
+  - pathPrefix: /foo
+    backend: foo-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(body string, chunked bool) int {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/foo", strings.NewReader(body))
+		if chunked {
+			stdr.ContentLength = -1
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusOK, serve("0123456789", false))
+	assert.Equal(http.StatusRequestEntityTooLarge, serve("0123456789a", false))
+	assert.Equal(http.StatusOK, serve("0123456789", true))
+	assert.Equal(http.StatusRequestEntityTooLarge, serve("0123456789a", true))
+
+	// zero means unlimited.
+	reloadTestMux(t, m, strings.Replace(yamlConfig, "maxBodySize: 10", "maxBodySize: 0", 1))
+	assert.Equal(http.StatusOK, serve("0123456789a", false))
+	assert.Equal(http.StatusOK, serve("0123456789a", true))
+}
+
+func TestPathMatchModeLongest(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.Header().Set("X-Backend", name)
+		ctx.SetOutputResponse(resp)
+	}
+
+	paths := []string{`
+  - pathPrefix: /api
+    backend: api-pipeline`, `
+  - pathRegexp: ^/api/h
+    backend: regexp-pipeline`, `
+  - pathPrefix: /api/v1
+    backend: v1-pipeline`, `
+  - path: /api/health
+    backend: health-pipeline`,
+	}
+
+	var m *mux
+	reload := func(mode string, paths []string) {
+		yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+pathMatchMode: ` + mode + `
+rules:
+- paths:` + strings.Join(paths, "")
+		m = newTestMux(t, yamlConfig, handle)
+	}
+
+	serve := func(path string) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Header().Get("X-Backend")
+	}
+
+	// the broad prefix shadows the others by default.
+	reload("first", paths)
+	assert.Equal("api-pipeline", serve("/api/health"))
+	assert.Equal("api-pipeline", serve("/api/v1/users"))
+
+	reversed := make([]string, len(paths))
+	for i, p := range paths {
+		reversed[len(paths)-1-i] = p
+	}
+	for _, paths := range [][]string{paths, reversed} {
+		reload("longest", paths)
+		assert.Equal("health-pipeline", serve("/api/health"))
+		assert.Equal("v1-pipeline", serve("/api/v1/users"))
+		assert.Equal("api-pipeline", serve("/api/users"))
+		assert.Equal("api-pipeline", serve("/api/healthz"))
+	}
+
+	// a regexp only wins over the paths matching all.
+	reload("longest", []string{`
+  - backend: any-pipeline`, `
+  - pathRegexp: ^/api/h
+    backend: regexp-pipeline`,
+	})
+	assert.Equal("regexp-pipeline", serve("/api/health"))
+	assert.Equal("any-pipeline", serve("/other"))
+}
+
+func TestRequireContentTypeOnWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - pathPrefix: /api
+    requireContentTypeOnWrite: [application/json]
+    backend: api-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(method, contentType string) int {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com/api/users", strings.NewReader("{}"))
+		if contentType != "" {
+			stdr.Header.Set("Content-Type", contentType)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusUnsupportedMediaType, serve(http.MethodPost, ""))
+	assert.Equal(http.StatusUnsupportedMediaType, serve(http.MethodPut, "text/plain"))
+	assert.Equal(http.StatusUnsupportedMediaType, serve(http.MethodPatch, "application/json;;"))
+	assert.Equal(http.StatusOK, serve(http.MethodPost, "application/json"))
+	assert.Equal(http.StatusOK, serve(http.MethodPatch, "Application/JSON; charset=utf-8"))
+	assert.Equal(http.StatusOK, serve(http.MethodGet, ""))
+	assert.Equal(http.StatusOK, serve(http.MethodDelete, ""))
+}
+
+func TestAllowedRequestEncodings(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /upload
+    allowedRequestEncodings: [gzip]
+    backend: upload-pipeline
+  - path: /plain
+    allowedRequestEncodings: [identity]
+    backend: plain-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(path, encoding string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com"+path, strings.NewReader("data"))
+		if encoding != "" {
+			stdr.Header.Set("Content-Encoding", encoding)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	assert.Equal(http.StatusOK, serve("/upload", "gzip").Code)
+	assert.Equal(http.StatusOK, serve("/upload", "GZIP").Code)
+	assert.Equal(http.StatusOK, serve("/upload", "").Code)
+	assert.Equal(http.StatusOK, serve("/upload", "identity").Code)
+
+	stdw := serve("/upload", "br")
+	assert.Equal(http.StatusUnsupportedMediaType, stdw.Code)
+	assert.Equal("gzip", stdw.Header().Get("Accept-Encoding"))
+	assert.Equal(http.StatusUnsupportedMediaType, serve("/upload", "gzip, br").Code)
+
+	// all compressed bodies are rejected.
+	assert.Equal(http.StatusOK, serve("/plain", "").Code)
+	assert.Equal(http.StatusUnsupportedMediaType, serve("/plain", "gzip").Code)
+}
+func TestSlowRequestLog(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		if strings.HasSuffix(req.Path(), "/slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+slowRequestThreshold: 50ms
+rules:
+- paths:
+  - path: /weighted/slow
+    backends:
+    - name: blue-pipeline
+      weight: 0
+    - name: green-pipeline
+      weight: 1
+  - pathPrefix: /
+    backend: api-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	var logs []string
+	mi := m.inst.Load().(*muxInstance)
+	mi.warnf = func(template string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(template, args...))
+	}
+
+	// stubbed durations
+	mi.logSlowRequest(http.MethodGet, "/fast", "api-pipeline", 5*time.Millisecond)
+	assert.Empty(logs)
+	mi.logSlowRequest(http.MethodGet, "/slow", "api-pipeline", time.Second)
+	assert.Len(logs, 1)
+	assert.Contains(logs[0], `slow request GET /slow to backend "api-pipeline" took 1s`)
+
+	logs = nil
+	serve := func(path string) {
+		stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com"+path, http.NoBody)
+		m.ServeHTTP(httptest.NewRecorder(), stdr)
+	}
+	serve("/fast")
+	assert.Empty(logs)
+	serve("/slow")
+	assert.Len(logs, 1)
+	assert.Contains(logs[0], `slow request POST /slow to backend "api-pipeline"`)
+
+	// the selected backend is reported, not the first of the backends.
+	logs = nil
+	serve("/weighted/slow")
+	assert.Len(logs, 1)
+	assert.Contains(logs[0], `slow request POST /weighted/slow to backend "green-pipeline"`)
+	labels := prometheus.Labels{"routerKind": mi.spec.RouterKind}
+	labels["backend"] = "green-pipeline"
+	assert.Equal(1.0, testutil.ToFloat64(mi.metrics.TotalRequests.With(labels)))
+	labels["backend"] = "blue-pipeline"
+	assert.Equal(0.0, testutil.ToFloat64(mi.metrics.TotalRequests.With(labels)))
+}
+
+func TestMatchEscapedPath(t *testing.T) {
+	assert := assert.New(t)
+
+	var backend, path string
+	handle := func(name string, ctx *context.Context) {
+		backend = name
+		path = ctx.GetInputRequest().(*httpprot.Request).Std().URL.EscapedPath()
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 10
+matchEscapedPath: %v
+rules:
+- paths:
+  - path: /files/a/b
+    backend: nested-pipeline
+  - pathPrefix: /files/
+    rewriteTarget: /storage/
+    backend: files-pipeline
+`
+
+	serve := func(m *mux, p string) {
+		backend, path = "", ""
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+p, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+	}
+
+	// the encoded slash is treated as a path separator
+	m := newTestMux(t, fmt.Sprintf(yamlConfig, false), handle)
+
+	serve(m, "/files/a%2Fb")
+	assert.Equal("nested-pipeline", backend)
+	serve(m, "/files/a/b")
+	assert.Equal("nested-pipeline", backend)
+
+	// the encoded slash is part of a path segment
+	m = newTestMux(t, fmt.Sprintf(yamlConfig, true), handle)
+
+	serve(m, "/files/a/b")
+	assert.Equal("nested-pipeline", backend)
+	serve(m, "/files/a%2Fb")
+	assert.Equal("files-pipeline", backend)
+	assert.Equal("/storage/a%2Fb", path)
+}
+
+func TestBaggageRouting(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte(name))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /api
+    baggage:
+    - key: experiment
+      values: [new-checkout]
+    backend: experiment-pipeline
+  - path: /api
+    backend: default-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(baggage string) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+		if baggage != "" {
+			stdr.Header.Set("baggage", baggage)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Body.String()
+	}
+
+	assert.Equal("experiment-pipeline", serve("userId=alice,experiment=new-checkout"))
+	assert.Equal("default-pipeline", serve("experiment=old-checkout"))
+	assert.Equal("default-pipeline", serve(""))
+
+	// the baggage value used for routing is attached to the span.
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+	stdr.Header.Set("baggage", "experiment=new-checkout")
+	req, _ := httpprot.NewRequest(stdr)
+	routeCtx := routers.NewContext(req)
+	route := m.inst.Load().(*muxInstance).search(routeCtx)
+	assert.Equal("experiment-pipeline", route.route.GetBackend())
+
+	tp := sdktrace.NewTracerProvider()
+	_, s := tp.Tracer("test").Start(stdcontext.Background(), "test")
+	tagBaggage(&tracing.Span{Span: s}, route.route, routeCtx)
+	attrs := s.(sdktrace.ReadOnlySpan).Attributes()
+	assert.Equal([]attribute.KeyValue{attribute.String("baggage.experiment", "new-checkout")}, attrs)
+}
+
+func TestDefaultErrorBody(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		switch name {
+		case "explicit-pipeline":
+			resp.SetStatusCode(http.StatusNotFound)
+			resp.SetPayload([]byte("no such user"))
+		case "ok-pipeline":
+		default:
+			resp.SetStatusCode(http.StatusNotFound)
+		}
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+defaultErrorBody: true
+rules:
+- paths:
+  - path: /bare
+    backend: bare-pipeline
+  - path: /explicit
+    backend: explicit-pipeline
+  - path: /ok
+    backend: ok-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	stdw := serve("/bare")
+	assert.Equal(http.StatusNotFound, stdw.Code)
+	assert.Equal("Not Found", stdw.Body.String())
+	assert.Equal("text/plain; charset=utf-8", stdw.Header().Get("Content-Type"))
+
+	stdw = serve("/explicit")
+	assert.Equal(http.StatusNotFound, stdw.Code)
+	assert.Equal("no such user", stdw.Body.String())
+
+	stdw = serve("/ok")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Empty(stdw.Body.String())
+
+	// responses generated by the server itself
+	stdw = serve("/unknown")
+	assert.Equal(http.StatusNotFound, stdw.Code)
+	assert.Equal("Not Found", stdw.Body.String())
+}
+
+func TestTimeoutResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		// a slow backend, which stops when the request times out.
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		<-req.Context().Done()
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetStatusCode(http.StatusBadGateway)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+requestTimeout: 50ms
+%s
+rules:
+- paths:
+  - path: /analytics
+    timeoutResponse:
+      statusCode: 200
+      body: accepted
+    backend: analytics-pipeline
+  - path: /api
+    backend: api-pipeline
+`
+
+	serve := func(m *mux, path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	m := newTestMux(t, fmt.Sprintf(yamlConfig, ""), handle)
+
+	stdw := serve(m, "/analytics")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("accepted", stdw.Body.String())
+	stdw = serve(m, "/api")
+	assert.Equal(http.StatusGatewayTimeout, stdw.Code)
+
+	// timeout response of the server
+	serverTimeoutResponse := `
+timeoutResponse:
+  statusCode: 503
+  body: try again later`
+	reloadTestMux(t, m, fmt.Sprintf(yamlConfig, serverTimeoutResponse))
+
+	stdw = serve(m, "/analytics")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("accepted", stdw.Body.String())
+	stdw = serve(m, "/api")
+	assert.Equal(http.StatusServiceUnavailable, stdw.Code)
+	assert.Equal("try again later", stdw.Body.String())
+}
+
+func TestRouteTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		// a slow backend, which stops when the request times out.
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+rules:
+- paths:
+  - path: /slow
+    timeout: 20ms
+    backend: slow-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	// the second request uses the cached route.
+	for i := 0; i < 2; i++ {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/slow", http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		assert.Equal(http.StatusGatewayTimeout, stdw.Code)
+	}
+	assert.Equal(uint64(1), m.RouteCacheStatus().Hits)
+}
+
+func TestTimeoutAbandonHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	// the handler ignores the context of the request, and only returns
+	// after release is closed.
+	release := make(chan struct{})
+	pr, pw := io.Pipe()
+	handle := func(name string, ctx *context.Context) {
+		<-release
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload(pr)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+requestTimeout: 20ms
+rules:
+- paths:
+  - path: /slow
+    backend: slow-pipeline
+  - path: /slower
+    timeout: 50ms
+    backend: slow-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	for path, timeout := range map[string]time.Duration{"/slow": 20 * time.Millisecond, "/slower": 50 * time.Millisecond} {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		start := time.Now()
+		m.ServeHTTP(stdw, stdr)
+		assert.Equal(http.StatusGatewayTimeout, stdw.Code)
+		assert.GreaterOrEqual(time.Since(start), timeout)
+		assert.Less(time.Since(start), time.Second)
+	}
+
+	// the responses of the abandoned handlers are closed when they return.
+	close(release)
+	assert.Eventually(func() bool {
+		_, err := pw.Write([]byte("a"))
+		return err == io.ErrClosedPipe
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRunWithTimeoutPanic(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := context.New(nil)
+	assert.PanicsWithValue("boom", func() {
+		runWithTimeout(stdcontext.Background(), ctx, func(*context.Context) {
+			panic("boom")
+		})
+	})
+
+	timeoutCtx, cancel := stdcontext.WithTimeout(stdcontext.Background(), time.Millisecond)
+	defer cancel()
+	finished := make(chan struct{})
+	ctx.OnFinish(func() { close(finished) })
+	release := make(chan struct{})
+	assert.False(runWithTimeout(timeoutCtx, ctx, func(*context.Context) {
+		<-release
+		panic("abandoned")
+	}))
+	close(release)
+	<-finished
+}
+
+func TestStrictIPFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+routerKind: ROUTER_KIND
+rules:
+- host: admin.megaease.com
+  strictIPFilter: true
+  ipFilter:
+    blockIPs: [10.0.0.0/8]
+  paths:
+  - path: /api
+    backend: admin-pipeline
+- paths:
+  - CATCH_ALL
+    backend: default-pipeline
+`
+
+	serve := func(m *mux, host, path, ip string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://"+host+path, http.NoBody)
+		stdr.Header.Set("X-Real-Ip", ip)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	for kind, catchAll := range map[string]string{"Ordered": "pathPrefix: /", "RadixTree": "path: /*"} {
+		config := strings.Replace(yamlConfig, "ROUTER_KIND", kind, 1)
+		config = strings.Replace(config, "CATCH_ALL", catchAll, 1)
+
+		m := newTestMux(t, config, nil)
+
+		// blocked regardless of the path matching
+		assert.Equal(http.StatusForbidden, serve(m, "admin.megaease.com", "/api", "10.0.0.1"), kind)
+		assert.Equal(http.StatusForbidden, serve(m, "admin.megaease.com", "/unknown", "10.0.0.1"), kind)
+		assert.Equal(http.StatusOK, serve(m, "admin.megaease.com", "/api", "192.168.1.1"), kind)
+		assert.Equal(http.StatusOK, serve(m, "www.megaease.com", "/unknown", "10.0.0.1"), kind)
+
+		// the following rules are tried if not strict
+		config = strings.Replace(config, "strictIPFilter: true", "strictIPFilter: false", 1)
+		reloadTestMux(t, m, config)
+		assert.Equal(http.StatusOK, serve(m, "admin.megaease.com", "/unknown", "10.0.0.1"), kind)
+	}
+}
+
+func TestIPFilterRef(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+ipFilterPolicies:
+  admin:
+    allowIPs: [192.168.1.1]
+    blockByDefault: true
+  public:
+    blockIPs: [10.0.0.0/8]
+rules:
+- paths:
+  - pathPrefix: /admin
+    ipFilterRef: admin
+    backend: admin-pipeline
+  - pathPrefix: /console
+    ipFilterRef: admin
+    backend: admin-pipeline
+  - pathPrefix: /public
+    ipFilterRef: public
+    backend: public-pipeline
+`
+
+	serve := func(m *mux, path, ip string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdr.Header.Set("X-Real-Ip", ip)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	m := newTestMux(t, yamlConfig, nil)
+
+	// the admin policy blocks an IP allowed by the public one.
+	assert.Equal(http.StatusOK, serve(m, "/public/index.html", "192.168.1.2"))
+	assert.Equal(http.StatusForbidden, serve(m, "/admin/users", "192.168.1.2"))
+	assert.Equal(http.StatusForbidden, serve(m, "/console", "192.168.1.2"))
+
+	assert.Equal(http.StatusOK, serve(m, "/admin/users", "192.168.1.1"))
+	assert.Equal(http.StatusOK, serve(m, "/console", "192.168.1.1"))
+	assert.Equal(http.StatusForbidden, serve(m, "/public/index.html", "10.0.0.1"))
+
+	for _, ri := range m.ExportRoutes() {
+		assert.True(ri.IPFiltered)
+	}
+
+	spec := &Spec{
+		IPFilterPolicies: map[string]*ipfilter.Spec{"admin": {}},
+		Rules: routers.Rules{{Paths: routers.Paths{
+			{Path: "/admin", IPFilterRef: "admin"},
+			{Path: "/other", IPFilterRef: "other"},
+		}}},
+	}
+	assert.Error(spec.Validate())
+	delete(spec.IPFilterPolicies, "admin")
+	spec.IPFilterPolicies["other"] = &ipfilter.Spec{}
+	assert.Error(spec.Validate())
+	spec.IPFilterPolicies["admin"] = &ipfilter.Spec{}
+	assert.NoError(spec.Validate())
+}
+
+func TestRewriteHost(t *testing.T) {
+	assert := assert.New(t)
+
+	var host string
+	handle := func(name string, ctx *context.Context) {
+		host = ctx.GetInputRequest().(*httpprot.Request).Host()
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+%s
+rules:
+- paths:
+  - path: /legacy
+    rewriteHost:
+      match: ^([^.]+)\.megaease\.com(:\d+)?$
+      replacement: ${1}.internal
+    backend: legacy-pipeline
+  - path: /api
+    backend: api-pipeline
+`
+
+	serve := func(m *mux, url string) {
+		host = ""
+		stdr, _ := http.NewRequest(http.MethodGet, url, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		assert.Equal(http.StatusOK, stdw.Code)
+	}
+
+	m := newTestMux(t, fmt.Sprintf(yamlConfig, ""), handle)
+
+	serve(m, "http://www.megaease.com:8080/api")
+	assert.Equal("www.megaease.com:8080", host)
+	serve(m, "http://www.megaease.com:8080/legacy")
+	assert.Equal("www.internal", host)
+
+	// server-wide rewriting, the per-path one overrides it.
+	serverRewriteHost := `
+rewriteHost:
+  match: ^.*$
+  replacement: localhost`
+	reloadTestMux(t, m, fmt.Sprintf(yamlConfig, serverRewriteHost))
+
+	serve(m, "http://www.megaease.com:8080/api")
+	assert.Equal("localhost", host)
+	serve(m, "http://www.megaease.com:8080/legacy")
+	assert.Equal("www.internal", host)
+}
+
+func TestForceResponseContentType(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.HTTPHeader().Set("Content-Type", "text/plain")
+		resp.SetPayload([]byte(`{"name":"easegress"}`))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /legacy
+    forceResponseContentType: application/json
+    backend: legacy-pipeline
+  - path: /api
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/legacy", http.NoBody)
+	stdw := httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal("application/json", stdw.Header().Get("Content-Type"))
+	assert.Equal(`{"name":"easegress"}`, stdw.Body.String())
+
+	stdr, _ = http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+	stdw = httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal("text/plain", stdw.Header().Get("Content-Type"))
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handle := func(name string, ctx *context.Context) {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		switch req.Path() {
+		case "/slow":
+			entered <- struct{}{}
+			<-release
+		case "/panic":
+			panic("backend panics")
+		}
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+maxConcurrentRequests: 2
+rules:
+- paths:
+  - pathPrefix: /
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	// saturate the limit
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- serve("/slow")
+		}()
+		<-entered
+	}
+
+	assert.Equal(http.StatusServiceUnavailable, serve("/api"))
+
+	// recover when the in-flight requests complete
+	close(release)
+	assert.Equal(http.StatusOK, <-done)
+	assert.Equal(http.StatusOK, <-done)
+	assert.Equal(http.StatusOK, serve("/api"))
+
+	// the counter is decremented when the handler panics
+	assert.Panics(func() { serve("/panic") })
+	assert.Equal(int64(0), atomic.LoadInt64(&m.inFlight))
+	assert.Equal(http.StatusOK, serve("/api"))
+}
+
+func TestRefererFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte(name))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - pathPrefix: /images
+    refererFilter:
+      allowDomains: [www.megaease.com, "*.megaease.cn"]
+      allowEmpty: %v
+    backend: image-pipeline
+  - pathPrefix: /videos
+    refererFilter:
+      allowDomains: [www.megaease.com]
+      backend: placeholder-pipeline
+    backend: video-pipeline
+`
+
+	serve := func(m *mux, path, referer string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		if referer != "" {
+			stdr.Header.Set("Referer", referer)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	m := newTestMux(t, fmt.Sprintf(yamlConfig, false), handle)
+
+	// same domain
+	stdw := serve(m, "/images/logo.png", "https://www.megaease.com/index.html")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("image-pipeline", stdw.Body.String())
+	stdw = serve(m, "/images/logo.png", "https://blog.megaease.cn:8443/")
+	assert.Equal(http.StatusOK, stdw.Code)
+
+	// external domain
+	stdw = serve(m, "/images/logo.png", "https://www.example.com/")
+	assert.Equal(http.StatusForbidden, stdw.Code)
+	stdw = serve(m, "/videos/intro.mp4", "https://www.example.com/")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("placeholder-pipeline", stdw.Body.String())
+
+	// missing referer
+	stdw = serve(m, "/images/logo.png", "")
+	assert.Equal(http.StatusForbidden, stdw.Code)
+
+	reloadTestMux(t, m, fmt.Sprintf(yamlConfig, true))
+	stdw = serve(m, "/images/logo.png", "")
+	assert.Equal(http.StatusOK, stdw.Code)
+}
+
+func TestEmptyHost(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte(name))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+%s
+rules:
+- host: www.megaease.com
+  paths:
+  - path: /api
+    backend: megaease-pipeline
+- host: www.example.com
+  paths:
+  - path: /api
+    backend: example-pipeline
+`
+
+	serve := func(m *mux) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+		stdr.Host = ""
+		stdr.Proto, stdr.ProtoMajor, stdr.ProtoMinor = "HTTP/1.0", 1, 0
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	m := newTestMux(t, fmt.Sprintf(yamlConfig, ""), handle)
+	assert.Equal(http.StatusNotFound, serve(m).Code)
+
+	// route to the default host
+	reloadTestMux(t, m, fmt.Sprintf(yamlConfig, "defaultHost: www.example.com"))
+	stdw := serve(m)
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("example-pipeline", stdw.Body.String())
+
+	// reject
+	reloadTestMux(t, m, fmt.Sprintf(yamlConfig, "rejectEmptyHost: true"))
+	assert.Equal(http.StatusBadRequest, serve(m).Code)
+}
+
+func TestCanary(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte(name))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /api
+    canary:
+      headers:
+      - key: X-Canary
+        values: ["true"]
+      backend: canary-pipeline
+      percent: 100
+    responseCache:
+      ttl: 1m
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(canary bool) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+		if canary {
+			stdr.Header.Set("X-Canary", "true")
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Body.String()
+	}
+
+	// the response of the canary backend is not cached.
+	assert.Equal("canary-pipeline", serve(true))
+	assert.Equal("api-pipeline", serve(false))
+	assert.Equal("canary-pipeline", serve(true))
+}
+
+func TestGeoRestrict(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte(name))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /videos
+    geoRestrict:
+      blockedCountries: [AA, bb]
+      countryHeader: CF-IPCountry
+      body: not available in your region
+    backend: video-pipeline
+  - path: /api
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path, country string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdr.Header.Set("CF-IPCountry", country)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	// restricted country
+	stdw := serve("/videos", "AA")
+	assert.Equal(http.StatusUnavailableForLegalReasons, stdw.Code)
+	assert.Equal("not available in your region", stdw.Body.String())
+	assert.Equal(http.StatusUnavailableForLegalReasons, serve("/videos", "BB").Code)
+
+	// allowed country
+	stdw = serve("/videos", "CC")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("video-pipeline", stdw.Body.String())
+
+	// only the specific route is restricted
+	assert.Equal(http.StatusOK, serve("/api", "AA").Code)
+}
+
+func TestServerIPFilterOnCacheHit(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte("cached"))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+ipFilter:
+  blockIPs: [192.168.1.1]
+rules:
+- paths:
+  - path: /api
+    responseCache:
+      ttl: 1m
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(ip string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+		stdr.Header.Set("X-Real-Ip", ip)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	// populate both the route cache and the response cache.
+	assert.Equal(http.StatusOK, serve("192.168.1.2"))
+	inst := m.inst.Load().(*muxInstance)
+	assert.Equal(1, inst.cache.Len())
+
+	// the server-level IP filter is applied on cache hits.
+	assert.Equal(http.StatusForbidden, serve("192.168.1.1"))
+	assert.Equal(http.StatusOK, serve("192.168.1.2"))
+}
+
+func TestPriorityShedding(t *testing.T) {
+	assert := assert.New(t)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handle := func(name string, ctx *context.Context) {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		if req.HTTPHeader().Get("X-Slow") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+maxConcurrentRequests: 3
+highPriorityReserve: 1
+rules:
+- paths:
+  - pathPrefix: /checkout
+    priority: 10
+    backend: checkout-pipeline
+  - pathPrefix: /
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string, slow bool) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		if slow {
+			stdr.Header.Set("X-Slow", "true")
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	// low priority requests use up the slots not reserved
+	done := make(chan int, 3)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- serve("/api", true)
+		}()
+		<-entered
+	}
+
+	// low priority requests are shed, high priority ones are not
+	assert.Equal(http.StatusServiceUnavailable, serve("/api", false))
+	assert.Equal(http.StatusOK, serve("/checkout", false))
+
+	// high priority requests are shed too when all slots are used up
+	go func() {
+		done <- serve("/checkout", true)
+	}()
+	<-entered
+	assert.Equal(http.StatusServiceUnavailable, serve("/checkout", false))
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusOK, <-done)
+	}
+	assert.Equal(http.StatusOK, serve("/api", false))
+
+	spec := &Spec{MaxConcurrentRequests: 3, HighPriorityReserve: 3}
+	assert.Error(spec.Validate())
+}
+
+func TestCaseInsensitiveHostRouteCache(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 10
+caseInsensitiveHost: true
+rules:
+- host: Example.com
+  paths:
+  - pathPrefix: /
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(host string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://"+host+"/api", http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	cache := m.inst.Load().(*muxInstance).cache
+	assert.Equal(http.StatusOK, serve("Example.com"))
+	assert.Equal(http.StatusOK, serve("example.com"))
+	assert.Equal(http.StatusOK, serve("EXAMPLE.COM:8080"))
+	assert.Equal(1, cache.Len())
+
+	// the host matching is case sensitive by default
+	reloadTestMux(t, m, strings.Replace(yamlConfig, "caseInsensitiveHost: true", "", 1))
+
+	cache = m.inst.Load().(*muxInstance).cache
+	assert.Equal(http.StatusOK, serve("Example.com"))
+	assert.Equal(http.StatusNotFound, serve("example.com"))
+	assert.Equal(2, cache.Len())
+}
+
+func TestSegmentMatchRouting(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte(name))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 10
+rules:
+- paths:
+  - pathPrefix: /
+    segmentMatch:
+    - index: 0
+      prefix: v
+      type: int
+      max: 1
+    backend: v1-pipeline
+  - pathPrefix: /
+    segmentMatch:
+    - index: 0
+      prefix: v
+      type: int
+      min: 2
+    backend: v2-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string) (int, string) {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code, stdw.Body.String()
+	}
+
+	for i := 0; i < 2; i++ {
+		code, body := serve("/v1/users")
+		assert.Equal(http.StatusOK, code)
+		assert.Equal("v1-pipeline", body)
+
+		code, body = serve("/v2/users")
+		assert.Equal(http.StatusOK, code)
+		assert.Equal("v2-pipeline", body)
+
+		code, body = serve("/v10/users")
+		assert.Equal(http.StatusOK, code)
+		assert.Equal("v2-pipeline", body)
+
+		code, _ = serve("/vx/users")
+		assert.Equal(http.StatusNotFound, code)
+	}
+}
+
+func TestReloadReusesUnchangedRules(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte(name))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- host: a.megaease.com
+  paths:
+  - pathRegexp: ^/api/.*
+    backend: a-pipeline
+- host: b.megaease.com
+  paths:
+  - pathPrefix: /
+    backend: B_BACKEND
+- host: c.megaease.com
+  ipFilter:
+    blockIPs: [10.0.0.0/8]
+  paths:
+  - pathPrefix: /
+    backend: c-pipeline
+`
+
+	serve := func(m *mux, host string) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://"+host+"/api/test", http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Body.String()
+	}
+
+	m := newTestMux(t, strings.Replace(yamlConfig, "B_BACKEND", "b-pipeline", 1), handle)
+	oldRules := m.inst.Load().(*muxInstance).spec.Rules
+
+	reloadTestMux(t, m, strings.Replace(yamlConfig, "B_BACKEND", "b2-pipeline", 1))
+	newRules := m.inst.Load().(*muxInstance).spec.Rules
+
+	assert.Same(oldRules[0], newRules[0])
+	assert.NotSame(oldRules[1], newRules[1])
+	assert.Same(oldRules[2], newRules[2])
+
+	assert.Equal("a-pipeline", serve(m, "a.megaease.com"))
+	assert.Equal("b2-pipeline", serve(m, "b.megaease.com"))
+	assert.Equal("c-pipeline", serve(m, "c.megaease.com"))
+
+	// nothing is reused when the IP filter policies change
+	reloadTestMux(t, m, strings.Replace(yamlConfig, "B_BACKEND", "b2-pipeline", 1)+
+		"ipFilterPolicies:\n  admin:\n    allowIPs: [192.168.1.1]\n")
+	for i, rule := range m.inst.Load().(*muxInstance).spec.Rules {
+		assert.NotSame(newRules[i], rule)
+	}
+}
+
+func TestRequestReceivedAt(t *testing.T) {
+	const xRequestReceivedAt = "X-Request-Received-At"
+
+	assert := assert.New(t)
+
+	received := ""
+	handle := func(name string, ctx *context.Context) {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		received = req.HTTPHeader().Get(xRequestReceivedAt)
+		resp, _ := httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+requestReceivedAt: true
+rules:
+- paths:
+  - pathPrefix: /
+    backend: test-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	before := time.Now().UnixMilli()
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/", http.NoBody)
+	stdw := httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal(http.StatusOK, stdw.Code)
+
+	ms, err := strconv.ParseInt(received, 10, 64)
+	assert.NoError(err)
+	// fasttime is updated periodically, so allow some skew.
+	assert.InDelta(before, ms, 1000)
+
+	// the time of the upstream proxy is kept.
+	stdr, _ = http.NewRequest(http.MethodGet, "http://www.megaease.com/", http.NoBody)
+	stdr.Header.Set(xRequestReceivedAt, "1700000000000")
+	stdw = httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal("1700000000000", received)
+}
+
+func TestAutoHead(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		resp, _ := httpprot.NewResponse(nil)
+		resp.Header().Set("X-Method", req.Method())
+		resp.SetPayload("hello")
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+autoHead: %v
+rules:
+- paths:
+  - path: /get
+    methods: [GET]
+    backend: get-pipeline
+  - path: /post
+    methods: [POST]
+    backend: post-pipeline
+`
+	m := newTestMux(t, fmt.Sprintf(yamlConfig, false), handle)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	assert.Equal(http.StatusMethodNotAllowed, serve(http.MethodHead, "/get").Code)
+
+	reloadTestMux(t, m, fmt.Sprintf(yamlConfig, true))
+
+	get := serve(http.MethodGet, "/get")
+	assert.Equal(http.StatusOK, get.Code)
+	assert.Equal("hello", get.Body.String())
+
+	// twice for the cached route
+	for i := 0; i < 2; i++ {
+		head := serve(http.MethodHead, "/get")
+		assert.Equal(http.StatusOK, head.Code)
+		assert.Equal("GET", head.Header().Get("X-Method"))
+		assert.Equal("5", head.Header().Get("Content-Length"))
+		assert.Empty(head.Body.String())
+	}
+
+	assert.Equal(http.StatusMethodNotAllowed, serve(http.MethodHead, "/post").Code)
+}
+
+func TestMuxInstanceSearchALPN(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newMux(httpstat.New(), httpstat.NewTopN(10), newMockMetrics(), nil)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 100
+rules:
+- paths:
+  - path: /h2
+    alpnProtocols: [h2]
+    backend: h2-pipeline
+  - path: /abc
+    alpnProtocols: [h2]
+    backend: h2-pipeline
+  - path: /abc
+    backend: http1-pipeline
+`
+	superSpec, err := supervisor.NewSpec(yamlConfig)
+	assert.NoError(err)
+	assert.NotPanics(func() { m.reload(superSpec, nil) })
+	mi := m.inst.Load().(*muxInstance)
+
+	newReq := func(path string, state *tls.ConnectionState) *httpprot.Request {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdr.TLS = state
+		req, _ := httpprot.NewRequest(stdr)
+		return req
+	}
+
+	h2 := &tls.ConnectionState{NegotiatedProtocol: "h2"}
+	http1 := &tls.ConnectionState{NegotiatedProtocol: "http/1.1"}
+
+	r := mi.search(routers.NewContext(newReq("/abc", h2)))
+	assert.Equal("h2-pipeline", r.route.GetBackend())
+	r = mi.search(routers.NewContext(newReq("/abc", http1)))
+	assert.Equal("http1-pipeline", r.route.GetBackend())
+	r = mi.search(routers.NewContext(newReq("/abc", nil)))
+	assert.Equal("http1-pipeline", r.route.GetBackend())
+
+	// the not found result of an ALPN mismatch is not cached
+	assert.Equal(notFound, mi.search(routers.NewContext(newReq("/h2", http1))))
+	assert.Nil(mi.getRouteFromCache(routers.NewContext(newReq("/h2", http1))))
+	r = mi.search(routers.NewContext(newReq("/h2", h2)))
+	assert.Equal("h2-pipeline", r.route.GetBackend())
+}
+
+func TestMuxExportRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	m := newMux(httpstat.New(), httpstat.NewTopN(10), newMockMetrics(), nil)
+	assert.Empty(m.ExportRoutes())
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- host: www.megaease.com
+  paths:
+  - path: /abc
+    methods: [GET, POST]
+    backend: abc-pipeline
+  - pathPrefix: /api/
+    backend: api-pipeline
+    ipFilter:
+      blockIPs: [192.168.1.3]
+- hostRegexp: "^[^.]+\\.megaease\\.cn$"
+  ipFilter:
+    allowIPs: [192.168.1.0/24]
+  paths:
+  - pathRegexp: ^/v[0-9]+/.*$
+    backend: versioned-pipeline
+  - backend: default-pipeline
+- host: www.megaease.org
+  paths:
+  - pathPrefix: /
+    backends:
+    - name: blue-pipeline
+      weight: 90
+    - name: green-pipeline
+      weight: 10
+`
+	superSpec, err := supervisor.NewSpec(yamlConfig)
+	assert.NoError(err)
+	m.reload(superSpec, nil)
+
+	weighted := routers.WeightedBackends{{Name: "blue-pipeline", Weight: 90}, {Name: "green-pipeline", Weight: 10}}
+	expected := []RouteInfo{
+		{Host: "www.megaease.com", PathKind: "exact", Path: "/abc", Methods: []string{"GET", "POST"}, Backend: "abc-pipeline"},
+		{Host: "www.megaease.com", PathKind: "prefix", Path: "/api/", Backend: "api-pipeline", IPFiltered: true},
+		{HostRegexp: `^[^.]+\.megaease\.cn$`, PathKind: "regexp", Path: "^/v[0-9]+/.*$", Backend: "versioned-pipeline", IPFiltered: true},
+		{HostRegexp: `^[^.]+\.megaease\.cn$`, PathKind: "any", Backend: "default-pipeline", IPFiltered: true},
+		{Host: "www.megaease.org", PathKind: "prefix", Path: "/", Backend: "blue-pipeline", Backends: weighted},
+	}
+	assert.Equal(expected, m.ExportRoutes())
+
+	data, err := json.Marshal(m.ExportRoutes()[:1])
+	assert.NoError(err)
+	assert.JSONEq(`[{"host":"www.megaease.com","pathKind":"exact","path":"/abc","methods":["GET","POST"],"backend":"abc-pipeline","ipFiltered":false}]`, string(data))
+
+	data, err = json.Marshal(m.ExportRoutes()[4:])
+	assert.NoError(err)
+	assert.JSONEq(`[{"host":"www.megaease.org","pathKind":"prefix","path":"/","backend":"blue-pipeline","backends":[{"name":"blue-pipeline","weight":90},{"name":"green-pipeline","weight":10}],"ipFiltered":false}]`, string(data))
+
+	// reloading replaces the exported routes
+	yamlConfig = `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /xyz
+    backend: xyz-pipeline
+`
+	superSpec, err = supervisor.NewSpec(yamlConfig)
+	assert.NoError(err)
+	m.reload(superSpec, nil)
+	assert.Equal([]RouteInfo{{PathKind: "exact", Path: "/xyz", Backend: "xyz-pipeline"}}, m.ExportRoutes())
+}
+
+func TestAccessLog(t *testing.T) {
+	log := &accessLog{
+		Method:  "GET",
+		URI:     "127.0.0.1",
+		ReqSize: 100,
+	}
+	formatter := newAccessLogFormatter("{{Method}} {{URI}} [{{ReqSize}}]")
+	s := formatter.format(log)
+	assert.Equal(t, "GET 127.0.0.1 [100]", s)
+}
+
+func TestAccessLogPredefinedFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	startAt := time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+	log := &accessLog{
+		RealIP:     "127.0.0.1",
+		User:       "frank",
+		Method:     "GET",
+		URI:        "/apache_pb.gif",
+		Proto:      "HTTP/1.0",
+		StatusCode: 200,
+		RespSize:   2326,
+		Referer:    "http://www.example.com/start.html",
+		UserAgent:  `Mozilla/4.08 [en] (Win98; I ;Nav) "quoted"`,
+		startAt:    startAt,
+	}
+
+	s := newAccessLogFormatter("combined").format(log)
+	assert.Equal(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav) \"quoted\""`, s)
+
+	s = newAccessLogFormatter("common").format(log)
+	assert.Equal(`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`, s)
+
+	// empty fields are replaced by "-"
+	log.User, log.Referer, log.UserAgent, log.RespSize = "", "", "", 0
+	s = newAccessLogFormatter("combined").format(log)
+	assert.Equal(`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 - "-" "-"`, s)
+
+	s = newAccessLogFormatter("json").format(log)
+	m := map[string]interface{}{}
+	assert.NoError(json.Unmarshal([]byte(s), &m))
+	assert.Equal("127.0.0.1", m["realIP"])
+	assert.Equal("/apache_pb.gif", m["uri"])
+	assert.Equal(float64(200), m["statusCode"])
+}
+
+func TestDraining(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - pathPrefix: /
+    backend: test-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func() *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/", http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	stdw := serve()
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Empty(stdw.Header().Get("Connection"))
+	assert.Empty(stdw.Header().Get(drainingHeader))
+
+	m.drain()
+	stdw = serve()
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal("close", stdw.Header().Get("Connection"))
+	assert.Empty(stdw.Header().Get(drainingHeader))
+
+	// the draining state is kept across reloads.
+	reloadTestMux(t, m, yamlConfig+"drainingHeader: true\n")
+	stdw = serve()
+	assert.Equal("close", stdw.Header().Get("Connection"))
+	assert.Equal("true", stdw.Header().Get(drainingHeader))
+}
+
+func TestMethodNotAllowedAllowHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+cacheSize: 10
+rules:
+- paths:
+  - path: /users
+    methods: [POST, GET]
+    backend: users-pipeline
+  - pathPrefix: /users
+    methods: [DELETE]
+    backend: users-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	// twice to serve from the route cache.
+	for i := 0; i < 2; i++ {
+		stdw := serve(http.MethodPut, "/users")
+		assert.Equal(http.StatusMethodNotAllowed, stdw.Code)
+		assert.Equal("GET, POST, DELETE", stdw.Header().Get("Allow"))
+
+		stdw = serve(http.MethodPut, "/users/1")
+		assert.Equal(http.StatusMethodNotAllowed, stdw.Code)
+		assert.Equal("DELETE", stdw.Header().Get("Allow"))
+	}
+
+	stdw := serve(http.MethodGet, "/users")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Empty(stdw.Header().Get("Allow"))
+
+	stdw = serve(http.MethodGet, "/unknown")
+	assert.Equal(http.StatusNotFound, stdw.Code)
+	assert.Empty(stdw.Header().Get("Allow"))
+}
+
+func TestIPFilterAllowLoopback(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+ipFilter:
+  blockByDefault: true
+  allowLoopback: true
+  allowIPs: [203.0.113.0/24]
+rules:
+- paths:
+  - pathPrefix: /admin
+    ipFilter:
+      blockByDefault: true
+      allowLoopback: true
+    backend: admin-pipeline
+  - path: /
+    backend: public-pipeline
+`
+
+	plain := newTestMux(t, yamlConfig, nil)
+	trusted := newTestMux(t, yamlConfig+"trustedCIDRs: [127.0.0.0/8]\n", nil)
+
+	cases := []struct {
+		name   string
+		m      *mux
+		path   string
+		peer   string
+		header string
+		value  string
+		code   int
+	}{
+		// a spoofed loopback header doesn't bypass the filters.
+		{"spoofed server", plain, "/", "198.51.100.1", "X-Real-Ip", "127.0.0.1", http.StatusForbidden},
+		{"spoofed path", plain, "/admin", "203.0.113.7", "X-Real-Ip", "127.0.0.1", http.StatusForbidden},
+		{"spoofed forwarded", plain, "/admin", "203.0.113.7", "X-Forwarded-For", "127.0.0.1", http.StatusForbidden},
+
+		// the loopback peer is always allowed.
+		{"loopback server", plain, "/", "127.0.0.1", "", "", http.StatusOK},
+		{"loopback path", plain, "/admin", "127.0.0.1", "", "", http.StatusOK},
+		{"loopback with real ip", plain, "/admin", "127.0.0.1", "X-Real-Ip", "203.0.113.7", http.StatusOK},
+
+		// the real IP resolved by trustedCIDRs is used instead of the peer.
+		{"trusted remote", trusted, "/admin", "127.0.0.1", "X-Forwarded-For", "203.0.113.7", http.StatusForbidden},
+		{"trusted loopback", trusted, "/admin", "127.0.0.1", "X-Forwarded-For", "127.0.0.2", http.StatusOK},
+		{"trusted server", trusted, "/", "127.0.0.1", "X-Forwarded-For", "203.0.113.7", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+c.path, http.NoBody)
+		stdr.RemoteAddr = c.peer + ":12345"
+		if c.header != "" {
+			stdr.Header.Set(c.header, c.value)
+		}
+		stdw := httptest.NewRecorder()
+		c.m.ServeHTTP(stdw, stdr)
+		assert.Equal(c.code, stdw.Code, c.name)
 	}
-	formatter := newAccessLogFormatter("{{Method}} {{URI}} [{{ReqSize}}]")
-	s := formatter.format(log)
-	assert.Equal(t, "GET 127.0.0.1 [100]", s)
 }
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/object/httpserver/routers"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+// allMethods are the methods in the order of the aggregated Allow header.
+var allMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+}
+
+// isOptionsAsterisk returns whether the request is an asterisk-form
+// OPTIONS request, that's "OPTIONS * HTTP/1.1".
+func isOptionsAsterisk(stdr *http.Request) bool {
+	return stdr.Method == http.MethodOptions && stdr.RequestURI == "*"
+}
+
+// aggregateAllowedMethods returns the Allow header aggregated from the
+// methods of all paths of the rules, a path without methods accepts all
+// methods but CONNECT, OPTIONS is always allowed, and CONNECT is allowed
+// only if routeConnect is true.
+func aggregateAllowedMethods(rules routers.Rules, routeConnect bool) string {
+	allowed := map[string]bool{http.MethodOptions: true}
+	for _, rule := range rules {
+		for _, path := range rule.Paths {
+			if len(path.Methods) == 0 {
+				for _, m := range allMethods {
+					if m != http.MethodConnect {
+						allowed[m] = true
+					}
+				}
+			}
+			for _, m := range path.Methods {
+				allowed[m] = true
+			}
+		}
+	}
+
+	methods := make([]string, 0, len(allowed))
+	for _, m := range allMethods {
+		if allowed[m] && (m != http.MethodConnect || routeConnect) {
+			methods = append(methods, m)
+		}
+	}
+	return strings.Join(methods, ", ")
+}
+
+// buildOptionsAsteriskResponse replies 204 with the aggregated Allow header.
+func buildOptionsAsteriskResponse(ctx *context.Context, allow string) {
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(http.StatusNoContent)
+	resp.Header().Set("Allow", allow)
+	ctx.SetResponse(context.DefaultNamespace, resp)
+}
@@ -0,0 +1,27 @@
+//go:build !go1.20
+// +build !go1.20
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import "net/http"
+
+// disableGeneralOptionsHandler is a no-op before Go 1.20, the asterisk-form
+// OPTIONS requests are always replied by net/http over HTTP/1 and HTTP/2.
+func disableGeneralOptionsHandler(srv *http.Server) {}
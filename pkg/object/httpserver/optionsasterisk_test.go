@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/object/httpserver/routers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateAllowedMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	rules := routers.Rules{
+		{Paths: []*routers.Path{{Path: "/a", Methods: []string{"POST", "GET"}}}},
+		{Paths: []*routers.Path{{Path: "/b", Methods: []string{"DELETE", "GET"}}}},
+	}
+	assert.Equal("GET, POST, DELETE, OPTIONS", aggregateAllowedMethods(rules, false))
+
+	rules = append(rules, &routers.Rule{Paths: []*routers.Path{{Path: "/c"}}})
+	assert.Equal("GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE", aggregateAllowedMethods(rules, false))
+
+	rules = append(rules, &routers.Rule{Paths: []*routers.Path{{Path: "/d", Methods: []string{"CONNECT"}}}})
+	assert.Equal("GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE", aggregateAllowedMethods(rules, false))
+	assert.Equal("GET, HEAD, POST, PUT, PATCH, DELETE, CONNECT, OPTIONS, TRACE", aggregateAllowedMethods(rules, true))
+}
+
+func TestOptionsAsterisk(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+handleOptionsAsterisk: true
+rules:
+- paths:
+  - pathPrefix: /api
+    methods: [GET, POST]
+    backend: api-pipeline
+  - pathPrefix: /files
+    methods: [GET, PUT, DELETE]
+    backend: file-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(raw string) *httptest.ResponseRecorder {
+		stdr, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+		assert.NoError(err)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	w := serve("OPTIONS * HTTP/1.1\r\nHost: www.megaease.com\r\n\r\n")
+	assert.Equal(http.StatusNoContent, w.Code)
+	assert.Equal("GET, POST, PUT, DELETE, OPTIONS", w.Header().Get("Allow"))
+
+	// OPTIONS requests to paths are routed normally
+	w = serve("OPTIONS /api HTTP/1.1\r\nHost: www.megaease.com\r\n\r\n")
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+
+	// falls through to 404 when disabled
+	reloadTestMux(t, m, strings.Replace(yamlConfig, "handleOptionsAsterisk: true", "", 1))
+	w = serve("OPTIONS * HTTP/1.1\r\nHost: www.megaease.com\r\n\r\n")
+	assert.Equal(http.StatusNotFound, w.Code)
+}
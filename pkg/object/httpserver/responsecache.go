@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httpserver/routers"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/fasttime"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+const (
+	defaultResponseCacheTTL        = time.Minute
+	defaultResponseCacheMaxEntries = 1024
+)
+
+type (
+	responseCache struct {
+		methods []string
+		ttl     time.Duration
+		cache   *lru.Cache
+	}
+
+	cachedResponse struct {
+		statusCode int
+		header     http.Header
+		body       []byte
+		expireAt   time.Time
+
+		// vary is the header names in the Vary header of the response, the
+		// entry of the request key is only a placeholder if it is not
+		// empty, and the response is cached with the key of the variant.
+		vary []string
+
+		// bodyHash is the hash of the request body of an idempotent
+		// request.
+		bodyHash string
+	}
+)
+
+func newResponseCache(spec *routers.ResponseCache) *responseCache {
+	rc := &responseCache{
+		methods: spec.Methods,
+		ttl:     defaultResponseCacheTTL,
+	}
+	if len(rc.methods) == 0 {
+		rc.methods = []string{http.MethodGet, http.MethodHead}
+	}
+	if spec.TTL != "" {
+		// the format of TTL has been checked in validation.
+		rc.ttl, _ = time.ParseDuration(spec.TTL)
+	}
+
+	maxEntries := int(spec.MaxEntries)
+	if maxEntries == 0 {
+		maxEntries = defaultResponseCacheMaxEntries
+	}
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		logger.Errorf("BUG: new lru cache failed: %v", err)
+	}
+	rc.cache = cache
+
+	return rc
+}
+
+// newResponseCaches creates the response caches of all paths, the key of
+// the result map is the response cache spec of the path.
+func newResponseCaches(rules routers.Rules) map[*routers.ResponseCache]*responseCache {
+	caches := map[*routers.ResponseCache]*responseCache{}
+	for _, rule := range rules {
+		for _, path := range rule.Paths {
+			if path.ResponseCache != nil {
+				caches[path.ResponseCache] = newResponseCache(path.ResponseCache)
+			}
+		}
+	}
+	return caches
+}
+
+// bodyInKey returns whether the request body should be part of the key.
+func bodyInKey(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead
+}
+
+func (rc *responseCache) cacheable(req *httpprot.Request) bool {
+	if !stringtool.StrInSlice(req.Method(), rc.methods) {
+		return false
+	}
+	// a shared cache must not reply the responses to the authenticated
+	// requests to the other clients.
+	if req.HTTPHeader().Get("Authorization") != "" {
+		return false
+	}
+	// we are not able to hash a stream body.
+	return !(bodyInKey(req.Method()) && req.IsStream())
+}
+
+func (rc *responseCache) key(req *httpprot.Request) string {
+	key := stringtool.Cat(req.Method(), " ", req.Host(), req.Std().URL.RequestURI())
+	if bodyInKey(req.Method()) {
+		sum := sha256.Sum256(req.RawPayload())
+		key = stringtool.Cat(key, " ", hex.EncodeToString(sum[:]))
+	}
+	return key
+}
+
+// varyKey returns the key of the variant of the request, which is the key
+// of the request followed by the values of the vary headers.
+func varyKey(key string, vary []string, req *httpprot.Request) string {
+	header := req.HTTPHeader()
+	for _, name := range vary {
+		key = stringtool.Cat(key, "\n", name, ": ", strings.Join(header.Values(name), ", "))
+	}
+	return key
+}
+
+func (rc *responseCache) lookup(key string) *cachedResponse {
+	v, ok := rc.cache.Get(key)
+	if !ok {
+		return nil
+	}
+
+	cr := v.(*cachedResponse)
+	if fasttime.Now().After(cr.expireAt) {
+		rc.cache.Remove(key)
+		return nil
+	}
+	return cr
+}
+
+func (rc *responseCache) get(key string, req *httpprot.Request) *cachedResponse {
+	cr := rc.lookup(key)
+	if cr != nil && len(cr.vary) > 0 {
+		cr = rc.lookup(varyKey(key, cr.vary, req))
+	}
+	return cr
+}
+
+// storable returns whether the response could be replied to the other
+// clients, that is, it carries no cookie, is not private, and doesn't
+// vary on something other than the request headers.
+func storable(resp *httpprot.Response) bool {
+	header := resp.HTTPHeader()
+	if len(header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.EqualFold(name, "no-store") || strings.EqualFold(name, "private") {
+				return false
+			}
+		}
+	}
+	for _, name := range varyHeaders(header) {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// varyHeaders returns the canonical header names in the Vary header.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// put caches the response if it is a complete and storable 200 response.
+func (rc *responseCache) put(key string, req *httpprot.Request, resp *httpprot.Response) {
+	if resp == nil || resp.IsStream() || resp.StatusCode() != http.StatusOK || !storable(resp) {
+		return
+	}
+
+	expireAt := fasttime.Now().Add(rc.ttl)
+	if vary := varyHeaders(resp.HTTPHeader()); len(vary) > 0 {
+		rc.cache.Add(key, &cachedResponse{vary: vary, expireAt: expireAt})
+		key = varyKey(key, vary, req)
+	}
+
+	rc.cache.Add(key, &cachedResponse{
+		statusCode: resp.StatusCode(),
+		header:     resp.HTTPHeader().Clone(),
+		body:       append([]byte(nil), resp.RawPayload()...),
+		expireAt:   expireAt,
+	})
+}
+
+func (cr *cachedResponse) toResponse() *httpprot.Response {
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(cr.statusCode)
+	header := resp.HTTPHeader()
+	for k, v := range cr.header {
+		header[k] = append([]string(nil), v...)
+	}
+	resp.SetPayload(cr.body)
+	return resp
+}
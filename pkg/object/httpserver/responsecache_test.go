@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/object/httpserver/routers"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseCache(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	handle := func(name string, ctx *context.Context) {
+		calls++
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload(append([]byte("echo: "), req.RawPayload()...))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /query
+    backend: query-pipeline
+    responseCache:
+      methods: [GET, POST]
+      ttl: 1m
+  - path: /default
+    backend: default-pipeline
+    responseCache: {}
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(method, path, body string) string {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+path, strings.NewReader(body))
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		assert.Equal(http.StatusOK, stdw.Code)
+		data, _ := io.ReadAll(stdw.Body)
+		return string(data)
+	}
+
+	assert.Equal("echo: q1", serve(http.MethodPost, "/query", "q1"))
+	assert.Equal(1, calls)
+	assert.Equal("echo: q1", serve(http.MethodPost, "/query", "q1"))
+	assert.Equal(1, calls)
+
+	// a different body is a different cache entry
+	assert.Equal("echo: q2", serve(http.MethodPost, "/query", "q2"))
+	assert.Equal(2, calls)
+	assert.Equal("echo: q1", serve(http.MethodPost, "/query", "q1"))
+	assert.Equal(2, calls)
+
+	assert.Equal("echo: ", serve(http.MethodGet, "/query", ""))
+	assert.Equal(3, calls)
+	assert.Equal("echo: ", serve(http.MethodGet, "/query", ""))
+	assert.Equal(3, calls)
+
+	// POST is not cacheable by default
+	serve(http.MethodPost, "/default", "q1")
+	serve(http.MethodPost, "/default", "q1")
+	assert.Equal(5, calls)
+	serve(http.MethodGet, "/default", "")
+	serve(http.MethodGet, "/default", "")
+	assert.Equal(6, calls)
+
+	// the responses to the authenticated requests are not cached
+	for i := 0; i < 2; i++ {
+		stdr := httptest.NewRequest(http.MethodGet, "http://www.megaease.com/default", nil)
+		stdr.Header.Set("Authorization", "Bearer token")
+		m.ServeHTTP(httptest.NewRecorder(), stdr)
+	}
+	assert.Equal(8, calls)
+}
+
+func TestResponseCacheExpire(t *testing.T) {
+	assert := assert.New(t)
+
+	rc := newResponseCache(&routers.ResponseCache{TTL: "1ms"})
+	assert.Equal([]string{http.MethodGet, http.MethodHead}, rc.methods)
+
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/", nil)
+	req, _ := httpprot.NewRequest(stdr)
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetPayload("hello")
+	rc.put("key", req, resp)
+	cr := rc.get("key", req)
+	assert.NotNil(cr)
+	assert.Equal([]byte("hello"), cr.toResponse().RawPayload())
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(rc.get("key", req))
+
+	// only 200 responses are cached
+	resp.SetStatusCode(http.StatusNotFound)
+	rc.put("key", req, resp)
+	assert.Nil(rc.get("key", req))
+}
+
+func TestResponseCacheNotStorable(t *testing.T) {
+	assert := assert.New(t)
+
+	rc := newResponseCache(&routers.ResponseCache{})
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/", nil)
+	req, _ := httpprot.NewRequest(stdr)
+
+	for _, h := range [][2]string{
+		{"Set-Cookie", "session=123"},
+		{"Cache-Control", "no-store"},
+		{"Cache-Control", "max-age=60, Private"},
+		{"Cache-Control", `private="Set-Cookie"`},
+		{"Vary", "*"},
+		{"Vary", "Accept-Encoding, *"},
+	} {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.HTTPHeader().Set(h[0], h[1])
+		resp.SetPayload("hello")
+		rc.put("key", req, resp)
+		assert.Nil(rc.get("key", req), "%s: %s", h[0], h[1])
+	}
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.HTTPHeader().Set("Cache-Control", "public, max-age=60")
+	resp.SetPayload("hello")
+	rc.put("key", req, resp)
+	assert.NotNil(rc.get("key", req))
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	assert := assert.New(t)
+
+	rc := newResponseCache(&routers.ResponseCache{})
+	newReq := func(lang string) *httpprot.Request {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/", nil)
+		stdr.Header.Set("Accept-Language", lang)
+		req, _ := httpprot.NewRequest(stdr)
+		return req
+	}
+
+	en, zh := newReq("en"), newReq("zh")
+	resp, _ := httpprot.NewResponse(nil)
+	resp.HTTPHeader().Set("Vary", "accept-language")
+	resp.SetPayload("hello")
+	rc.put(rc.key(en), en, resp)
+
+	cr := rc.get(rc.key(en), newReq("en"))
+	assert.NotNil(cr)
+	assert.Equal([]byte("hello"), cr.toResponse().RawPayload())
+	assert.Nil(rc.get(rc.key(zh), zh))
+
+	resp, _ = httpprot.NewResponse(nil)
+	resp.HTTPHeader().Set("Vary", "Accept-Language")
+	resp.SetPayload("你好")
+	rc.put(rc.key(zh), zh, resp)
+	assert.Equal([]byte("你好"), rc.get(rc.key(zh), zh).toResponse().RawPayload())
+	assert.Equal([]byte("hello"), rc.get(rc.key(en), en).toResponse().RawPayload())
+}
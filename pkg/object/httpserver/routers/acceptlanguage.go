@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// languageRange is a language range of the Accept-Language header with
+// its quality value.
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage parses the Accept-Language header into language
+// ranges sorted by their quality values in descending order, the wildcard
+// and the ranges with invalid or zero quality values are dropped.
+func parseAcceptLanguage(header string) []languageRange {
+	var ranges []languageRange
+	for _, item := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(item, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(k) != "q" {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				q = 0
+			}
+		}
+		if q <= 0 || q > 1 {
+			continue
+		}
+
+		ranges = append(ranges, languageRange{tag: tag, q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// matchLanguage returns if the language range matches the tag, that's
+// one of them equals to or is a prefix of the other at a subtag boundary,
+// case-insensitively, e.g. "fr-FR" matches "fr" and vice versa.
+func matchLanguage(lr, tag string) bool {
+	if len(lr) < len(tag) {
+		lr, tag = tag, lr
+	}
+	if !strings.EqualFold(lr[:len(tag)], tag) {
+		return false
+	}
+	return len(lr) == len(tag) || lr[len(tag)] == '-'
+}
+
+// selectLanguage returns the language range of the highest quality value
+// matching any of the tags, empty if none of them matches.
+func selectLanguage(ranges []languageRange, tags []string) string {
+	for _, lr := range ranges {
+		for _, tag := range tags {
+			if matchLanguage(lr.tag, tag) {
+				return lr.tag
+			}
+		}
+	}
+	return ""
+}
+
+// matchAcceptLanguage returns if the language selected from the header is
+// one of the AcceptLanguage of the path. The language is selected from the
+// tags of all the paths of the rule, so that the path matching the most
+// preferred language is chosen regardless of the order of the paths.
+func (p *Path) matchAcceptLanguage(header string) bool {
+	tags := p.ruleLanguages
+	if tags == nil {
+		tags = p.AcceptLanguage
+	}
+
+	selected := selectLanguage(parseAcceptLanguage(header), tags)
+	if selected == "" {
+		return false
+	}
+
+	for _, tag := range p.AcceptLanguage {
+		if matchLanguage(selected, tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	assert := assert.New(t)
+
+	ranges := parseAcceptLanguage("en;q=0.8, fr-FR, *;q=0.5, de;q=0, fr;q=0.9, it;q=abc")
+	assert.Equal([]languageRange{
+		{tag: "fr-FR", q: 1},
+		{tag: "fr", q: 0.9},
+		{tag: "en", q: 0.8},
+	}, ranges)
+
+	assert.Empty(parseAcceptLanguage(""))
+	assert.Empty(parseAcceptLanguage("*"))
+}
+
+func TestMatchLanguage(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(matchLanguage("fr", "fr"))
+	assert.True(matchLanguage("fr-FR", "fr"))
+	assert.True(matchLanguage("fr", "fr-FR"))
+	assert.True(matchLanguage("ZH-cn", "zh-CN"))
+	assert.False(matchLanguage("fr-FR", "fr-CA"))
+	assert.False(matchLanguage("fry", "fr"))
+}
+
+func TestPathMatchAcceptLanguage(t *testing.T) {
+	assert := assert.New(t)
+
+	// the English path is before the French one, but the French path is
+	// chosen for the clients preferring French.
+	rule := &Rule{
+		Paths: []*Path{
+			{PathPrefix: "/", AcceptLanguage: []string{"en"}, Backend: "en"},
+			{PathPrefix: "/", AcceptLanguage: []string{"fr"}, Backend: "fr"},
+			{PathPrefix: "/", Backend: "default"},
+		},
+	}
+	rule.Init(nil)
+	assert.False(rule.Paths[0].cacheable)
+	assert.False(rule.Paths[1].cacheable)
+
+	route := func(acceptLanguage string) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/", nil)
+		if acceptLanguage != "" {
+			stdr.Header.Set("Accept-Language", acceptLanguage)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := NewContext(req)
+		for _, p := range rule.Paths {
+			if p.Match(ctx) {
+				assert.False(ctx.Cacheable)
+				return p.Backend
+			}
+		}
+		return ""
+	}
+
+	assert.Equal("fr", route("fr-FR,fr;q=0.9,en;q=0.8"))
+	assert.Equal("en", route("en-US,fr;q=0.9"))
+	assert.Equal("fr", route("de,fr;q=0.9,en;q=0.8"))
+
+	// fall through if no language matches.
+	assert.Equal("default", route("de-DE,de;q=0.9"))
+	assert.Equal("default", route("*"))
+	assert.Equal("default", route(""))
+}
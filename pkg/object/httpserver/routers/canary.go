@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/fasttime"
+)
+
+// Canary routes a share of the requests matching the headers to Backend,
+// the share ramps linearly from 0 to Percent in RampDuration after the
+// config is loaded, requests not matching the headers never go to Backend.
+type Canary struct {
+	Headers        Headers `json:"headers" jsonschema:"required"`
+	MatchAllHeader bool    `json:"matchAllHeader,omitempty" jsonschema:"omitempty"`
+	Backend        string  `json:"backend" jsonschema:"required"`
+	Percent        uint32  `json:"percent" jsonschema:"required,minimum=1,maximum=100"`
+	RampDuration   string  `json:"rampDuration,omitempty" jsonschema:"omitempty,format=duration"`
+
+	rampDuration time.Duration
+	loadedAt     time.Time
+
+	lock  sync.Mutex
+	count uint64
+
+	// now returns the current time, it is replaced in unit tests.
+	now func() time.Time
+}
+
+func (c *Canary) init() {
+	c.Headers.init()
+	c.rampDuration, _ = time.ParseDuration(c.RampDuration)
+	if c.now == nil {
+		c.now = fasttime.Now
+	}
+	c.loadedAt = c.now()
+}
+
+// share returns the current share of the canary backend, in the range of
+// [0, 1].
+func (c *Canary) share() float64 {
+	share := float64(c.Percent) / 100
+	if c.rampDuration <= 0 {
+		return share
+	}
+
+	elapsed := c.now().Sub(c.loadedAt)
+	if elapsed >= c.rampDuration {
+		return share
+	}
+	return share * float64(elapsed) / float64(c.rampDuration)
+}
+
+// Select returns the canary backend if the request should be routed to it,
+// otherwise an empty string. The requests matching the headers are
+// distributed evenly, the n-th of them goes to the canary backend if
+// floor(n*share) increases.
+func (c *Canary) Select(req *httpprot.Request) string {
+	if c == nil || !c.Headers.Match(req.HTTPHeader(), c.MatchAllHeader) {
+		return ""
+	}
+
+	share := c.share()
+
+	c.lock.Lock()
+	c.count++
+	n := float64(c.count)
+	c.lock.Unlock()
+
+	if math.Floor(n*share) > math.Floor((n-1)*share) {
+		return c.Backend
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanary(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	c := &Canary{
+		Headers:      Headers{{Key: "X-Canary", Values: []string{"true"}}},
+		Backend:      "canary-pipeline",
+		Percent:      40,
+		RampDuration: "10m",
+		now:          func() time.Time { return now },
+	}
+	c.init()
+
+	newRequest := func(canary bool) *httpprot.Request {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", nil)
+		if canary {
+			stdr.Header.Set("X-Canary", "true")
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		return req
+	}
+
+	// count of the requests routed to canary in 100 requests
+	canaryCount := func(canary bool) int {
+		count := 0
+		for i := 0; i < 100; i++ {
+			if c.Select(newRequest(canary)) == "canary-pipeline" {
+				count++
+			}
+		}
+		return count
+	}
+
+	// the share increases over time
+	assert.Equal(0, canaryCount(true))
+	now = now.Add(5 * time.Minute)
+	assert.Equal(20, canaryCount(true))
+	now = now.Add(5 * time.Minute)
+	assert.Equal(40, canaryCount(true))
+	now = now.Add(time.Hour)
+	assert.Equal(40, canaryCount(true))
+
+	// requests without the header never go to canary
+	assert.Equal(0, canaryCount(false))
+
+	c = nil
+	assert.Equal("", c.Select(newRequest(true)))
+}
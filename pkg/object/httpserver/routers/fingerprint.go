@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+// defaultFingerprintThreshold is the default threshold of Fingerprint.
+const defaultFingerprintThreshold = 4
+
+// scriptedClientTokens are the tokens in the User-Agent of the HTTP
+// libraries, command line tools and crawlers, in lower case.
+var scriptedClientTokens = []string{
+	"curl/", "wget/", "python-requests", "python-urllib", "aiohttp",
+	"go-http-client", "java/", "okhttp", "apache-httpclient", "libwww-perl",
+	"scrapy", "headlesschrome", "phantomjs", "bot", "spider", "crawler",
+}
+
+// Fingerprint matches the requests looking like from bots by a score
+// computed from the User-Agent, the Accept headers and the TLS state of
+// the request, it matches if the score is at least Threshold, default is
+// 4. It is a cheap and coarse heuristic, browsers get a score of 0.
+type Fingerprint struct {
+	Threshold int `json:"threshold,omitempty" jsonschema:"omitempty,minimum=1"`
+}
+
+func (fp *Fingerprint) init() {
+	if fp.Threshold == 0 {
+		fp.Threshold = defaultFingerprintThreshold
+	}
+}
+
+// Score returns the bot score of the request, the higher the more likely
+// the request is from a bot.
+func (fp *Fingerprint) Score(req *httpprot.Request) int {
+	header := req.HTTPHeader()
+	score := 0
+
+	ua := strings.ToLower(header.Get("User-Agent"))
+	if ua == "" {
+		score += 4
+	} else {
+		for _, token := range scriptedClientTokens {
+			if strings.Contains(ua, token) {
+				score += 4
+				break
+			}
+		}
+	}
+
+	// browsers always send these headers.
+	if header.Get("Accept") == "" {
+		score++
+	}
+	if header.Get("Accept-Language") == "" {
+		score += 2
+	}
+	if header.Get("Accept-Encoding") == "" {
+		score++
+	}
+
+	// browsers negotiate the protocol by ALPN, with TLS 1.2 or later.
+	if state := req.Std().TLS; state != nil {
+		if state.NegotiatedProtocol == "" {
+			score++
+		}
+		if state.Version < tls.VersionTLS12 {
+			score++
+		}
+	}
+
+	return score
+}
+
+// Match returns if the score of the request is at least the threshold.
+func (fp *Fingerprint) Match(req *httpprot.Request) bool {
+	return fp.Score(req) >= fp.Threshold
+}
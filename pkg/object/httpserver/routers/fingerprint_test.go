@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	assert := assert.New(t)
+
+	browser := map[string]string{
+		"User-Agent":      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+		"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"Accept-Language": "en-US,en;q=0.9",
+		"Accept-Encoding": "gzip, deflate, br",
+	}
+	curl := map[string]string{
+		"User-Agent": "curl/8.4.0",
+		"Accept":     "*/*",
+	}
+	python := map[string]string{
+		"User-Agent":      "python-requests/2.31.0",
+		"Accept":          "*/*",
+		"Accept-Encoding": "gzip, deflate",
+	}
+	// a spoofed browser User-Agent, but none of the other headers.
+	spoofed := map[string]string{
+		"User-Agent": browser["User-Agent"],
+	}
+
+	newRequest := func(headers map[string]string, state *tls.ConnectionState) *httpprot.Request {
+		stdr, _ := http.NewRequest(http.MethodGet, "/api", nil)
+		for k, v := range headers {
+			stdr.Header.Set(k, v)
+		}
+		stdr.TLS = state
+		req, _ := httpprot.NewRequest(stdr)
+		return req
+	}
+
+	fp := &Fingerprint{}
+	fp.init()
+	assert.Equal(defaultFingerprintThreshold, fp.Threshold)
+
+	h2 := &tls.ConnectionState{Version: tls.VersionTLS13, NegotiatedProtocol: "h2"}
+	assert.Equal(0, fp.Score(newRequest(browser, nil)))
+	assert.Equal(0, fp.Score(newRequest(browser, h2)))
+	assert.False(fp.Match(newRequest(browser, h2)))
+
+	assert.Equal(7, fp.Score(newRequest(curl, nil)))
+	assert.True(fp.Match(newRequest(curl, nil)))
+	assert.Equal(6, fp.Score(newRequest(python, nil)))
+	assert.True(fp.Match(newRequest(python, nil)))
+	assert.Equal(8, fp.Score(newRequest(nil, nil)))
+	assert.True(fp.Match(newRequest(spoofed, nil)))
+
+	// TLS without ALPN and with an old version.
+	assert.Equal(2, fp.Score(newRequest(browser, &tls.ConnectionState{Version: tls.VersionTLS11})))
+	assert.False(fp.Match(newRequest(browser, &tls.ConnectionState{Version: tls.VersionTLS11})))
+
+	// the path with fingerprint.
+	path := &Path{Path: "/api", Fingerprint: &Fingerprint{Threshold: 5}}
+	path.Init(nil)
+	assert.False(path.cacheable)
+
+	ctx := NewContext(newRequest(browser, nil))
+	assert.False(path.Match(ctx))
+	assert.True(ctx.HeaderMismatch)
+
+	ctx = NewContext(newRequest(curl, nil))
+	assert.True(path.Match(ctx))
+	ctx = NewContext(newRequest(spoofed, nil))
+	assert.False(path.Match(ctx))
+}
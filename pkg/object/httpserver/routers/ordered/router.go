@@ -19,6 +19,7 @@ package ordered
 
 import (
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/megaease/easegress/pkg/logger"
@@ -28,16 +29,21 @@ import (
 type (
 	muxRule struct {
 		routers.Rule
+		// src is the rule the muxRule is created from.
+		src   *routers.Rule
 		paths []*muxPath
 	}
 
 	muxPath struct {
 		routers.Path
-		pathRE *regexp.Regexp
+		pathRE       *regexp.Regexp
+		rewriteParts []routers.RewritePart
 	}
 
 	orderedRouter struct {
 		rules []*muxRule
+		// longest means the paths of a rule are sorted by specificity.
+		longest bool
 	}
 )
 
@@ -46,26 +52,100 @@ var kind = &routers.Kind{
 	Description: "Ordered",
 
 	CreateInstance: func(rules routers.Rules) routers.Router {
-		muxRules := make([]*muxRule, len(rules))
-		for i, rule := range rules {
-			paths := make([]*muxPath, len(rule.Paths))
-			for j, path := range rule.Paths {
-				paths[j] = newMuxPath(path)
-			}
+		return newOrderedRouter(rules, nil, false)
+	},
 
-			muxRules[i] = &muxRule{
-				Rule:  *rule,
-				paths: paths,
-			}
-		}
-		return &orderedRouter{
-			rules: muxRules,
-		}
+	InheritInstance: func(rules routers.Rules, previous routers.Router) routers.Router {
+		prev, _ := previous.(*orderedRouter)
+		return newOrderedRouter(rules, prev, false)
+	},
+}
+
+// longestKind is the Ordered router selecting the most specific path of a
+// rule instead of the first one, it is used for the longest path match
+// mode of the server.
+var longestKind = &routers.Kind{
+	Name:        "OrderedLongest",
+	Description: "Ordered, the most specific path of a rule wins",
+
+	CreateInstance: func(rules routers.Rules) routers.Router {
+		return newOrderedRouter(rules, nil, true)
+	},
+
+	InheritInstance: func(rules routers.Rules, previous routers.Router) routers.Router {
+		prev, _ := previous.(*orderedRouter)
+		return newOrderedRouter(rules, prev, true)
 	},
 }
 
 func init() {
 	routers.Register(kind)
+	routers.Register(longestKind)
+}
+
+// newOrderedRouter creates the router, the muxRules of the previous router
+// are reused for the same rules if it has the same match mode.
+func newOrderedRouter(rules routers.Rules, previous *orderedRouter, longest bool) *orderedRouter {
+	reusable := map[*routers.Rule]*muxRule{}
+	if previous != nil && previous.longest == longest {
+		for _, mr := range previous.rules {
+			reusable[mr.src] = mr
+		}
+	}
+
+	muxRules := make([]*muxRule, len(rules))
+	for i, rule := range rules {
+		if mr := reusable[rule]; mr != nil {
+			muxRules[i] = mr
+			continue
+		}
+
+		paths := make([]*muxPath, len(rule.Paths))
+		for j, path := range rule.Paths {
+			paths[j] = newMuxPath(path)
+		}
+		if longest {
+			sortBySpecificity(paths)
+		}
+
+		muxRules[i] = &muxRule{
+			Rule:  *rule,
+			src:   rule,
+			paths: paths,
+		}
+	}
+	return &orderedRouter{
+		rules:   muxRules,
+		longest: longest,
+	}
+}
+
+// sortBySpecificity sorts the paths by specificity, that's the exact paths
+// first, then the prefixes from the longest to the shortest, then the
+// regexps, and the paths matching all at last. The order of the paths of
+// the same specificity is kept, so the first match is the most specific
+// one, which is the same as selecting from all matches.
+func sortBySpecificity(paths []*muxPath) {
+	specificity := func(mp *muxPath) (int, int) {
+		switch {
+		case mp.Path.Path != "":
+			return 3, 0
+		case mp.PathPrefix != "":
+			return 2, len(mp.PathPrefix)
+		case mp.pathRE != nil:
+			return 1, 0
+		}
+		return 0, 0
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		ci, li := specificity(paths[i])
+		cj, lj := specificity(paths[j])
+		if ci != cj {
+			return ci > cj
+		}
+		return li > lj
+	})
 }
 
 func newMuxPath(p *routers.Path) *muxPath {
@@ -79,10 +159,22 @@ func newMuxPath(p *routers.Path) *muxPath {
 		}
 	}
 
-	return &muxPath{
+	mp := &muxPath{
 		Path:   *p,
 		pathRE: pathRE,
 	}
+	if pathRE != nil {
+		parts, err := routers.ParseRewriteTarget(p.RewriteTarget)
+		// defensive programming
+		if err != nil {
+			logger.Errorf("BUG: parse rewrite target %s failed: %v", p.RewriteTarget, err)
+		}
+		if p.DecodeCaptures {
+			parts = routers.DecodeRewriteParts(p.RewriteTarget, parts)
+		}
+		mp.rewriteParts = parts
+	}
+	return mp
 }
 
 func (mp *muxPath) matchPath(path string) bool {
@@ -90,10 +182,10 @@ func (mp *muxPath) matchPath(path string) bool {
 		return true
 	}
 
-	if mp.Path.Path != "" && mp.Path.Path == path {
+	if mp.Path.Path != "" && mp.equalPath(path) {
 		return true
 	}
-	if mp.PathPrefix != "" && strings.HasPrefix(path, mp.PathPrefix) {
+	if mp.PathPrefix != "" && mp.hasPathPrefix(path) {
 		return true
 	}
 	if mp.pathRE != nil {
@@ -103,32 +195,81 @@ func (mp *muxPath) matchPath(path string) bool {
 	return false
 }
 
+// equalPath returns whether path equals to Path, case-insensitively if
+// CaseInsensitive is true.
+func (mp *muxPath) equalPath(path string) bool {
+	if mp.CaseInsensitive {
+		return strings.EqualFold(mp.Path.Path, path)
+	}
+	return mp.Path.Path == path
+}
+
+// hasPathPrefix returns whether path starts with PathPrefix,
+// case-insensitively if CaseInsensitive is true.
+func (mp *muxPath) hasPathPrefix(path string) bool {
+	if mp.CaseInsensitive {
+		n := len(mp.PathPrefix)
+		return len(path) >= n && strings.EqualFold(path[:n], mp.PathPrefix)
+	}
+	return strings.HasPrefix(path, mp.PathPrefix)
+}
+
+// stripPathPrefix removes PathPrefix from path, the result always starts
+// with a slash, so both "/api" and "/api/" strip "/api/users" to "/users".
+func (mp *muxPath) stripPathPrefix(path string) string {
+	path = path[len(mp.PathPrefix):]
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
 func (mp *muxPath) Rewrite(context *routers.RouteContext) {
-	if mp.RewriteTarget == "" {
+	if mp.RewriteTarget == "" && !mp.StripPrefix {
 		return
 	}
 	r := context.Request
 	path := context.Path
 
-	if mp.Path.Path != "" && mp.Path.Path == path {
-		r.SetPath(mp.RewriteTarget)
+	if mp.Path.Path != "" && mp.equalPath(path) {
+		if mp.RewriteTarget != "" {
+			r.SetPath(mp.RewriteTarget)
+		}
 		return
 	}
 
-	if mp.PathPrefix != "" && strings.HasPrefix(path, mp.PathPrefix) {
-		path = mp.RewriteTarget + path[len(mp.PathPrefix):]
+	if mp.PathPrefix != "" && mp.hasPathPrefix(path) {
+		if mp.StripPrefix {
+			// strip first, then prepend the rewrite target to the rest.
+			path = mp.stripPathPrefix(path)
+			if mp.RewriteTarget != "" && path == "/" {
+				path = mp.RewriteTarget
+			} else if mp.RewriteTarget != "" {
+				path = strings.TrimSuffix(mp.RewriteTarget, "/") + path
+			}
+		} else {
+			path = mp.RewriteTarget + path[len(mp.PathPrefix):]
+		}
 		r.SetPath(path)
 		return
 	}
 
+	if mp.RewriteTarget == "" {
+		return
+	}
+
 	// sure (mp.pathRE != nil && mp.pathRE.MatchString(path)) is true
-	path = mp.pathRE.ReplaceAllString(path, mp.RewriteTarget)
+	if mp.rewriteParts != nil {
+		path = routers.ReplaceAllWithParts(mp.pathRE, path, mp.rewriteParts)
+	} else {
+		path = mp.pathRE.ReplaceAllString(path, mp.RewriteTarget)
+	}
 	r.SetPath(path)
 }
 
 func (r *orderedRouter) Search(context *routers.RouteContext) {
 	req := context.Request
-	ip := req.RealIP()
+	ip, trustedIP := req.RealIP(), req.TrustedIP()
 	path := context.Path
 
 	for _, rule := range r.rules {
@@ -136,8 +277,11 @@ func (r *orderedRouter) Search(context *routers.RouteContext) {
 			continue
 		}
 
-		if !rule.AllowIP(ip) {
+		if !rule.AllowIP(ip, trustedIP) {
 			context.IPMismatch = true
+			if rule.StrictIPFilter {
+				return
+			}
 			continue
 		}
 
@@ -69,7 +69,7 @@ func TestCreateInstance(t *testing.T) {
 		},
 	}
 
-	rules.Init()
+	rules.Init(nil)
 	var router *orderedRouter = kind.CreateInstance(rules).(*orderedRouter)
 
 	assert := assert.New(t)
@@ -141,6 +141,208 @@ func TestMuxRoutePathMatch(t *testing.T) {
 	assert.False(mp.matchPath(path))
 }
 
+func TestMuxPathCaseInsensitive(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &routers.Path{Path: "/API/Users"}
+	p.Init(nil)
+	mp := newMuxPath(p)
+	assert.False(mp.matchPath("/api/users"))
+
+	p = &routers.Path{Path: "/API/Users", CaseInsensitive: true}
+	p.Init(nil)
+	mp = newMuxPath(p)
+	assert.True(mp.matchPath("/api/users"))
+	assert.True(mp.matchPath("/API/USERS"))
+	assert.False(mp.matchPath("/api/users/1"))
+
+	p = &routers.Path{PathPrefix: "/API/", CaseInsensitive: true, RewriteTarget: "/v1/"}
+	p.Init(nil)
+	mp = newMuxPath(p)
+	assert.True(mp.matchPath("/api/users"))
+	assert.False(mp.matchPath("/ap"))
+
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api/Users", nil)
+	req, _ := httpprot.NewRequest(stdr)
+	mp.Rewrite(routers.NewContext(req))
+	assert.Equal("/v1/Users", req.Path())
+
+	// the regexp is not affected, (?i) should be used instead.
+	p = &routers.Path{PathRegexp: "^/API$", CaseInsensitive: true}
+	p.Init(nil)
+	mp = newMuxPath(p)
+	assert.False(mp.matchPath("/api"))
+	p = &routers.Path{PathRegexp: "(?i)^/API$"}
+	p.Init(nil)
+	mp = newMuxPath(p)
+	assert.True(mp.matchPath("/api"))
+}
+
+func TestMuxPathRewriteTransforms(t *testing.T) {
+	assert := assert.New(t)
+
+	rewrite := func(pathRegexp, target, path string) string {
+		p := &routers.Path{PathRegexp: pathRegexp, RewriteTarget: target}
+		assert.NoError(p.Validate())
+		p.Init(nil)
+		mp := newMuxPath(p)
+
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, nil)
+		req, _ := httpprot.NewRequest(stdr)
+		mp.Rewrite(routers.NewContext(req))
+		return req.Path()
+	}
+
+	assert.Equal("/users/alice/profile", rewrite(`^/Users/(\w+)/(\w+)$`, "/users/${1:lower}/$2", "/Users/Alice/profile"))
+	assert.Equal("/users/ALICE/Profile", rewrite(`^/Users/(\w+)/(\w+)$`, "/users/${1:upper}/$2", "/Users/Alice/Profile"))
+	assert.Equal("/tags/go", rewrite(`^/t/([^/]+)$`, "/tags/${1:trim}", "/t/%20go%20"))
+	assert.Equal("/v2/api", rewrite(`^/(?P<ver>V\d)/(\w+)$`, "/${ver:lower}/${2:trim}", "/V2/api"))
+
+	// no transform
+	assert.Equal("/users/Alice", rewrite(`^/Users/(\w+)$`, "/users/$1", "/Users/Alice"))
+
+	p := &routers.Path{PathRegexp: `^/(\w+)$`, RewriteTarget: "/${1:title}"}
+	assert.Error(p.Validate())
+}
+
+func TestMuxPathRewriteDecodeCaptures(t *testing.T) {
+	assert := assert.New(t)
+
+	// the escaped path is matched, like matchEscapedPath of the server.
+	rewrite := func(target, path string, decode bool) string {
+		p := &routers.Path{PathRegexp: `^/files/([^/]+)/(\w+)$`, RewriteTarget: target, DecodeCaptures: decode}
+		p.Init(nil)
+		mp := newMuxPath(p)
+
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, nil)
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := routers.NewContext(req)
+		ctx.Path = stdr.URL.EscapedPath()
+		mp.Rewrite(ctx)
+		return req.Path()
+	}
+
+	assert.Equal("/storage/john%20doe/a", rewrite("/storage/$1/$2", "/files/john%20doe/a", false))
+	assert.Equal("/storage/john doe/a", rewrite("/storage/$1/$2", "/files/john%20doe/a", true))
+	assert.Equal("/storage/john doe/a", rewrite("/storage/${1}/${2}", "/files/john%20doe/a", true))
+	assert.Equal("/storage/JOHN DOE/a", rewrite("/storage/${1:upper}/$2", "/files/john%20doe/a", true))
+	assert.Equal("/storage/$/a", rewrite("/storage/$$/$2", "/files/john%20doe/a", true))
+}
+
+func TestMuxPathStripPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Error((&routers.Path{Path: "/api", StripPrefix: true}).Validate())
+
+	// the prefixes overlap, the first matched path wins.
+	rules := routers.Rules{
+		&routers.Rule{
+			Paths: []*routers.Path{
+				{PathPrefix: "/api/users/", StripPrefix: true, Backend: "users"},
+				{PathPrefix: "/api/users/v2", StripPrefix: true, RewriteTarget: "/v2/", Backend: "users-v2"},
+				{PathPrefix: "/api/orders", StripPrefix: true, RewriteTarget: "/orders", Backend: "orders"},
+				{PathPrefix: "/api", StripPrefix: true, Backend: "api"},
+			},
+		},
+	}
+	rules.Init(nil)
+	for _, p := range rules[0].Paths {
+		assert.NoError(p.Validate())
+	}
+	router := kind.CreateInstance(rules)
+
+	rewrite := func(path string) (string, string) {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, nil)
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := routers.NewContext(req)
+		router.Search(ctx)
+		if ctx.Route == nil {
+			return "", ""
+		}
+		ctx.Route.Rewrite(ctx)
+		return ctx.Route.GetBackend(), req.Path()
+	}
+
+	tests := []struct {
+		path, backend, result string
+	}{
+		{"/api/users/1", "users", "/1"},
+		{"/api/users/", "users", "/"},
+		{"/api/users/v2/1", "users", "/v2/1"},
+		{"/api/orders/1", "orders", "/orders/1"},
+		{"/api/orders", "orders", "/orders"},
+		{"/api/users", "api", "/users"},
+		{"/api", "api", "/"},
+		{"/apiv2", "api", "/v2"},
+	}
+	for _, test := range tests {
+		backend, path := rewrite(test.path)
+		assert.Equal(test.backend, backend, test.path)
+		assert.Equal(test.result, path, test.path)
+	}
+
+	// strip first, then rewrite.
+	p := &routers.Path{PathPrefix: "/api/users/v2", StripPrefix: true, RewriteTarget: "/v2/"}
+	p.Init(nil)
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api/users/v2/1", nil)
+	req, _ := httpprot.NewRequest(stdr)
+	ctx := routers.NewContext(req)
+	ctx.Path = stdr.URL.Path
+	newMuxPath(p).Rewrite(ctx)
+	assert.Equal("/v2/1", req.Path())
+}
+
+func TestInheritInstance(t *testing.T) {
+	assert := assert.New(t)
+
+	newRules := func() routers.Rules {
+		rules := routers.Rules{
+			{Host: "a.megaease.com", Paths: []*routers.Path{{PathRegexp: "^/a"}}},
+			{Host: "b.megaease.com", Paths: []*routers.Path{{PathRegexp: "^/b"}}},
+		}
+		rules.Init(nil)
+		return rules
+	}
+
+	rules := newRules()
+	old := kind.CreateInstance(rules).(*orderedRouter)
+
+	// the first rule is kept, the second one is changed
+	rules2 := newRules()
+	rules2[0] = rules[0]
+	router := kind.InheritInstance(rules2, old).(*orderedRouter)
+	assert.Same(old.rules[0], router.rules[0])
+	assert.Same(old.rules[0].paths[0].pathRE, router.rules[0].paths[0].pathRE)
+	assert.NotSame(old.rules[1], router.rules[1])
+
+	// all rules are created without the previous instance
+	router = kind.InheritInstance(rules, nil).(*orderedRouter)
+	assert.NotSame(old.rules[0], router.rules[0])
+}
+
+func TestInheritInstanceLongest(t *testing.T) {
+	assert := assert.New(t)
+
+	rules := routers.Rules{
+		{Paths: []*routers.Path{{PathPrefix: "/a"}, {PathRegexp: "^/a/b"}, {Path: "/a/b"}, {PathPrefix: "/a/b"}}},
+	}
+	rules.Init(nil)
+
+	old := kind.CreateInstance(rules).(*orderedRouter)
+	assert.Equal("/a", old.rules[0].paths[0].PathPrefix)
+
+	// the rules are not reused if the match mode is changed.
+	router := longestKind.InheritInstance(rules, old).(*orderedRouter)
+	assert.NotSame(old.rules[0], router.rules[0])
+	paths := router.rules[0].paths
+	assert.Equal("/a/b", paths[0].Path.Path)
+	assert.Equal("/a/b", paths[1].PathPrefix)
+	assert.Equal("/a", paths[2].PathPrefix)
+	assert.Equal("^/a/b", paths[3].PathRegexp)
+
+	assert.Same(router.rules[0], longestKind.InheritInstance(rules, router).(*orderedRouter).rules[0])
+}
+
 func TestSearch(t *testing.T) {
 	assert := assert.New(t)
 
@@ -162,7 +364,7 @@ func TestSearch(t *testing.T) {
 		},
 	}
 
-	rules.Init()
+	rules.Init(nil)
 	var router *orderedRouter = kind.CreateInstance(rules).(*orderedRouter)
 
 	tests := []struct {
@@ -218,3 +420,64 @@ func TestSearch(t *testing.T) {
 
 	}
 }
+
+func TestSearchHeaderOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	newRouter := func(first, second *routers.Path) routers.Router {
+		rules := routers.Rules{
+			&routers.Rule{
+				Paths: []*routers.Path{
+					first,
+					second,
+					{Path: "/api", Backend: "default"},
+				},
+			},
+		}
+		rules.Init(nil)
+		return kind.CreateInstance(rules)
+	}
+
+	newPaths := func() (*routers.Path, *routers.Path) {
+		version := &routers.Path{
+			Path:    "/api",
+			Backend: "version",
+			Headers: routers.Headers{{Key: "X-Version", Regexp: "^v[0-9]+$"}},
+		}
+		canary := &routers.Path{
+			Path:    "/api",
+			Backend: "canary",
+			Headers: routers.Headers{{Key: "X-Canary", Values: []string{"true"}}},
+		}
+		return version, canary
+	}
+
+	search := func(router routers.Router, headers map[string]string) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "/api", nil)
+		for k, v := range headers {
+			stdr.Header.Set(k, v)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		context := routers.NewContext(req)
+		router.Search(context)
+		if context.Route == nil {
+			return ""
+		}
+		return context.Route.GetBackend()
+	}
+
+	both := map[string]string{"X-Version": "v2", "X-Canary": "true"}
+
+	// paths are evaluated in definition order, the first one whose
+	// header conditions match wins.
+	router := newRouter(newPaths())
+	assert.Equal("version", search(router, both))
+	assert.Equal("canary", search(router, map[string]string{"X-Canary": "true"}))
+	assert.Equal("default", search(router, nil))
+
+	version, canary := newPaths()
+	router = newRouter(canary, version)
+	assert.Equal("canary", search(router, both))
+	assert.Equal("version", search(router, map[string]string{"X-Version": "v2"}))
+	assert.Equal("default", search(router, nil))
+}
@@ -75,6 +75,8 @@ type (
 
 	muxRule struct {
 		routers.Rule
+		// src is the rule the muxRule is created from.
+		src       *routers.Rule
 		root      *node
 		pathCache map[string]paths
 	}
@@ -107,17 +109,38 @@ var kind = &routers.Kind{
 	Description: "RadixTree",
 
 	CreateInstance: func(rules routers.Rules) routers.Router {
-		router := &radixTreeRouter{
-			rules: make([]*muxRule, len(rules)),
+		return newRadixTreeRouter(rules, nil)
+	},
+
+	InheritInstance: func(rules routers.Rules, previous routers.Router) routers.Router {
+		prev, _ := previous.(*radixTreeRouter)
+		return newRadixTreeRouter(rules, prev)
+	},
+}
+
+// newRadixTreeRouter creates the router, the muxRules of the previous
+// router are reused for the same rules.
+func newRadixTreeRouter(rules routers.Rules, previous *radixTreeRouter) *radixTreeRouter {
+	reusable := map[*routers.Rule]*muxRule{}
+	if previous != nil {
+		for _, mr := range previous.rules {
+			reusable[mr.src] = mr
 		}
+	}
 
-		for i, rule := range rules {
-			mr := newMuxRule(rule)
-			router.rules[i] = mr
+	router := &radixTreeRouter{
+		rules: make([]*muxRule, len(rules)),
+	}
+
+	for i, rule := range rules {
+		mr := reusable[rule]
+		if mr == nil {
+			mr = newMuxRule(rule)
 		}
+		router.rules[i] = mr
+	}
 
-		return router
-	},
+	return router
 }
 
 func init() {
@@ -504,6 +527,7 @@ func (mp *muxPath) Rewrite(context *routers.RouteContext) {
 func newMuxRule(rule *routers.Rule) *muxRule {
 	mr := &muxRule{
 		Rule:      *rule,
+		src:       rule,
 		root:      &node{},
 		pathCache: make(map[string]paths),
 	}
@@ -529,15 +553,18 @@ func newMuxRule(rule *routers.Rule) *muxRule {
 func (r *radixTreeRouter) Search(context *routers.RouteContext) {
 	path := context.Path
 	req := context.Request
-	ip := req.RealIP()
+	ip, trustedIP := req.RealIP(), req.TrustedIP()
 
 	for _, rule := range r.rules {
 		if !rule.MatchHost(context) {
 			continue
 		}
 
-		if !rule.AllowIP(ip) {
+		if !rule.AllowIP(ip, trustedIP) {
 			context.IPMismatch = true
+			if rule.StrictIPFilter {
+				return
+			}
 			continue
 		}
 
@@ -30,6 +30,31 @@ import (
 // go-chi in https://github.com/go-chi/chi/blob/master/tree.go
 // (MIT licensed). It's been heavily modified for use as a HTTP router.
 
+func TestInheritInstance(t *testing.T) {
+	assert := assert.New(t)
+
+	newRules := func() routers.Rules {
+		rules := routers.Rules{
+			{Host: "a.megaease.com", Paths: []*routers.Path{{Path: "/users/{id}"}}},
+			{Host: "b.megaease.com", Paths: []*routers.Path{{Path: "/orders/{id}"}}},
+		}
+		rules.Init(nil)
+		return rules
+	}
+
+	rules := newRules()
+	old := kind.CreateInstance(rules).(*radixTreeRouter)
+
+	rules2 := newRules()
+	rules2[0] = rules[0]
+	router := kind.InheritInstance(rules2, old).(*radixTreeRouter)
+	assert.Same(old.rules[0], router.rules[0])
+	assert.NotSame(old.rules[1], router.rules[1])
+
+	router = kind.InheritInstance(rules, nil).(*radixTreeRouter)
+	assert.NotSame(old.rules[0], router.rules[0])
+}
+
 func TestTree(t *testing.T) {
 	hStub := "hStub"
 	hIndex := "hIndex"
@@ -244,7 +269,7 @@ func TestTree(t *testing.T) {
 		},
 	}
 
-	rules.Init()
+	rules.Init(nil)
 
 	tests := []struct {
 		r string   // input request path
@@ -494,7 +519,7 @@ func TestTreeMoar(t *testing.T) {
 		{m: "GET", r: "/users/2/settings/", h: hStub16, k: []string{"id", egWildcard}, v: []string{"2", ""}},
 	}
 
-	rules.Init()
+	rules.Init(nil)
 
 	router := kind.CreateInstance(rules).(*radixTreeRouter)
 	assert := assert.New(t)
@@ -594,7 +619,7 @@ func TestTreeRegexp(t *testing.T) {
 		{r: "/articles/1122", h: hStub1, k: []string{"id"}, v: []string{"1122"}},
 		{r: "/articles/1122-yes", h: hStub6, k: []string{"id", "aux"}, v: []string{"1122", "yes"}},
 	}
-	rules.Init()
+	rules.Init(nil)
 	router := kind.CreateInstance(rules).(*radixTreeRouter)
 	assert := assert.New(t)
 
@@ -653,7 +678,7 @@ func TestTreeRegexpRecursive(t *testing.T) {
 		{r: "/one///first", h: "", k: nil, v: nil},
 		{r: "/one/hi/123/second", h: hStub2, k: []string{"firstId", "secondId"}, v: []string{"hi", "123"}},
 	}
-	rules.Init()
+	rules.Init(nil)
 	router := kind.CreateInstance(rules).(*radixTreeRouter)
 	assert := assert.New(t)
 
@@ -719,7 +744,7 @@ func TestTreeRegexMatchWholeParam(t *testing.T) {
 		{url: "//foo", expectedHandler: ""},
 		{url: "//test", expectedHandler: ""},
 	}
-	rules.Init()
+	rules.Init(nil)
 	router := kind.CreateInstance(rules).(*radixTreeRouter)
 	assert := assert.New(t)
 
@@ -797,7 +822,7 @@ func BenchmarkTreeGet(b *testing.B) {
 			},
 		},
 	}
-	rules.Init()
+	rules.Init(nil)
 	router := kind.CreateInstance(rules).(*radixTreeRouter)
 
 	b.ReportAllocs()
@@ -963,3 +988,64 @@ func TestRouteRewrite(t *testing.T) {
 
 	}
 }
+
+func TestSearchHeaderOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	newRouter := func(first, second *routers.Path) routers.Router {
+		rules := routers.Rules{
+			&routers.Rule{
+				Paths: []*routers.Path{
+					first,
+					second,
+					{Path: "/api", Backend: "default"},
+				},
+			},
+		}
+		rules.Init(nil)
+		return kind.CreateInstance(rules)
+	}
+
+	newPaths := func() (*routers.Path, *routers.Path) {
+		version := &routers.Path{
+			Path:    "/api",
+			Backend: "version",
+			Headers: routers.Headers{{Key: "X-Version", Regexp: "^v[0-9]+$"}},
+		}
+		canary := &routers.Path{
+			Path:    "/api",
+			Backend: "canary",
+			Headers: routers.Headers{{Key: "X-Canary", Values: []string{"true"}}},
+		}
+		return version, canary
+	}
+
+	search := func(router routers.Router, headers map[string]string) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "/api", nil)
+		for k, v := range headers {
+			stdr.Header.Set(k, v)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		context := routers.NewContext(req)
+		router.Search(context)
+		if context.Route == nil {
+			return ""
+		}
+		return context.Route.GetBackend()
+	}
+
+	both := map[string]string{"X-Version": "v2", "X-Canary": "true"}
+
+	// paths are evaluated in definition order, the first one whose
+	// header conditions match wins.
+	router := newRouter(newPaths())
+	assert.Equal("version", search(router, both))
+	assert.Equal("canary", search(router, map[string]string{"X-Canary": "true"}))
+	assert.Equal("default", search(router, nil))
+
+	version, canary := newPaths()
+	router = newRouter(canary, version)
+	assert.Equal("canary", search(router, both))
+	assert.Equal("version", search(router, map[string]string{"X-Version": "v2"}))
+	assert.Equal("default", search(router, nil))
+}
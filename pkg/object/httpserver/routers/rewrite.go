@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RewritePart is a part of the rewrite target of a path regexp.
+type RewritePart struct {
+	// Template is expanded by the regexp, like the replacement of
+	// regexp.Regexp.ReplaceAllString.
+	Template string
+	// Transform is applied to the expanded template, nil means no transform.
+	Transform func(string) string
+}
+
+var (
+	rewriteTransformRE = regexp.MustCompile(`\$\{(\w+):(\w*)\}`)
+
+	// rewriteGroupRE matches the references to the captured groups, and
+	// the escaped dollar sign, which is not a reference.
+	rewriteGroupRE = regexp.MustCompile(`\$\$|\$\{\w+\}|\$\w+`)
+
+	rewriteTransforms = map[string]func(string) string{
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"trim":  strings.TrimSpace,
+	}
+)
+
+// ParseRewriteTarget splits the rewrite target of a path regexp into parts
+// by the transforms of the captured groups, like ${1:lower}, ${1:upper} and
+// ${name:trim}. Nil is returned if there isn't any transform.
+func ParseRewriteTarget(target string) ([]RewritePart, error) {
+	matches := rewriteTransformRE.FindAllStringSubmatchIndex(target, -1)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	parts := []RewritePart{}
+	start := 0
+	for _, m := range matches {
+		name := target[m[4]:m[5]]
+		transform := rewriteTransforms[name]
+		if transform == nil {
+			return nil, fmt.Errorf("unknown transform %q in rewriteTarget %s", name, target)
+		}
+		if m[0] > start {
+			parts = append(parts, RewritePart{Template: target[start:m[0]]})
+		}
+		parts = append(parts, RewritePart{
+			Template:  "${" + target[m[2]:m[3]] + "}",
+			Transform: transform,
+		})
+		start = m[1]
+	}
+	if start < len(target) {
+		parts = append(parts, RewritePart{Template: target[start:]})
+	}
+
+	return parts, nil
+}
+
+// ReplaceAllWithParts is the same as re.ReplaceAllString, but the
+// replacement is built from the parts.
+func ReplaceAllWithParts(re *regexp.Regexp, src string, parts []RewritePart) string {
+	var buf []byte
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(src, -1) {
+		buf = append(buf, src[last:m[0]]...)
+		for _, p := range parts {
+			if p.Transform == nil {
+				buf = re.ExpandString(buf, p.Template, src, m)
+				continue
+			}
+			s := string(re.ExpandString(nil, p.Template, src, m))
+			buf = append(buf, p.Transform(s)...)
+		}
+		last = m[1]
+	}
+	buf = append(buf, src[last:]...)
+	return string(buf)
+}
+
+// DecodeRewriteParts returns the parts of the rewrite target with all of
+// the captured groups URL-decoded, before their transforms if any, parts
+// is the result of ParseRewriteTarget.
+func DecodeRewriteParts(target string, parts []RewritePart) []RewritePart {
+	if parts == nil {
+		parts = []RewritePart{{Template: target}}
+	}
+
+	decoded := []RewritePart{}
+	for _, p := range parts {
+		if transform := p.Transform; transform != nil {
+			decoded = append(decoded, RewritePart{
+				Template:  p.Template,
+				Transform: func(s string) string { return transform(DecodeCapture(s)) },
+			})
+			continue
+		}
+
+		start := 0
+		for _, m := range rewriteGroupRE.FindAllStringIndex(p.Template, -1) {
+			if p.Template[m[0]:m[1]] == "$$" {
+				continue
+			}
+			if m[0] > start {
+				decoded = append(decoded, RewritePart{Template: p.Template[start:m[0]]})
+			}
+			decoded = append(decoded, RewritePart{
+				Template:  p.Template[m[0]:m[1]],
+				Transform: DecodeCapture,
+			})
+			start = m[1]
+		}
+		if start < len(p.Template) {
+			decoded = append(decoded, RewritePart{Template: p.Template[start:]})
+		}
+	}
+
+	return decoded
+}
+
+// DecodeCapture URL-decodes the captured value, it is returned as is if
+// it is not a valid escaped string.
+func DecodeCapture(s string) string {
+	if v, err := url.PathUnescape(s); err == nil {
+		return v
+	}
+	return s
+}
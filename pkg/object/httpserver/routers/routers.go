@@ -18,12 +18,16 @@
 package routers
 
 import (
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"go.opentelemetry.io/otel/baggage"
 )
 
 type (
@@ -37,6 +41,11 @@ type (
 
 		// CreateInstance creates a new router instance of the kind.
 		CreateInstance func(rules Rules) Router
+
+		// InheritInstance creates a new router instance of the kind, the
+		// compiled rules of the previous instance are reused for the rules
+		// also in rules, it is optional and previous may be nil.
+		InheritInstance func(rules Rules, previous Router) Router
 	}
 
 	// Router is the interface for route search.
@@ -51,8 +60,52 @@ type (
 		Rewrite(context *RouteContext)
 		// GetBackend is used to get the backend corresponding to the route.
 		GetBackend() string
+		// GetBackends is used to get the weighted backends corresponding to the route.
+		GetBackends() WeightedBackends
+		// GetConnBackend is used to get the backend for the TLS or plaintext connections corresponding to the route.
+		GetConnBackend(tls bool) string
 		// GetClientMaxBodySize is used to get the clientMaxBodySize corresponding to the route.
 		GetClientMaxBodySize() int64
+		// GetRequiredHeaders is used to get the required headers and the status code for requests lacking any of them.
+		GetRequiredHeaders() ([]string, int)
+		// GetRequireContentTypeOnWrite is used to get the media types accepted for the writes corresponding to the route.
+		GetRequireContentTypeOnWrite() []string
+		// GetAllowedRequestEncodings is used to get the content codings accepted for the request body corresponding to the route.
+		GetAllowedRequestEncodings() []string
+		// GetResponseCache is used to get the response cache spec corresponding to the route.
+		GetResponseCache() *ResponseCache
+		// GetIdempotency is used to get the idempotency spec corresponding to the route.
+		GetIdempotency() *Idempotency
+		// GetTeeBackends is used to get the tee backends corresponding to the route.
+		GetTeeBackends() []string
+		// GetBaggage is used to get the baggage conditions corresponding to the route.
+		GetBaggage() Headers
+		// GetTimeoutResponse is used to get the timeout response corresponding to the route.
+		GetTimeoutResponse() *TimeoutResponse
+		// GetRewriteHost is used to get the host rewriting corresponding to the route.
+		GetRewriteHost() *RewriteHost
+		// GetForceResponseContentType is used to get the forced response Content-Type corresponding to the route.
+		GetForceResponseContentType() string
+		// GetRefererFilter is used to get the referer filter corresponding to the route.
+		GetRefererFilter() *RefererFilter
+		// GetCanary is used to get the canary corresponding to the route.
+		GetCanary() *Canary
+		// GetGeoRestrict is used to get the geo restriction corresponding to the route.
+		GetGeoRestrict() *GeoRestrict
+		// GetSignedLink is used to get the signed link corresponding to the route.
+		GetSignedLink() *SignedLink
+		// GetPriority is used to get the priority corresponding to the route.
+		GetPriority() int
+		// GetAutoETag is used to get whether to generate ETags corresponding to the route.
+		GetAutoETag() bool
+		// GetDecodeCaptures is used to get whether to URL-decode the captures corresponding to the route.
+		GetDecodeCaptures() bool
+		// GetTimeout is used to get the request timeout corresponding to the route.
+		GetTimeout() time.Duration
+		// SampleTee is used to decide whether to copy the request to the tee backends.
+		SampleTee() bool
+		// RewriteLocation is used to rewrite the Location header of the response.
+		RewriteLocation(header http.Header)
 	}
 
 	// Params are used to store the variables in the search path and their corresponding values.
@@ -70,16 +123,37 @@ type (
 		Method  MethodType
 		host    string
 		queries url.Values
+		baggage http.Header
 
 		// Params are used to store the variables in the search path and their corresponding values.
 		Params   Params
 		captures map[string]string
 
+		// CaseInsensitiveHost makes the host lowercased for matching.
+		CaseInsensitiveHost bool
+		// StripHostTrailingDot strips a single trailing dot of the host.
+		StripHostTrailingDot bool
+		// ClientCAs verify the client certs not verified by the TLS layer.
+		ClientCAs        *x509.CertPool
+		clientCertStatus string
+
+		// ForwardedProtoTrusted means the peer is a trusted proxy, so the
+		// X-Forwarded-Proto header is the scheme of the request.
+		ForwardedProtoTrusted bool
+		scheme                string
+
 		// Cacheable means whether the route can be cached or not.
 		Cacheable bool
 		// Route represents the results of this search
-		Route                                                     Route
-		HeaderMismatch, MethodMismatch, QueryMismatch, IPMismatch bool
+		Route                                                                   Route
+		HeaderMismatch, MethodMismatch, QueryMismatch, IPMismatch, ALPNMismatch bool
+
+		// ClientCertMismatch means the client cert status is not matched.
+		ClientCertMismatch bool
+
+		// AllowedMethods are the methods of the paths rejecting the request
+		// by its method, they are reported when replying 405.
+		AllowedMethods MethodType
 	}
 
 	// MethodType represents the bit-operated representation of the http method.
@@ -99,6 +173,15 @@ const (
 	mTRACE
 )
 
+const (
+	// ClientCertVerified means the client cert is verified.
+	ClientCertVerified = "verified"
+	// ClientCertUnverified means the client cert is present but unverified.
+	ClientCertUnverified = "unverified"
+	// ClientCertAbsent means there isn't a client cert.
+	ClientCertAbsent = "absent"
+)
+
 var (
 	// MALL represents the methodType that can match all methods.
 	MALL = mCONNECT | mDELETE | mGET | mHEAD |
@@ -117,9 +200,34 @@ var (
 		http.MethodTrace:   mTRACE,
 	}
 
+	// methodNames are the methods in the order of MethodType.Names.
+	methodNames = []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodPost,
+		http.MethodPut,
+		http.MethodPatch,
+		http.MethodDelete,
+		http.MethodConnect,
+		http.MethodOptions,
+		http.MethodTrace,
+	}
+
 	kinds = map[string]*Kind{}
 )
 
+// Names returns the names of the methods of mt, in the order of GET, HEAD,
+// POST, PUT, PATCH, DELETE, CONNECT, OPTIONS and TRACE.
+func (mt MethodType) Names() []string {
+	var names []string
+	for _, m := range methodNames {
+		if mt&Methods[m] != 0 {
+			names = append(names, m)
+		}
+	}
+	return names
+}
+
 // Register registers a router kind.
 func Register(k *Kind) {
 	name := k.Name
@@ -144,6 +252,19 @@ func Create(kind string, rules Rules) Router {
 	return k.CreateInstance(rules)
 }
 
+// Inherit creates a router instance of kind, reusing the compiled rules
+// of the previous instance if the kind supports it.
+func Inherit(kind string, rules Rules, previous Router) Router {
+	k := kinds[kind]
+	if k == nil {
+		return nil
+	}
+	if k.InheritInstance == nil {
+		return k.CreateInstance(rules)
+	}
+	return k.InheritInstance(rules, previous)
+}
+
 // NewContext creates a context instance.
 func NewContext(req *httpprot.Request) *RouteContext {
 	path := req.Path()
@@ -169,15 +290,21 @@ func (ctx *RouteContext) GetCaptures() map[string]string {
 		return ctx.captures
 	}
 
+	decode := ctx.Route != nil && ctx.Route.GetDecodeCaptures()
 	for i, key := range ctx.Params.Keys {
 		value := ctx.Params.Values[i]
+		if decode {
+			value = DecodeCapture(value)
+		}
 		ctx.captures[key] = value
 	}
 
 	return ctx.captures
 }
 
-// GetHost is used to get and cache host.
+// GetHost is used to get and cache host, the port is stripped, a single
+// trailing dot is stripped if StripHostTrailingDot is true, and the host
+// is lowercased if CaseInsensitiveHost is true.
 func (ctx *RouteContext) GetHost() string {
 	if ctx.host != "" {
 		return ctx.host
@@ -187,6 +314,12 @@ func (ctx *RouteContext) GetHost() string {
 	if h, _, err := net.SplitHostPort(host); err == nil {
 		host = h
 	}
+	if ctx.StripHostTrailingDot {
+		host = strings.TrimSuffix(host, ".")
+	}
+	if ctx.CaseInsensitiveHost {
+		host = strings.ToLower(host)
+	}
 
 	ctx.host = host
 	return host
@@ -201,6 +334,85 @@ func (ctx *RouteContext) GetQueries() url.Values {
 	return ctx.queries
 }
 
+// GetBaggage is used to get the members of the W3C baggage header of the
+// request, the keys are case-insensitive as those of http.Header.
+func (ctx *RouteContext) GetBaggage() http.Header {
+	if ctx.baggage != nil {
+		return ctx.baggage
+	}
+
+	ctx.baggage = http.Header{}
+	b, err := baggage.Parse(ctx.Request.HTTPHeader().Get("baggage"))
+	if err != nil {
+		return ctx.baggage
+	}
+	for _, m := range b.Members() {
+		ctx.baggage.Set(m.Key(), m.Value())
+	}
+	return ctx.baggage
+}
+
+// GetClientCertStatus is used to get and cache the verification status of
+// the client cert, certs not verified by the TLS layer are verified by
+// ClientCAs.
+func (ctx *RouteContext) GetClientCertStatus() string {
+	if ctx.clientCertStatus != "" {
+		return ctx.clientCertStatus
+	}
+
+	state := ctx.Request.Std().TLS
+	switch {
+	case state == nil || len(state.PeerCertificates) == 0:
+		ctx.clientCertStatus = ClientCertAbsent
+	case len(state.VerifiedChains) > 0 || verifyClientCert(state.PeerCertificates, ctx.ClientCAs):
+		ctx.clientCertStatus = ClientCertVerified
+	default:
+		ctx.clientCertStatus = ClientCertUnverified
+	}
+	return ctx.clientCertStatus
+}
+
+// verifyClientCert verifies the client cert chain in the same way as the
+// TLS layer does.
+func verifyClientCert(certs []*x509.Certificate, roots *x509.CertPool) bool {
+	// x509 verifies with the system roots if roots is nil.
+	if roots == nil {
+		return false
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err == nil
+}
+
+// GetScheme is used to get and cache the scheme of the request, it is the
+// first value of the X-Forwarded-Proto header if ForwardedProtoTrusted is
+// true and the header is present, otherwise the scheme of the connection.
+func (ctx *RouteContext) GetScheme() string {
+	if ctx.scheme != "" {
+		return ctx.scheme
+	}
+
+	if ctx.ForwardedProtoTrusted {
+		proto, _, _ := strings.Cut(ctx.GetHeader().Get("X-Forwarded-Proto"), ",")
+		ctx.scheme = strings.ToLower(strings.TrimSpace(proto))
+	}
+	if ctx.scheme == "" {
+		ctx.scheme = "http"
+		if ctx.Request.Std().TLS != nil {
+			ctx.scheme = "https"
+		}
+	}
+	return ctx.scheme
+}
+
 // GetHeader is used to get request http header.
 func (ctx *RouteContext) GetHeader() http.Header {
 	return ctx.Request.HTTPHeader()
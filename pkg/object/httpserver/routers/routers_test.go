@@ -18,8 +18,16 @@
 package routers
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/megaease/easegress/pkg/protocols/httpprot"
 	"github.com/stretchr/testify/assert"
@@ -57,3 +65,110 @@ func TestGetCaptures(t *testing.T) {
 		"c": "3",
 	}, res)
 }
+
+// newTestCert creates a cert signed by the parent, the cert is self-signed
+// if parent is nil.
+func newTestCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestGetClientCertStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	ca, caKey := newTestCert(t, "ca", true, nil, nil)
+	client, _ := newTestCert(t, "client", false, ca, caKey)
+	otherCA, otherKey := newTestCert(t, "other", true, nil, nil)
+	stranger, _ := newTestCert(t, "stranger", false, otherCA, otherKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	tests := []struct {
+		state     *tls.ConnectionState
+		clientCAs *x509.CertPool
+		status    string
+	}{
+		{state: nil, clientCAs: pool, status: ClientCertAbsent},
+		{state: &tls.ConnectionState{}, clientCAs: pool, status: ClientCertAbsent},
+		{state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}, clientCAs: pool, status: ClientCertVerified},
+		{state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{stranger}}, clientCAs: pool, status: ClientCertUnverified},
+		// no client CAs to verify
+		{state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}, clientCAs: nil, status: ClientCertUnverified},
+		// verified by the TLS layer
+		{
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{stranger},
+				VerifiedChains:   [][]*x509.Certificate{{stranger, otherCA}},
+			},
+			clientCAs: nil,
+			status:    ClientCertVerified,
+		},
+	}
+
+	for _, test := range tests {
+		stdr, _ := http.NewRequest(http.MethodGet, "https://www.megaease.com/api", nil)
+		stdr.TLS = test.state
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := NewContext(req)
+		ctx.ClientCAs = test.clientCAs
+		assert.Equal(test.status, ctx.GetClientCertStatus())
+	}
+}
+
+func TestMethodTypeNames(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(MethodType(0).Names())
+	assert.Equal([]string{"GET", "POST"}, (mPOST | mGET).Names())
+	assert.Equal([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE"}, MALL.Names())
+}
+
+type testRoute struct {
+	*Path
+}
+
+func (r *testRoute) Rewrite(context *RouteContext) {}
+
+func TestGetCapturesDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	captures := func(decode bool) map[string]string {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/users/john%20doe", nil)
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := NewContext(req)
+		ctx.Route = &testRoute{Path: &Path{DecodeCaptures: decode}}
+		ctx.Params.Keys = []string{"name", "bad"}
+		ctx.Params.Values = []string{"john%20doe", "a%zz"}
+		return ctx.GetCaptures()
+	}
+
+	assert.Equal(map[string]string{"name": "john%20doe", "bad": "a%zz"}, captures(false))
+	assert.Equal(map[string]string{"name": "john doe", "bad": "a%zz"}, captures(true))
+}
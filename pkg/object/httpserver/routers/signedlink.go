@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/fasttime"
+)
+
+// SignedLink matches the time-limited signed links, that's the requests
+// with both the signature and the timestamp, in epoch seconds, in the
+// query. Links older than MaxAge are rejected with ExpiredStatusCode, the
+// default is 403. The signature is verified by the backend.
+type SignedLink struct {
+	SignatureParam    string `json:"signatureParam" jsonschema:"required"`
+	TimestampParam    string `json:"timestampParam" jsonschema:"required"`
+	MaxAge            string `json:"maxAge" jsonschema:"required,format=duration"`
+	ExpiredStatusCode int    `json:"expiredStatusCode,omitempty" jsonschema:"omitempty,minimum=400,maximum=599"`
+
+	maxAge time.Duration
+
+	// now returns the current time, it is replaced in unit tests.
+	now func() time.Time
+}
+
+func (sl *SignedLink) init() {
+	sl.maxAge, _ = time.ParseDuration(sl.MaxAge)
+	if sl.ExpiredStatusCode == 0 {
+		sl.ExpiredStatusCode = http.StatusForbidden
+	}
+	if sl.now == nil {
+		sl.now = fasttime.Now
+	}
+}
+
+// timestamp returns the timestamp of the link, false is returned if the
+// signature or the timestamp is missing or the timestamp is invalid.
+func (sl *SignedLink) timestamp(queries url.Values) (time.Time, bool) {
+	if queries.Get(sl.SignatureParam) == "" {
+		return time.Time{}, false
+	}
+	ts, err := strconv.ParseInt(queries.Get(sl.TimestampParam), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(ts, 0), true
+}
+
+// Match returns if the queries contain the signature and a valid timestamp.
+func (sl *SignedLink) Match(queries url.Values) bool {
+	_, ok := sl.timestamp(queries)
+	return ok
+}
+
+// Expired returns if the link of the request is older than MaxAge, no
+// request is expired if sl is nil.
+func (sl *SignedLink) Expired(req *httpprot.Request) bool {
+	if sl == nil {
+		return false
+	}
+
+	ts, ok := sl.timestamp(req.Std().URL.Query())
+	if !ok {
+		return false
+	}
+	return sl.now().Sub(ts) > sl.maxAge
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedLink(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	path := &Path{
+		PathPrefix: "/download",
+		SignedLink: &SignedLink{
+			SignatureParam: "sig",
+			TimestampParam: "ts",
+			MaxAge:         "10m",
+		},
+	}
+	path.SignedLink.now = func() time.Time { return now }
+	path.Init(nil)
+	assert.False(path.cacheable)
+	assert.Equal(http.StatusForbidden, path.GetSignedLink().ExpiredStatusCode)
+
+	newReq := func(query string) (*httpprot.Request, *RouteContext) {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/download/a.zip?"+query, nil)
+		req, _ := httpprot.NewRequest(stdr)
+		return req, NewContext(req)
+	}
+
+	// fresh link
+	req, ctx := newReq(fmt.Sprintf("sig=abc&ts=%d", now.Add(-time.Minute).Unix()))
+	assert.True(path.Match(ctx))
+	assert.False(path.SignedLink.Expired(req))
+
+	// expired link
+	req, ctx = newReq(fmt.Sprintf("sig=abc&ts=%d", now.Add(-time.Hour).Unix()))
+	assert.True(path.Match(ctx))
+	assert.True(path.SignedLink.Expired(req))
+
+	// missing or invalid timestamp, or missing signature
+	for _, query := range []string{"sig=abc", "sig=abc&ts=yesterday", fmt.Sprintf("ts=%d", now.Unix())} {
+		req, ctx = newReq(query)
+		assert.False(path.Match(ctx), query)
+		assert.True(ctx.QueryMismatch, query)
+		assert.False(path.SignedLink.Expired(req), query)
+	}
+
+	var sl *SignedLink
+	assert.False(sl.Expired(req))
+}
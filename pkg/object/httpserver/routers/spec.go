@@ -19,11 +19,17 @@ package routers
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
 	"github.com/megaease/easegress/pkg/util/ipfilter"
 	"github.com/megaease/easegress/pkg/util/stringtool"
 )
@@ -31,6 +37,9 @@ import (
 // Rules represents the set of rules.
 type Rules []*Rule
 
+// IPFilterPolicies are the named IP filters referenced by paths.
+type IPFilterPolicies map[string]*ipfilter.IPFilter
+
 // Paths represents the set of paths.
 type Paths []*Path
 
@@ -48,8 +57,22 @@ type Rule struct {
 	HostRegexp   string         `json:"hostRegexp" jsonschema:"omitempty,format=regexp"`
 	Paths        Paths          `json:"paths" jsonschema:"omitempty"`
 
-	ipFilter *ipfilter.IPFilter
-	hostRE   *regexp.Regexp
+	// Hosts are the exact hosts to match in addition to Host, the rule
+	// matches if the host of the request is any of them.
+	Hosts []string `json:"hosts,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+
+	// HostWildcard matches the host by a pattern like *.example.com, where
+	// each * stands for exactly one label of the host.
+	HostWildcard string `json:"hostWildcard,omitempty" jsonschema:"omitempty,pattern=^([*]|[^.*]+)([.]([*]|[^.*]+))*$"`
+
+	// StrictIPFilter stops the search at the rule if its IP filter blocks
+	// the request, so the request is replied with 403 instead of being
+	// routed by the following rules.
+	StrictIPFilter bool `json:"strictIPFilter,omitempty" jsonschema:"omitempty"`
+
+	ipFilter       *ipfilter.IPFilter
+	hostRE         *regexp.Regexp
+	hostWildcardRE *regexp.Regexp
 }
 
 // Path is second level entry of router.
@@ -66,10 +89,281 @@ type Path struct {
 	Queries           Queries        `json:"queries,omitempty" jsonschema:"omitempty"`
 	MatchAllHeader    bool           `json:"matchAllHeader" jsonschema:"omitempty"`
 	MatchAllQuery     bool           `json:"matchAllQuery" jsonschema:"omitempty"`
+	ALPNProtocols     []string       `json:"alpnProtocols,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	ClientCertStatus  []string       `json:"clientCertStatus,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	ResponseCache     *ResponseCache `json:"responseCache,omitempty" jsonschema:"omitempty"`
+
+	RequiredHeaders           []string `json:"requiredHeaders,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	RequiredHeadersStatusCode int      `json:"requiredHeadersStatusCode,omitempty" jsonschema:"omitempty,minimum=400,maximum=599"`
+
+	RewriteLocationHeader *RewriteLocationHeader `json:"rewriteLocationHeader,omitempty" jsonschema:"omitempty"`
+
+	// TeeBackends receive a copy of the request, their responses are
+	// discarded.
+	TeeBackends []string `json:"teeBackends,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	// TeePercent is the percentage of the requests copied to the tee
+	// backends, they are sampled evenly, 0 means all requests.
+	TeePercent uint32 `json:"teePercent,omitempty" jsonschema:"omitempty,minimum=0,maximum=100"`
+
+	// Baggage are matched against the members of the W3C baggage header,
+	// all of them must match, and the matched values are attached to the
+	// tracing span.
+	Baggage Headers `json:"baggage,omitempty" jsonschema:"omitempty"`
+
+	// TimeoutResponse overrides the timeout response of the server.
+	TimeoutResponse *TimeoutResponse `json:"timeoutResponse,omitempty" jsonschema:"omitempty"`
+
+	// IPFilterRef is the name of the IP filter policy of the server used
+	// as the IP filter of the path, it can't be used with IPFilterSpec.
+	IPFilterRef string `json:"ipFilterRef,omitempty" jsonschema:"omitempty"`
+
+	// RewriteHost overrides the host rewriting of the server.
+	RewriteHost *RewriteHost `json:"rewriteHost,omitempty" jsonschema:"omitempty"`
+
+	// ForceResponseContentType overwrites the Content-Type header of the
+	// responses of the backend.
+	ForceResponseContentType string `json:"forceResponseContentType,omitempty" jsonschema:"omitempty"`
+
+	// RefererFilter blocks requests referred by external domains.
+	RefererFilter *RefererFilter `json:"refererFilter,omitempty" jsonschema:"omitempty"`
+
+	// Canary routes a ramping share of the requests with specific headers
+	// to the canary backend.
+	Canary *Canary `json:"canary,omitempty" jsonschema:"omitempty"`
+
+	// GeoRestrict blocks the requests from specific countries with 451.
+	GeoRestrict *GeoRestrict `json:"geoRestrict,omitempty" jsonschema:"omitempty"`
+
+	// SignedLink matches the signed links in the query and rejects the
+	// expired ones.
+	SignedLink *SignedLink `json:"signedLink,omitempty" jsonschema:"omitempty"`
+
+	// Priority of the path, requests to paths with priority greater than
+	// 0 can use the slots reserved for high priority when the concurrency
+	// of the server is limited.
+	Priority int `json:"priority,omitempty" jsonschema:"omitempty"`
+
+	// AutoETag generates weak ETags from the bodies of the responses to
+	// GET requests, and replies 304 to the matching If-None-Match.
+	AutoETag bool `json:"autoETag,omitempty" jsonschema:"omitempty"`
+
+	// SegmentMatch matches the segments of the path by structured
+	// constraints, all of them must match.
+	SegmentMatch SegmentMatches `json:"segmentMatch,omitempty" jsonschema:"omitempty"`
+
+	// IsRangeRequest matches the requests with a valid Range header of
+	// bytes, like "bytes=0-499".
+	IsRangeRequest bool `json:"isRangeRequest,omitempty" jsonschema:"omitempty"`
+
+	// CaseInsensitive matches path and pathPrefix case-insensitively, use
+	// the (?i) flag for pathRegexp. Only the Ordered router supports it.
+	CaseInsensitive bool `json:"caseInsensitive,omitempty" jsonschema:"omitempty"`
+
+	// Idempotency replays the responses to the requests with the same
+	// idempotency key, e.g. the retries of payments.
+	Idempotency *Idempotency `json:"idempotency,omitempty" jsonschema:"omitempty"`
+
+	// Backends share the requests in proportion to their weights, they are
+	// used instead of Backend if specified.
+	Backends WeightedBackends `json:"backends,omitempty" jsonschema:"omitempty"`
+
+	// RequireContentTypeOnWrite are the media types accepted for POST, PUT
+	// and PATCH, the others and the missing ones are replied with 415.
+	RequireContentTypeOnWrite []string `json:"requireContentTypeOnWrite,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+
+	// AllowedRequestEncodings are the content codings accepted for the
+	// request body, like gzip, requests with other codings are replied
+	// with 415. Requests without Content-Encoding are always accepted.
+	AllowedRequestEncodings []string `json:"allowedRequestEncodings,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+
+	// TLSBackend and PlaintextBackend override Backend for the requests
+	// over TLS and plaintext connections respectively.
+	TLSBackend       string `json:"tlsBackend,omitempty" jsonschema:"omitempty"`
+	PlaintextBackend string `json:"plaintextBackend,omitempty" jsonschema:"omitempty"`
+
+	// AcceptLanguage are the language tags matched against the
+	// Accept-Language header, like "fr" or "zh-CN". The language of the
+	// highest quality value among the tags of all paths of the rule is
+	// selected, and the path matches if the language is one of its tags.
+	AcceptLanguage []string `json:"acceptLanguage,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+
+	// DecodeCaptures URL-decodes the values captured by the path, which
+	// may be escaped, like the %20 of "/users/john%20doe".
+	DecodeCaptures bool `json:"decodeCaptures,omitempty" jsonschema:"omitempty"`
+
+	// StripPrefix removes the matched PathPrefix from the path before the
+	// request is handled, the RewriteTarget, if any, is prepended to the
+	// rest of the path.
+	StripPrefix bool `json:"stripPrefix,omitempty" jsonschema:"omitempty"`
+
+	// Schemes are the schemes of the request to match, "http" or "https".
+	// The scheme is the X-Forwarded-Proto header if the peer is a trusted
+	// proxy, or the scheme of the connection otherwise.
+	Schemes []string `json:"schemes,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+
+	// Timeout overrides the request timeout of the server.
+	Timeout string `json:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+
+	// Fingerprint matches the requests looking like from bots, so they
+	// can be routed to a challenge backend.
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty" jsonschema:"omitempty"`
 
 	ipFilter             *ipfilter.IPFilter
+	ruleLanguages        []string
 	method               MethodType
 	cacheable, matchable bool
+	teeCount             *uint64
+	timeout              time.Duration
+}
+
+// TimeoutResponse is the response for requests not completed within the
+// request timeout of the server.
+type TimeoutResponse struct {
+	StatusCode int    `json:"statusCode" jsonschema:"required,format=httpcode"`
+	Body       string `json:"body,omitempty" jsonschema:"omitempty"`
+}
+
+// ResponseCache is the spec of the response cache of a path. Responses
+// not storable in a shared cache and those to authenticated requests are
+// not cached.
+type ResponseCache struct {
+	// Methods are the cacheable methods, default is GET and HEAD. The
+	// request body is part of the cache key for methods other than GET
+	// and HEAD.
+	Methods    []string `json:"methods,omitempty" jsonschema:"omitempty,uniqueItems=true,format=httpmethod-array"`
+	TTL        string   `json:"ttl,omitempty" jsonschema:"omitempty,format=duration"`
+	MaxEntries uint32   `json:"maxEntries,omitempty" jsonschema:"omitempty"`
+}
+
+// Idempotency is the spec of the idempotent requests of a path, the
+// response to the first request with a key in Header is cached for TTL,
+// and replayed to the requests of the same caller with the same key and
+// body, default Header is Idempotency-Key.
+type Idempotency struct {
+	Header     string `json:"header,omitempty" jsonschema:"omitempty"`
+	TTL        string `json:"ttl,omitempty" jsonschema:"omitempty,format=duration"`
+	MaxEntries uint32 `json:"maxEntries,omitempty" jsonschema:"omitempty"`
+}
+
+// RewriteLocationHeader rewrites the Location header of the responses of
+// a path, e.g. replacing the internal host of a backend with the external
+// one.
+type RewriteLocationHeader struct {
+	Match       string `json:"match" jsonschema:"required,format=regexp"`
+	Replacement string `json:"replacement" jsonschema:"omitempty"`
+
+	re *regexp.Regexp
+}
+
+// GeoRestrict blocks the requests from the BlockedCountries with 451 and
+// Body, e.g. the legal notice. The country of a request is the ISO 3166-1
+// alpha-2 code in CountryHeader, which is set by the GeoIP lookup in front
+// of the server, the default header is X-Country-Code.
+type GeoRestrict struct {
+	BlockedCountries []string `json:"blockedCountries" jsonschema:"required,uniqueItems=true"`
+	CountryHeader    string   `json:"countryHeader,omitempty" jsonschema:"omitempty"`
+	Body             string   `json:"body,omitempty" jsonschema:"omitempty"`
+}
+
+// Block returns if the request is from a blocked country, no request is
+// blocked if gr is nil.
+func (gr *GeoRestrict) Block(req *httpprot.Request) bool {
+	if gr == nil {
+		return false
+	}
+
+	key := gr.CountryHeader
+	if key == "" {
+		key = "X-Country-Code"
+	}
+	country := req.HTTPHeader().Get(key)
+	if country == "" {
+		return false
+	}
+
+	for _, c := range gr.BlockedCountries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteHost rewrites the host of the requests before they are handled
+// by the backend, e.g. to the virtual host expected by the backend. Match
+// is matched against the whole Host of the request, including the port.
+type RewriteHost struct {
+	Match       string `json:"match" jsonschema:"required,format=regexp"`
+	Replacement string `json:"replacement" jsonschema:"omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Init compiles the regular expression of the host rewriting.
+func (rh *RewriteHost) Init() {
+	rh.re = regexp.MustCompile(rh.Match)
+}
+
+// Rewrite rewrites the host of the request, it does nothing if rh is nil.
+func (rh *RewriteHost) Rewrite(req *httpprot.Request) {
+	if rh == nil {
+		return
+	}
+	req.SetHost(rh.re.ReplaceAllString(req.Host(), rh.Replacement))
+}
+
+// RefererFilter blocks requests whose Referer is not from any of the
+// AllowDomains, e.g. to prevent hotlinking of assets. A domain like
+// "*.megaease.com" matches all subdomains of megaease.com. The blocked
+// requests are routed to Backend if it is not empty, otherwise they are
+// replied with StatusCode.
+type RefererFilter struct {
+	AllowDomains []string `json:"allowDomains" jsonschema:"required,uniqueItems=true"`
+	AllowEmpty   bool     `json:"allowEmpty,omitempty" jsonschema:"omitempty"`
+	StatusCode   int      `json:"statusCode,omitempty" jsonschema:"omitempty,minimum=400,maximum=599"`
+	Backend      string   `json:"backend,omitempty" jsonschema:"omitempty"`
+}
+
+// Allow returns if the request with referer is allowed, all requests are
+// allowed if rf is nil.
+func (rf *RefererFilter) Allow(referer string) bool {
+	if rf == nil {
+		return true
+	}
+
+	if referer == "" {
+		return rf.AllowEmpty
+	}
+
+	u, err := url.Parse(referer)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return false
+	}
+
+	for _, d := range rf.AllowDomains {
+		d = strings.ToLower(d)
+		if strings.HasPrefix(d, "*.") {
+			if strings.HasSuffix(host, d[1:]) {
+				return true
+			}
+		} else if host == d {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStatusCode returns the status code for the blocked requests, the
+// default is 403.
+func (rf *RefererFilter) GetStatusCode() int {
+	if rf.StatusCode != 0 {
+		return rf.StatusCode
+	}
+	return http.StatusForbidden
 }
 
 // Headers represents the set of headers.
@@ -81,14 +375,40 @@ type Queries []*Query
 // Header is the third level entry of router. A header entry is always under a specific path entry, that is to mean
 // the headers entry will only be checked after a path entry matched. However, the headers entry has a higher priority
 // than the path entry itself.
+//
+// When the headers of several path entries could match a request, these path entries are evaluated in the order of
+// their definition, and the first one that matches wins, this is the same for both the Ordered and RadixTree routers.
 type Header struct {
 	Key    string   `json:"key" jsonschema:"required"`
 	Values []string `json:"values,omitempty" jsonschema:"omitempty,uniqueItems=true"`
 	Regexp string   `json:"regexp,omitempty" jsonschema:"omitempty,format=regexp"`
+	// Negate inverts the matching, the header matches if its value is not
+	// in Values and does not match Regexp, an absent header matches.
+	Negate bool `json:"negate,omitempty" jsonschema:"omitempty"`
+	// Present matches the presence of the header before Values and Regexp,
+	// true matches a non-empty value, and false matches an absent header.
+	Present *bool `json:"present,omitempty" jsonschema:"omitempty"`
 
 	re *regexp.Regexp
 }
 
+// SegmentMatches are the matching of the segments of the path.
+type SegmentMatches []*SegmentMatch
+
+// SegmentMatch matches the segment of the path at Index, the empty
+// segments are skipped. The segment must start with Prefix, and the rest
+// is checked by Type, e.g. index 0, prefix "v" and type "int" match the
+// "v2" of "/v2/users".
+type SegmentMatch struct {
+	Index  int    `json:"index" jsonschema:"minimum=0"`
+	Prefix string `json:"prefix,omitempty" jsonschema:"omitempty"`
+	Type   string `json:"type" jsonschema:"required,enum=int,enum=alpha,enum=alnum"`
+	// Min and Max are the range of the values of type int, Max 0 means
+	// no upper limit.
+	Min int `json:"min,omitempty" jsonschema:"omitempty,minimum=0"`
+	Max int `json:"max,omitempty" jsonschema:"omitempty,minimum=0"`
+}
+
 // Query is the third level entry.
 type Query struct {
 	Key    string   `json:"key" jsonschema:"required"`
@@ -99,14 +419,15 @@ type Query struct {
 }
 
 // Init is the initialization portal for Rules.
-func (rules Rules) Init() {
+func (rules Rules) Init(policies IPFilterPolicies) {
 	for _, rule := range rules {
-		rule.Init()
+		rule.Init(policies)
 	}
 }
 
-// Init is the initialization portal for Rule.
-func (rule *Rule) Init() {
+// Init is the initialization portal for Rule, policies are the IP filter
+// policies referenced by the paths.
+func (rule *Rule) Init(policies IPFilterPolicies) {
 	var hostRE *regexp.Regexp
 
 	if rule.HostRegexp != "" {
@@ -119,21 +440,41 @@ func (rule *Rule) Init() {
 
 	rule.ipFilter = ipfilter.New(rule.IPFilterSpec)
 	rule.hostRE = hostRE
+	rule.hostWildcardRE = compileHostWildcard(rule.HostWildcard)
+
+	var languages []string
+	for _, p := range rule.Paths {
+		languages = append(languages, p.AcceptLanguage...)
+	}
 
 	for _, p := range rule.Paths {
+		if len(p.AcceptLanguage) > 0 {
+			p.ruleLanguages = languages
+		}
+		if p.IPFilterRef != "" {
+			p.ipFilter = policies[p.IPFilterRef]
+		}
 		p.Init(rule.ipFilter)
 	}
 }
 
 // MatchHost matches the host of the request to the rule.
 func (rule *Rule) MatchHost(ctx *RouteContext) bool {
-	if rule.Host == "" && rule.hostRE == nil {
+	if rule.Host == "" && len(rule.Hosts) == 0 && rule.hostWildcardRE == nil && rule.hostRE == nil {
 		return true
 	}
 
 	host := ctx.GetHost()
 
-	if rule.Host != "" && rule.Host == host {
+	if rule.Host != "" && matchExactHost(ctx, rule.Host, host) {
+		return true
+	}
+	for _, h := range rule.Hosts {
+		if matchExactHost(ctx, h, host) {
+			return true
+		}
+	}
+	if rule.hostWildcardRE != nil && rule.hostWildcardRE.MatchString(host) {
 		return true
 	}
 	if rule.hostRE != nil && rule.hostRE.MatchString(host) {
@@ -143,19 +484,75 @@ func (rule *Rule) MatchHost(ctx *RouteContext) bool {
 	return false
 }
 
-// AllowIP return if rule ipFilter allows the incoming ip.
-func (rule *Rule) AllowIP(ip string) bool {
-	return rule.ipFilter.Allow(ip)
+// matchExactHost returns if the host of the request is the expected one,
+// they are compared case-insensitively if CaseInsensitiveHost is true.
+func matchExactHost(ctx *RouteContext, expected, host string) bool {
+	if expected == host {
+		return true
+	}
+	return ctx.CaseInsensitiveHost && strings.EqualFold(expected, host)
+}
+
+// compileHostWildcard compiles a host wildcard pattern into an anchored
+// regexp, a * label matches exactly one label of the host, and the match
+// is case-insensitive as host names are.
+func compileHostWildcard(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+
+	labels := strings.Split(pattern, ".")
+	for i, label := range labels {
+		if label == "*" {
+			labels[i] = "[^.]+"
+		} else {
+			labels[i] = regexp.QuoteMeta(label)
+		}
+	}
+	return regexp.MustCompile(`(?i)^` + strings.Join(labels, `\.`) + `$`)
+}
+
+// AllowIP return if rule ipFilter allows the incoming ip, trustedIP is used
+// to decide the loopback exemption, see ipfilter.IPFilter.AllowClient.
+func (rule *Rule) AllowIP(ip, trustedIP string) bool {
+	return rule.ipFilter.AllowClient(ip, trustedIP)
 }
 
 // Init is the initialization portal for Path
 func (p *Path) Init(parentIPFilter *ipfilter.IPFilter) {
-	p.ipFilter = ipfilter.New(p.IPFilterSpec)
+	// the IP filter of a path referencing a policy is set by its rule.
+	if p.IPFilterRef == "" {
+		p.ipFilter = ipfilter.New(p.IPFilterSpec)
+	}
 
 	p.Headers.init()
 	p.Queries.init()
+	p.Baggage.init()
+
+	if rlh := p.RewriteLocationHeader; rlh != nil {
+		rlh.re = regexp.MustCompile(rlh.Match)
+	}
+	if p.RewriteHost != nil {
+		p.RewriteHost.Init()
+	}
+	if p.Canary != nil {
+		p.Canary.init()
+	}
+	if p.SignedLink != nil {
+		p.SignedLink.init()
+	}
+	if p.Fingerprint != nil {
+		p.Fingerprint.init()
+	}
+	if p.TeePercent > 0 {
+		p.teeCount = new(uint64)
+	}
+	if p.Timeout != "" {
+		p.timeout, _ = time.ParseDuration(p.Timeout)
+	}
 
-	method := MALL
+	// CONNECT is a tunneling method, it must be declared explicitly.
+	method := MALL &^ mCONNECT
 	if len(p.Methods) != 0 {
 		method = 0
 		for _, m := range p.Methods {
@@ -166,11 +563,13 @@ func (p *Path) Init(parentIPFilter *ipfilter.IPFilter) {
 	p.method = method
 	p.matchable = true
 
-	if len(p.Headers) == 0 && len(p.Queries) == 0 && p.ipFilter == nil {
+	if len(p.Headers) == 0 && len(p.Queries) == 0 && len(p.Baggage) == 0 && len(p.ALPNProtocols) == 0 && len(p.ClientCertStatus) == 0 && !p.IsRangeRequest && p.SignedLink == nil && len(p.AcceptLanguage) == 0 && len(p.Schemes) == 0 && p.Fingerprint == nil && p.ipFilter == nil {
 		if parentIPFilter == nil {
 			p.cacheable = true
 		}
-		if len(p.Methods) == 0 {
+		// the segments are part of the path, so the path is still
+		// cacheable with them.
+		if len(p.Methods) == 0 && len(p.SegmentMatch) == 0 {
 			p.matchable = false
 		}
 	}
@@ -182,17 +581,59 @@ func (p *Path) Validate() error {
 		return fmt.Errorf("rewriteTarget is specified but path is empty")
 	}
 
+	if p.StripPrefix && p.PathPrefix == "" {
+		return fmt.Errorf("stripPrefix is specified but pathPrefix is empty")
+	}
+
+	for _, scheme := range p.Schemes {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("invalid scheme %s", scheme)
+		}
+	}
+
+	if p.IPFilterRef != "" && p.IPFilterSpec != nil {
+		return fmt.Errorf("ipFilter and ipFilterRef can't be both specified")
+	}
+
+	for _, status := range p.ClientCertStatus {
+		switch status {
+		case ClientCertVerified, ClientCertUnverified, ClientCertAbsent:
+		default:
+			return fmt.Errorf("invalid client cert status %s", status)
+		}
+	}
+
+	if p.PathRegexp != "" {
+		if _, err := regexp.Compile(p.PathRegexp); err != nil {
+			return fmt.Errorf("invalid pathRegexp %s: %v", p.PathRegexp, err)
+		}
+		if _, err := ParseRewriteTarget(p.RewriteTarget); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// AllowIP return if rule ipFilter allows the incoming ip.
-func (p *Path) AllowIP(ip string) bool {
-	return p.ipFilter.Allow(ip)
+// IsCatchAllRegexp returns whether PathRegexp is unanchored and begins
+// with ".*", so it matches any path and shadows the following paths.
+func (p *Path) IsCatchAllRegexp() bool {
+	return strings.HasPrefix(p.PathRegexp, ".*")
+}
+
+// AllowIP return if path ipFilter allows the incoming ip, trustedIP is used
+// to decide the loopback exemption, see ipfilter.IPFilter.AllowClient.
+func (p *Path) AllowIP(ip, trustedIP string) bool {
+	return p.ipFilter.AllowClient(ip, trustedIP)
 }
 
 // Match is the matching function of path.
 func (p *Path) Match(context *RouteContext) bool {
-	context.Cacheable = p.cacheable
+	// The route depends on more than the host, method and path if a
+	// previous path or rule is rejected by the headers, queries or other
+	// properties of the request, so it can't be cached either.
+	context.Cacheable = p.cacheable && !context.HeaderMismatch && !context.QueryMismatch &&
+		!context.IPMismatch && !context.ALPNMismatch && !context.ClientCertMismatch
 
 	if !p.matchable {
 		return true
@@ -202,8 +643,13 @@ func (p *Path) Match(context *RouteContext) bool {
 	req := context.Request
 	ip := req.RealIP()
 
+	if len(p.SegmentMatch) > 0 && !p.SegmentMatch.Match(context.Path) {
+		return false
+	}
+
 	if context.Method&p.method == 0 {
 		context.MethodMismatch = true
+		context.AllowedMethods |= p.method
 		return false
 	}
 
@@ -217,7 +663,47 @@ func (p *Path) Match(context *RouteContext) bool {
 		return false
 	}
 
-	if !p.AllowIP(ip) {
+	if p.SignedLink != nil && !p.SignedLink.Match(context.GetQueries()) {
+		context.QueryMismatch = true
+		return false
+	}
+
+	if len(p.Baggage) > 0 && !p.Baggage.Match(context.GetBaggage(), true) {
+		context.HeaderMismatch = true
+		return false
+	}
+
+	if p.IsRangeRequest && !isRangeRequest(context.GetHeader().Get("Range")) {
+		context.HeaderMismatch = true
+		return false
+	}
+
+	if len(p.AcceptLanguage) > 0 && !p.matchAcceptLanguage(context.GetHeader().Get("Accept-Language")) {
+		context.HeaderMismatch = true
+		return false
+	}
+
+	if len(p.Schemes) > 0 && !stringtool.StrInSlice(context.GetScheme(), p.Schemes) {
+		context.HeaderMismatch = true
+		return false
+	}
+
+	if p.Fingerprint != nil && !p.Fingerprint.Match(req) {
+		context.HeaderMismatch = true
+		return false
+	}
+
+	if len(p.ALPNProtocols) > 0 && !p.matchALPN(req) {
+		context.ALPNMismatch = true
+		return false
+	}
+
+	if len(p.ClientCertStatus) > 0 && !stringtool.StrInSlice(context.GetClientCertStatus(), p.ClientCertStatus) {
+		context.ClientCertMismatch = true
+		return false
+	}
+
+	if !p.AllowIP(ip, req.TrustedIP()) {
 		context.IPMismatch = true
 		return false
 	}
@@ -225,16 +711,209 @@ func (p *Path) Match(context *RouteContext) bool {
 	return true
 }
 
+// isRangeRequest returns whether the Range header is a valid byte range
+// set, like "bytes=0-499", "bytes=500-" or "bytes=-500, 1000-1499".
+func isRangeRequest(rangeHeader string) bool {
+	const prefix = "bytes="
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		return false
+	}
+
+	for _, r := range strings.Split(rangeHeader[len(prefix):], ",") {
+		start, end, ok := strings.Cut(strings.TrimSpace(r), "-")
+		if !ok || (start == "" && end == "") {
+			return false
+		}
+		first, err := parseRangePos(start)
+		if err != nil {
+			return false
+		}
+		last, err := parseRangePos(end)
+		if err != nil {
+			return false
+		}
+		if start != "" && end != "" && last < first {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRangePos parses a position of a byte range, empty is allowed.
+func parseRangePos(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid position %s", s)
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// matchALPN matches the negotiated ALPN protocol of the TLS connection,
+// requests not over TLS never match.
+func (p *Path) matchALPN(req *httpprot.Request) bool {
+	state := req.Std().TLS
+	if state == nil {
+		return false
+	}
+	return stringtool.StrInSlice(state.NegotiatedProtocol, p.ALPNProtocols)
+}
+
 // GetBackend is used to get the backend corresponding to the route.
 func (p *Path) GetBackend() string {
+	if p.Backend == "" && len(p.Backends) > 0 {
+		return p.Backends[0].Name
+	}
 	return p.Backend
 }
 
+// GetConnBackend is used to get the backend for the TLS or plaintext
+// connections corresponding to the route, empty means to use the others.
+func (p *Path) GetConnBackend(tls bool) string {
+	if tls {
+		return p.TLSBackend
+	}
+	return p.PlaintextBackend
+}
+
+// GetBackends is used to get the weighted backends corresponding to the route.
+func (p *Path) GetBackends() WeightedBackends {
+	return p.Backends
+}
+
 // GetClientMaxBodySize is used to get the clientMaxBodySize corresponding to the route.
 func (p *Path) GetClientMaxBodySize() int64 {
 	return p.ClientMaxBodySize
 }
 
+// GetRequiredHeaders is used to get the required headers corresponding to the
+// route, and the status code for requests lacking any of them.
+func (p *Path) GetRequiredHeaders() ([]string, int) {
+	code := p.RequiredHeadersStatusCode
+	if code == 0 {
+		code = http.StatusBadRequest
+	}
+	return p.RequiredHeaders, code
+}
+
+// GetRequireContentTypeOnWrite is used to get the media types accepted for
+// the writes corresponding to the route.
+func (p *Path) GetRequireContentTypeOnWrite() []string {
+	return p.RequireContentTypeOnWrite
+}
+
+// GetAllowedRequestEncodings is used to get the content codings accepted
+// for the request body corresponding to the route.
+func (p *Path) GetAllowedRequestEncodings() []string {
+	return p.AllowedRequestEncodings
+}
+
+// GetTeeBackends is used to get the tee backends corresponding to the route.
+func (p *Path) GetTeeBackends() []string {
+	return p.TeeBackends
+}
+
+// SampleTee is used to decide whether to copy the request to the tee
+// backends, the n-th request is copied if floor(n*TeePercent/100)
+// increases, the same as the canary.
+func (p *Path) SampleTee() bool {
+	if p.teeCount == nil || p.TeePercent >= 100 {
+		return true
+	}
+
+	share := float64(p.TeePercent) / 100
+	n := float64(atomic.AddUint64(p.teeCount, 1))
+	return math.Floor(n*share) > math.Floor((n-1)*share)
+}
+
+// GetBaggage is used to get the baggage conditions corresponding to the route.
+func (p *Path) GetBaggage() Headers {
+	return p.Baggage
+}
+
+// GetTimeoutResponse is used to get the timeout response corresponding to the route.
+func (p *Path) GetTimeoutResponse() *TimeoutResponse {
+	return p.TimeoutResponse
+}
+
+// GetRewriteHost is used to get the host rewriting corresponding to the route.
+func (p *Path) GetRewriteHost() *RewriteHost {
+	return p.RewriteHost
+}
+
+// GetForceResponseContentType is used to get the forced response Content-Type corresponding to the route.
+func (p *Path) GetForceResponseContentType() string {
+	return p.ForceResponseContentType
+}
+
+// GetRefererFilter is used to get the referer filter corresponding to the route.
+func (p *Path) GetRefererFilter() *RefererFilter {
+	return p.RefererFilter
+}
+
+// GetCanary is used to get the canary corresponding to the route.
+func (p *Path) GetCanary() *Canary {
+	return p.Canary
+}
+
+// GetGeoRestrict is used to get the geo restriction corresponding to the route.
+func (p *Path) GetGeoRestrict() *GeoRestrict {
+	return p.GeoRestrict
+}
+
+// GetSignedLink is used to get the signed link corresponding to the route.
+func (p *Path) GetSignedLink() *SignedLink {
+	return p.SignedLink
+}
+
+// GetPriority is used to get the priority corresponding to the route.
+func (p *Path) GetPriority() int {
+	return p.Priority
+}
+
+// GetAutoETag is used to get whether to generate ETags corresponding to the route.
+func (p *Path) GetAutoETag() bool {
+	return p.AutoETag
+}
+
+// GetDecodeCaptures is used to get whether to URL-decode the captures corresponding to the route.
+func (p *Path) GetDecodeCaptures() bool {
+	return p.DecodeCaptures
+}
+
+// GetTimeout is used to get the request timeout corresponding to the route.
+func (p *Path) GetTimeout() time.Duration {
+	return p.timeout
+}
+
+// GetResponseCache is used to get the response cache spec corresponding to the route.
+func (p *Path) GetResponseCache() *ResponseCache {
+	return p.ResponseCache
+}
+
+// GetIdempotency is used to get the idempotency spec corresponding to the route.
+func (p *Path) GetIdempotency() *Idempotency {
+	return p.Idempotency
+}
+
+// RewriteLocation rewrites the Location header of the response of the route.
+func (p *Path) RewriteLocation(header http.Header) {
+	rlh := p.RewriteLocationHeader
+	if rlh == nil {
+		return
+	}
+
+	location := header.Get("Location")
+	if location == "" {
+		return
+	}
+
+	header.Set("Location", rlh.re.ReplaceAllString(location, rlh.Replacement))
+}
+
 func (hs Headers) init() {
 	for _, h := range hs {
 		if h.Regexp != "" {
@@ -243,11 +922,76 @@ func (hs Headers) init() {
 	}
 }
 
+// Validate validates SegmentMatch.
+func (sm *SegmentMatch) Validate() error {
+	if sm.Type != "int" && (sm.Min != 0 || sm.Max != 0) {
+		return fmt.Errorf("min and max are only for type int")
+	}
+	if sm.Max != 0 && sm.Max < sm.Min {
+		return fmt.Errorf("max %d is less than min %d", sm.Max, sm.Min)
+	}
+	return nil
+}
+
+// Match is the matching function of SegmentMatches.
+func (sms SegmentMatches) Match(path string) bool {
+	segments := make([]string, 0, strings.Count(path, "/"))
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+
+	for _, sm := range sms {
+		if sm.Index >= len(segments) || !sm.match(segments[sm.Index]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sm *SegmentMatch) match(segment string) bool {
+	if !strings.HasPrefix(segment, sm.Prefix) {
+		return false
+	}
+	value := segment[len(sm.Prefix):]
+	if value == "" {
+		return false
+	}
+
+	switch sm.Type {
+	case "int":
+		for _, c := range value {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return false
+		}
+		return n >= sm.Min && (sm.Max == 0 || n <= sm.Max)
+	case "alpha":
+		for _, c := range value {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+				return false
+			}
+		}
+	default: // alnum
+		for _, c := range value {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Validate validates Headers.
 func (hs Headers) Validate() error {
 	for _, h := range hs {
-		if len(h.Values) == 0 && h.Regexp == "" {
-			return fmt.Errorf("both of values and regexp are empty for key: %s", h.Key)
+		if !h.hasValueMatch() && h.Present == nil {
+			return fmt.Errorf("values, regexp and present are all empty for key: %s", h.Key)
 		}
 	}
 	return nil
@@ -261,6 +1005,22 @@ func (hs Headers) Match(headers http.Header, matchAll bool) bool {
 
 	if matchAll {
 		for _, h := range hs {
+			if h.Present != nil {
+				if !h.matchPresence(headers) {
+					return false
+				}
+				if !*h.Present || !h.hasValueMatch() {
+					continue
+				}
+			}
+
+			if h.Negate {
+				if !h.matchNegated(headers) {
+					return false
+				}
+				continue
+			}
+
 			v := headers.Get(h.Key)
 			if len(h.Values) > 0 && !stringtool.StrInSlice(v, h.Values) {
 				return false
@@ -272,6 +1032,22 @@ func (hs Headers) Match(headers http.Header, matchAll bool) bool {
 		}
 	} else {
 		for _, h := range hs {
+			if h.Present != nil {
+				if !h.matchPresence(headers) {
+					continue
+				}
+				if !*h.Present || !h.hasValueMatch() {
+					return true
+				}
+			}
+
+			if h.Negate {
+				if h.matchNegated(headers) {
+					return true
+				}
+				continue
+			}
+
 			v := headers.Get(h.Key)
 			if stringtool.StrInSlice(v, h.Values) {
 				return true
@@ -286,6 +1062,34 @@ func (hs Headers) Match(headers http.Header, matchAll bool) bool {
 	return matchAll
 }
 
+// hasValueMatch returns if the header has Values or Regexp to match.
+func (h *Header) hasValueMatch() bool {
+	return len(h.Values) > 0 || h.Regexp != ""
+}
+
+// matchPresence returns if the presence of the header is the expected one,
+// an empty value is neither present nor absent.
+func (h *Header) matchPresence(headers http.Header) bool {
+	if *h.Present {
+		return headers.Get(h.Key) != ""
+	}
+	return len(headers.Values(h.Key)) == 0
+}
+
+// matchNegated returns true if the header is absent, or its value is
+// neither in Values nor matches Regexp.
+func (h *Header) matchNegated(headers http.Header) bool {
+	if len(headers.Values(h.Key)) == 0 {
+		return true
+	}
+
+	v := headers.Get(h.Key)
+	if stringtool.StrInSlice(v, h.Values) {
+		return false
+	}
+	return h.Regexp == "" || !h.re.MatchString(v)
+}
+
 func (qs Queries) init() {
 	for _, q := range qs {
 		if q.Regexp != "" {
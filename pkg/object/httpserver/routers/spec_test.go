@@ -18,6 +18,8 @@
 package routers
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net/http"
 	"testing"
 
@@ -42,7 +44,7 @@ func TestRuleInit(t *testing.T) {
 		},
 	}
 
-	rule.Init()
+	rule.Init(nil)
 
 	assert.NotNil(rule.hostRE)
 	assert.NotNil(rule.ipFilter)
@@ -64,7 +66,7 @@ func TestRuleInit(t *testing.T) {
 		},
 	}
 
-	rule2.Init()
+	rule2.Init(nil)
 
 	assert.NotNil(rule2.hostRE)
 	assert.NotNil(rule2.ipFilter)
@@ -80,27 +82,85 @@ func TestRuleMatch(t *testing.T) {
 	ctx := NewContext(req)
 
 	rule := &Rule{}
-	rule.Init()
+	rule.Init(nil)
 
 	assert.NotNil(rule)
 	assert.True(rule.MatchHost(ctx))
 
 	rule = &Rule{Host: "www.megaease.com"}
-	rule.Init()
+	rule.Init(nil)
 	assert.NotNil(rule)
 	assert.True(rule.MatchHost(ctx))
 
 	rule = &Rule{HostRegexp: `^[^.]+\.megaease\.com$`}
-	rule.Init()
+	rule.Init(nil)
 	assert.NotNil(rule)
 	assert.True(rule.MatchHost(ctx))
 
 	rule = &Rule{HostRegexp: `^[^.]+\.megaease\.cn$`}
-	rule.Init()
+	rule.Init(nil)
 	assert.NotNil(rule)
 	assert.False(rule.MatchHost(ctx))
 }
 
+func TestRuleMatchHostWildcard(t *testing.T) {
+	assert := assert.New(t)
+
+	matchHost := func(rule *Rule, host string) bool {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://"+host+":8080", nil)
+		req, _ := httpprot.NewRequest(stdr)
+		rule.Init(nil)
+		return rule.MatchHost(NewContext(req))
+	}
+
+	rule := &Rule{HostWildcard: "*.example.com"}
+	assert.True(matchHost(rule, "a.example.com"))
+	assert.True(matchHost(rule, "A.Example.COM"))
+	assert.False(matchHost(rule, "example.com"))
+	assert.False(matchHost(rule, "a.b.example.com"))
+	assert.False(matchHost(rule, "aexample.com"))
+
+	rule = &Rule{HostWildcard: "api.*.internal"}
+	assert.True(matchHost(rule, "api.eu.internal"))
+	assert.False(matchHost(rule, "api.internal"))
+	assert.False(matchHost(rule, "web.eu.internal"))
+
+	// exact host is checked before the wildcard, and the regexp after it.
+	rule = &Rule{Host: "example.com", HostWildcard: "*.example.com", HostRegexp: `^example\.org$`}
+	assert.True(matchHost(rule, "example.com"))
+	assert.True(matchHost(rule, "a.example.com"))
+	assert.True(matchHost(rule, "example.org"))
+	assert.False(matchHost(rule, "a.example.org"))
+}
+
+func TestRuleMatchHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	matchHost := func(rule *Rule, host string, caseInsensitive bool) bool {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://"+host+":8080", nil)
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := NewContext(req)
+		ctx.CaseInsensitiveHost = caseInsensitive
+		rule.Init(nil)
+		return rule.MatchHost(ctx)
+	}
+
+	rule := &Rule{Hosts: []string{"example.com", "www.example.com", "example.org"}}
+	assert.True(matchHost(rule, "example.com", false))
+	assert.True(matchHost(rule, "www.example.com", false))
+	assert.True(matchHost(rule, "example.org", false))
+	assert.False(matchHost(rule, "api.example.com", false))
+	assert.False(matchHost(rule, "Example.ORG", false))
+	assert.True(matchHost(rule, "Example.ORG", true))
+
+	// host and hostRegexp still work along with hosts.
+	rule = &Rule{Host: "example.net", Hosts: []string{"example.com"}, HostRegexp: `^[^.]+\.example\.io$`}
+	assert.True(matchHost(rule, "example.net", false))
+	assert.True(matchHost(rule, "example.com", false))
+	assert.True(matchHost(rule, "a.example.io", false))
+	assert.False(matchHost(rule, "example.org", false))
+}
+
 func TestRuleAllowIP(t *testing.T) {
 	assert := assert.New(t)
 
@@ -118,14 +178,14 @@ func TestRuleAllowIP(t *testing.T) {
 		},
 	}
 
-	rule.Init()
+	rule.Init(nil)
 
-	assert.True(rule.AllowIP("192.168.1.1"))
-	assert.False(rule.AllowIP("10.168.1.1"))
+	assert.True(rule.AllowIP("192.168.1.1", "192.168.1.1"))
+	assert.False(rule.AllowIP("10.168.1.1", "10.168.1.1"))
 
 	rule.ipFilter = nil
-	assert.True(rule.AllowIP("192.168.1.1"))
-	assert.True(rule.AllowIP("10.168.1.1"))
+	assert.True(rule.AllowIP("192.168.1.1", "192.168.1.1"))
+	assert.True(rule.AllowIP("10.168.1.1", "10.168.1.1"))
 }
 
 func TestPathInit(t *testing.T) {
@@ -152,7 +212,7 @@ func TestPathInit(t *testing.T) {
 	path.Init(nil)
 
 	assert.NotNil(path.ipFilter)
-	assert.Equal(path.method, MALL)
+	assert.Equal(path.method, MALL&^mCONNECT)
 	assert.NotNil(path.Headers[0].re)
 	assert.NotNil(path.Queries[0].re)
 
@@ -236,12 +296,12 @@ func TestPathAllowIP(t *testing.T) {
 
 	path.Init(nil)
 
-	assert.True(path.AllowIP("192.168.1.1"))
-	assert.False(path.AllowIP("10.168.1.1"))
+	assert.True(path.AllowIP("192.168.1.1", "192.168.1.1"))
+	assert.False(path.AllowIP("10.168.1.1", "10.168.1.1"))
 
 	path.ipFilter = nil
-	assert.True(path.AllowIP("192.168.1.1"))
-	assert.True(path.AllowIP("10.168.1.1"))
+	assert.True(path.AllowIP("192.168.1.1", "192.168.1.1"))
+	assert.True(path.AllowIP("10.168.1.1", "10.168.1.1"))
 }
 
 func TestPathMatch(t *testing.T) {
@@ -395,6 +455,255 @@ func TestPathMatch1(t *testing.T) {
 	assert.True(ctx.Cacheable)
 }
 
+func TestPathMatchALPN(t *testing.T) {
+	assert := assert.New(t)
+
+	path := &Path{
+		Path:          "/api",
+		ALPNProtocols: []string{"h2"},
+	}
+	path.Init(nil)
+	assert.False(path.cacheable)
+	assert.True(path.matchable)
+
+	tests := []struct {
+		state        *tls.ConnectionState
+		result, miss bool
+	}{
+		{state: &tls.ConnectionState{NegotiatedProtocol: "h2"}, result: true},
+		{state: &tls.ConnectionState{NegotiatedProtocol: "http/1.1"}, miss: true},
+		{state: nil, miss: true},
+	}
+
+	for _, test := range tests {
+		stdr, _ := http.NewRequest(http.MethodGet, "/api", nil)
+		stdr.TLS = test.state
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := NewContext(req)
+
+		assert.Equal(test.result, path.Match(ctx))
+		assert.Equal(test.miss, ctx.ALPNMismatch)
+		assert.False(ctx.Cacheable)
+	}
+}
+
+func TestPathMatchClientCertStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	path := &Path{
+		Path:             "/api",
+		ClientCertStatus: []string{ClientCertUnverified, ClientCertAbsent},
+	}
+	assert.NoError(path.Validate())
+	path.Init(nil)
+	assert.False(path.cacheable)
+
+	cert := &x509.Certificate{}
+	tests := []struct {
+		state        *tls.ConnectionState
+		result, miss bool
+	}{
+		{state: nil, result: true},
+		{state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, result: true},
+		{state: &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}, miss: true},
+	}
+
+	for _, test := range tests {
+		stdr, _ := http.NewRequest(http.MethodGet, "/api", nil)
+		stdr.TLS = test.state
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := NewContext(req)
+
+		assert.Equal(test.result, path.Match(ctx))
+		assert.Equal(test.miss, ctx.ClientCertMismatch)
+	}
+
+	path = &Path{Path: "/api", ClientCertStatus: []string{"expired"}}
+	assert.Error(path.Validate())
+}
+
+func TestPathMatchSchemes(t *testing.T) {
+	assert := assert.New(t)
+
+	path := &Path{Path: "/api", Schemes: []string{"https"}}
+	assert.NoError(path.Validate())
+	path.Init(nil)
+	assert.False(path.cacheable)
+
+	tests := []struct {
+		state        *tls.ConnectionState
+		proto        string
+		trusted      bool
+		result, miss bool
+	}{
+		{state: &tls.ConnectionState{}, result: true},
+		{miss: true},
+		{proto: "https", miss: true},
+		{proto: "https", trusted: true, result: true},
+		{state: &tls.ConnectionState{}, proto: "http", trusted: true, miss: true},
+	}
+
+	for _, test := range tests {
+		stdr, _ := http.NewRequest(http.MethodGet, "/api", nil)
+		stdr.TLS = test.state
+		if test.proto != "" {
+			stdr.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := NewContext(req)
+		ctx.ForwardedProtoTrusted = test.trusted
+
+		assert.Equal(test.result, path.Match(ctx))
+		assert.Equal(test.miss, ctx.HeaderMismatch)
+	}
+
+	path = &Path{Path: "/api", Schemes: []string{"ws"}}
+	assert.Error(path.Validate())
+}
+
+func TestPathValidatePathRegexp(t *testing.T) {
+	assert := assert.New(t)
+
+	path := &Path{PathRegexp: "^/api/(\\w+"}
+	err := path.Validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), "invalid pathRegexp")
+
+	path = &Path{PathRegexp: ".*/api"}
+	assert.NoError(path.Validate())
+	assert.True(path.IsCatchAllRegexp())
+
+	path = &Path{PathRegexp: "^.*/api"}
+	assert.False(path.IsCatchAllRegexp())
+	path = &Path{Path: "/api"}
+	assert.False(path.IsCatchAllRegexp())
+}
+
+func TestSegmentMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	version := SegmentMatches{{Index: 0, Prefix: "v", Type: "int", Min: 1, Max: 3}}
+	assert.True(version.Match("/v1/users"))
+	assert.True(version.Match("//v3"))
+	assert.False(version.Match("/v4/users"))
+	assert.False(version.Match("/v0/users"))
+	assert.False(version.Match("/vx/users"))
+	assert.False(version.Match("/v/users"))
+	assert.False(version.Match("/v-1/users"))
+	assert.False(version.Match("/users/v1"))
+	assert.False(version.Match("/"))
+
+	sms := SegmentMatches{
+		{Index: 1, Type: "alpha"},
+		{Index: 2, Prefix: "id-", Type: "alnum"},
+	}
+	assert.True(sms.Match("/v1/users/id-a1"))
+	assert.False(sms.Match("/v1/users1/id-a1"))
+	assert.False(sms.Match("/v1/users/id-a_1"))
+	assert.False(sms.Match("/v1/users"))
+
+	path := &Path{PathPrefix: "/", SegmentMatch: version}
+	path.Init(nil)
+	assert.True(path.cacheable)
+	assert.True(path.matchable)
+
+	assert.NoError(version[0].Validate())
+	assert.Error((&SegmentMatch{Type: "int", Min: 3, Max: 1}).Validate())
+	assert.Error((&SegmentMatch{Type: "alpha", Max: 1}).Validate())
+}
+
+func TestPathMatchRangeRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	path := &Path{PathPrefix: "/media", IsRangeRequest: true}
+	path.Init(nil)
+	assert.False(path.cacheable)
+
+	tests := []struct {
+		rangeHeader  string
+		result, miss bool
+	}{
+		{rangeHeader: "bytes=0-499", result: true},
+		{rangeHeader: "bytes=500-", result: true},
+		{rangeHeader: "bytes=-500", result: true},
+		{rangeHeader: "bytes=0-99, 200-299", result: true},
+		{rangeHeader: "", miss: true},
+		{rangeHeader: "bytes=", miss: true},
+		{rangeHeader: "bytes=-", miss: true},
+		{rangeHeader: "bytes=500-100", miss: true},
+		{rangeHeader: "bytes=a-b", miss: true},
+		{rangeHeader: "bytes=0-99,", miss: true},
+		{rangeHeader: "items=0-9", miss: true},
+	}
+
+	for _, test := range tests {
+		stdr, _ := http.NewRequest(http.MethodGet, "/media/movie.mp4", nil)
+		if test.rangeHeader != "" {
+			stdr.Header.Set("Range", test.rangeHeader)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		ctx := NewContext(req)
+
+		assert.Equal(test.result, path.Match(ctx), test.rangeHeader)
+		assert.Equal(test.miss, ctx.HeaderMismatch, test.rangeHeader)
+		assert.False(ctx.Cacheable)
+	}
+}
+
+func TestPathSampleTee(t *testing.T) {
+	assert := assert.New(t)
+
+	count := func(p *Path, n int) int {
+		sampled := 0
+		for i := 0; i < n; i++ {
+			if p.SampleTee() {
+				sampled++
+			}
+		}
+		return sampled
+	}
+
+	path := &Path{Path: "/", TeeBackends: []string{"shadow"}}
+	path.Init(nil)
+	assert.Equal(100, count(path, 100))
+
+	path = &Path{Path: "/", TeeBackends: []string{"shadow"}, TeePercent: 25}
+	path.Init(nil)
+	assert.InDelta(2500, count(path, 10000), 1)
+
+	path = &Path{Path: "/", TeeBackends: []string{"shadow"}, TeePercent: 3}
+	path.Init(nil)
+	assert.InDelta(300, count(path, 10000), 1)
+
+	path = &Path{Path: "/", TeeBackends: []string{"shadow"}, TeePercent: 100}
+	path.Init(nil)
+	assert.Equal(100, count(path, 100))
+}
+
+func TestPathMatchCacheableAfterMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	withQuery := &Path{Path: "/experiment", Queries: []*Query{{Key: "variant", Values: []string{"b"}}}}
+	withQuery.Init(nil)
+	plain := &Path{Path: "/experiment"}
+	plain.Init(nil)
+
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/experiment", nil)
+	req, _ := httpprot.NewRequest(stdr)
+
+	ctx := NewContext(req)
+	assert.True(plain.Match(ctx))
+	assert.True(ctx.Cacheable)
+
+	ctx = NewContext(req)
+	assert.False(withQuery.Match(ctx))
+	assert.True(plain.Match(ctx))
+	assert.False(ctx.Cacheable)
+}
+
 func TestHeadersInit(t *testing.T) {
 	var headers Headers = []*Header{
 		{
@@ -498,6 +807,85 @@ func TestHeadersMatch(t *testing.T) {
 	}
 }
 
+func TestHeadersMatchNegate(t *testing.T) {
+	assert := assert.New(t)
+
+	var headers Headers = []*Header{
+		{
+			Key:    "X-Internal",
+			Values: []string{"true"},
+			Negate: true,
+		},
+	}
+	headers.init()
+
+	for _, matchAll := range []bool{true, false} {
+		assert.False(headers.Match(http.Header{"X-Internal": {"true"}}, matchAll))
+		assert.True(headers.Match(http.Header{"X-Internal": {"false"}}, matchAll))
+		// an absent header is a match.
+		assert.True(headers.Match(http.Header{}, matchAll))
+	}
+
+	headers = []*Header{
+		{
+			Key:    "X-Env",
+			Regexp: `^(dev|test)$`,
+			Negate: true,
+		},
+		{
+			Key:    "X-Test",
+			Values: []string{"test"},
+		},
+	}
+	headers.init()
+	assert.NotNil(headers[0].re)
+
+	assert.False(headers.Match(http.Header{"X-Env": {"dev"}}, false))
+	assert.True(headers.Match(http.Header{"X-Env": {"dev"}, "X-Test": {"test"}}, false))
+	assert.False(headers.Match(http.Header{"X-Env": {"dev"}, "X-Test": {"test"}}, true))
+	assert.True(headers.Match(http.Header{"X-Env": {"prod"}, "X-Test": {"test"}}, true))
+	assert.True(headers.Match(http.Header{"X-Test": {"test"}}, true))
+}
+
+func TestHeadersMatchPresent(t *testing.T) {
+	assert := assert.New(t)
+
+	present, absent := true, false
+
+	var headers Headers = []*Header{{Key: "Authorization", Present: &present}}
+	assert.NoError(headers.Validate())
+	headers.init()
+	for _, matchAll := range []bool{true, false} {
+		assert.True(headers.Match(http.Header{"Authorization": {"Bearer abc"}}, matchAll))
+		assert.False(headers.Match(http.Header{"Authorization": {""}}, matchAll))
+		assert.False(headers.Match(http.Header{}, matchAll))
+	}
+
+	headers = []*Header{{Key: "Authorization", Present: &absent}}
+	headers.init()
+	for _, matchAll := range []bool{true, false} {
+		assert.False(headers.Match(http.Header{"Authorization": {"Bearer abc"}}, matchAll))
+		assert.False(headers.Match(http.Header{"Authorization": {""}}, matchAll))
+		assert.True(headers.Match(http.Header{}, matchAll))
+	}
+
+	// composed with regexp, the presence is checked first.
+	headers = []*Header{
+		{Key: "Authorization", Present: &present, Regexp: "^Bearer "},
+		{Key: "X-Test", Values: []string{"test"}},
+	}
+	headers.init()
+	assert.True(headers.Match(http.Header{"Authorization": {"Bearer abc"}, "X-Test": {"test"}}, true))
+	assert.False(headers.Match(http.Header{"Authorization": {"Basic abc"}, "X-Test": {"test"}}, true))
+	assert.False(headers.Match(http.Header{"X-Test": {"test"}}, true))
+	assert.True(headers.Match(http.Header{"Authorization": {"Bearer abc"}}, false))
+	assert.False(headers.Match(http.Header{"Authorization": {"Basic abc"}}, false))
+	assert.True(headers.Match(http.Header{"X-Test": {"test"}}, false))
+
+	headers = []*Header{{Key: "Authorization"}}
+	assert.Error(headers.Validate())
+}
+
 func TestQueriesInit(t *testing.T) {
 	var queries Queries = []*Query{
 		{
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+// requestIDHeader is the header used to seed the selection of the
+// weighted backends.
+const requestIDHeader = "X-Request-Id"
+
+type (
+	// WeightedBackend is a backend receiving a share of the requests in
+	// proportion to its weight.
+	WeightedBackend struct {
+		Name   string `json:"name" jsonschema:"required"`
+		Weight int    `json:"weight" jsonschema:"required,minimum=0"`
+	}
+
+	// WeightedBackends are the backends sharing the requests of a path.
+	WeightedBackends []*WeightedBackend
+)
+
+// Validate validates WeightedBackends.
+func (wbs WeightedBackends) Validate() error {
+	if len(wbs) == 0 {
+		return nil
+	}
+	if wbs.totalWeight() == 0 {
+		return fmt.Errorf("the total weight of backends must be greater than 0")
+	}
+	return nil
+}
+
+func (wbs WeightedBackends) totalWeight() int {
+	total := 0
+	for _, wb := range wbs {
+		total += wb.Weight
+	}
+	return total
+}
+
+// Select selects a backend by weighted random, the random number is seeded
+// by the X-Request-Id header of the request if there is one, so that the
+// same request is always routed to the same backend. An empty string is
+// returned if there isn't any backend.
+func (wbs WeightedBackends) Select(req *httpprot.Request) string {
+	switch len(wbs) {
+	case 0:
+		return ""
+	case 1:
+		return wbs[0].Name
+	}
+
+	var n int
+	total := wbs.totalWeight()
+	if id := req.HTTPHeader().Get(requestIDHeader); id != "" {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		n = int(h.Sum64() % uint64(total))
+	} else {
+		n = rand.Intn(total)
+	}
+
+	for _, wb := range wbs {
+		if n < wb.Weight {
+			return wb.Name
+		}
+		n -= wb.Weight
+	}
+	// unreachable, as n is less than the total weight.
+	return wbs[len(wbs)-1].Name
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package routers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedBackendsSelect(t *testing.T) {
+	assert := assert.New(t)
+
+	newReq := func(id string) *httpprot.Request {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/", nil)
+		if id != "" {
+			stdr.Header.Set("X-Request-Id", id)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		return req
+	}
+
+	var wbs WeightedBackends
+	assert.Equal("", wbs.Select(newReq("")))
+
+	wbs = WeightedBackends{{Name: "v1", Weight: 1}}
+	assert.Equal("v1", wbs.Select(newReq("")))
+
+	wbs = WeightedBackends{{Name: "v1", Weight: 90}, {Name: "v2", Weight: 10}, {Name: "v3", Weight: 0}}
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[wbs.Select(newReq(""))]++
+	}
+	assert.InDelta(9000, counts["v1"], 300)
+	assert.InDelta(1000, counts["v2"], 300)
+	assert.Equal(0, counts["v3"])
+
+	// seeded by the request id
+	counts = map[string]int{}
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("request-%d", i)
+		b := wbs.Select(newReq(id))
+		assert.Equal(b, wbs.Select(newReq(id)))
+		counts[b]++
+	}
+	assert.InDelta(9000, counts["v1"], 300)
+	assert.InDelta(1000, counts["v2"], 300)
+}
+
+func TestWeightedBackendsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(WeightedBackends{}.Validate())
+	assert.NoError(WeightedBackends{{Name: "v1", Weight: 1}, {Name: "v2"}}.Validate())
+	assert.Error(WeightedBackends{{Name: "v1"}, {Name: "v2"}}.Validate())
+}
@@ -22,6 +22,7 @@ import (
 	stdcontext "context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
@@ -103,7 +104,8 @@ type (
 		Error string    `json:"error,omitempty"`
 
 		*httpstat.Status
-		TopN []*httpstat.Item `json:"topN"`
+		TopN       []*httpstat.Item  `json:"topN"`
+		RouteCache *RouteCacheStatus `json:"routeCache,omitempty"`
 	}
 )
 
@@ -138,12 +140,13 @@ func (r *runtime) Status() *Status {
 	health := r.getError().Error()
 
 	return &Status{
-		Name:   r.superSpec.Name(),
-		Health: health,
-		State:  r.getState(),
-		Error:  r.getError().Error(),
-		Status: r.httpStat.Status(),
-		TopN:   r.topN.Status(),
+		Name:       r.superSpec.Name(),
+		Health:     health,
+		State:      r.getState(),
+		Error:      r.getError().Error(),
+		Status:     r.httpStat.Status(),
+		TopN:       r.topN.Status(),
+		RouteCache: r.mux.RouteCacheStatus(),
 	}
 }
 
@@ -230,20 +233,24 @@ func (r *runtime) getError() error {
 	return err.(error)
 }
 
+// needRestartServer returns whether the HTTP server needs to be restarted
+// for the next spec. Only the options used by the server and its listener
+// are compared, the others are only used by the mux, which is reloaded
+// without interrupting the connections. An option used by the server must
+// be added here.
 func (r *runtime) needRestartServer(nextSpec *Spec) bool {
-	x := *r.spec
-	y := *nextSpec
-
-	// The change of options below need not restart the HTTP server.
-	x.MaxConnections, y.MaxConnections = 0, 0
-	x.CacheSize, y.CacheSize = 0, 0
-	x.XForwardedFor, y.XForwardedFor = false, false
-	x.Tracing, y.Tracing = nil, nil
-	x.IPFilterSpec, y.IPFilterSpec = nil, nil
-	x.Rules, y.Rules = nil, nil
-
-	// The update of rules need not to shutdown server.
-	return !reflect.DeepEqual(x, y)
+	serverOptions := func(spec *Spec) []interface{} {
+		return []interface{}{
+			spec.Port, spec.HTTP3, spec.HTTPS, spec.AutoCert,
+			spec.KeepAlive, spec.KeepAliveTimeout,
+			spec.CaCertBase64, spec.CertBase64, spec.KeyBase64,
+			spec.Certs, spec.Keys, spec.ClientCertSoftVerify,
+			spec.HandleOptionsAsterisk, spec.MaxConcurrentHandshakes,
+		}
+	}
+
+	// MaxConnections is updated to the listener directly.
+	return !reflect.DeepEqual(serverOptions(r.spec), serverOptions(nextSpec))
 }
 
 func (r *runtime) startServer() {
@@ -292,6 +299,15 @@ func (r *runtime) startHTTP3Server() {
 	}()
 }
 
+// connContextKey is the context key of the connection of a request.
+type connContextKey struct{}
+
+// connContext saves the connection to the context of its requests, so
+// that the mux could set the read deadline of the connection.
+func connContext(ctx stdcontext.Context, c net.Conn) stdcontext.Context {
+	return stdcontext.WithValue(ctx, connContextKey{}, c)
+}
+
 func (r *runtime) startHTTP1And2Server() {
 	keepAliveTimeout := defaultKeepAliveTimeout
 	if r.spec.KeepAliveTimeout != "" {
@@ -306,8 +322,12 @@ func (r *runtime) startHTTP1And2Server() {
 		Handler:     r.mux,
 		IdleTimeout: keepAliveTimeout,
 		ErrorLog:    log.New(fw, "", log.LstdFlags),
+		ConnContext: connContext,
 	}
 	r.server.SetKeepAlivesEnabled(r.spec.KeepAlive)
+	if r.spec.HandleOptionsAsterisk {
+		disableGeneralOptionsHandler(r.server)
+	}
 
 	listener, err := gnet.Listen("tcp", fmt.Sprintf(":%d", r.spec.Port))
 	if err != nil {
@@ -328,7 +348,11 @@ func (r *runtime) startHTTP1And2Server() {
 		if spec.HTTPS {
 			tlsConfig, _ := spec.tlsConfig()
 			srv.TLSConfig = tlsConfig
-			err = srv.ServeTLS(limitListener, "", "")
+			if spec.MaxConcurrentHandshakes > 0 {
+				err = srv.Serve(newHandshakeLimitListener(limitListener, tlsConfig, spec.MaxConcurrentHandshakes))
+			} else {
+				err = srv.ServeTLS(limitListener, "", "")
+			}
 		} else {
 			err = srv.Serve(limitListener)
 		}
@@ -395,6 +419,7 @@ func (r *runtime) handleEventReload(e *eventReload) {
 
 func (r *runtime) handleEventClose(e *eventClose) {
 	r.setState(stateClosed)
+	r.mux.drain()
 	r.closeServer()
 	r.mux.close()
 	close(e.done)
@@ -18,6 +18,8 @@
 package httpserver
 
 import (
+	"fmt"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -99,3 +101,54 @@ https: false
 
 	//
 }
+
+func TestNeedRestartServer(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	yamlConfig := fmt.Sprintf(`
+kind: HTTPServer
+name: test
+port: %d
+keepAlive: true
+https: false
+rules:
+- paths:
+  - path: /abc
+    backend: abc-pipeline
+`, port)
+	super := supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
+		nil, false, nil, nil)
+	superSpec, err := super.NewSpec(yamlConfig)
+	assert.NoError(err)
+	r := newRuntime(superSpec, &contexttest.MockedMuxMapper{})
+	defer r.Close()
+	r.reload(superSpec, &contexttest.MockedMuxMapper{})
+	assert.Equal(uint64(1), r.startNum)
+
+	// the options only used by the mux don't restart the server.
+	for _, extra := range []string{
+		"maintenance:\n  enabled: true\n",
+		"allowedMethods: [GET]\nrequestTimeout: 1s\nmaxConnections: 10\n",
+		"trustedCIDRs: [10.0.0.0/8]\nhandleCORSPreflight: true\ncacheSize: 10\n",
+	} {
+		superSpec, err = supervisor.NewSpec(yamlConfig + extra)
+		assert.NoError(err)
+		assert.False(r.needRestartServer(superSpec.ObjectSpec().(*Spec)), extra)
+		r.reload(superSpec, &contexttest.MockedMuxMapper{})
+		assert.Equal(uint64(1), r.startNum)
+	}
+
+	for _, extra := range []string{
+		"keepAliveTimeout: 10s\n",
+		"handleOptionsAsterisk: true\n",
+	} {
+		superSpec, err = supervisor.NewSpec(yamlConfig + extra)
+		assert.NoError(err)
+		assert.True(r.needRestartServer(superSpec.ObjectSpec().(*Spec)), extra)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/fasttime"
+)
+
+const timeOfDayLayout = "15:04"
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+type (
+	// ServiceHoursSpec describes the service hours of the server, requests
+	// outside the service hours are rejected, except for those to the
+	// ExceptPaths. The window is from Start to End (exclusive) in TimeZone,
+	// it spans midnight if End is earlier than Start, and it starts on one of
+	// Weekdays, all days if Weekdays is empty.
+	ServiceHoursSpec struct {
+		Start       string   `json:"start" jsonschema:"required,pattern=^([01][0-9]|2[0-3]):[0-5][0-9]$"`
+		End         string   `json:"end" jsonschema:"required,pattern=^([01][0-9]|2[0-3]):[0-5][0-9]$"`
+		Weekdays    []string `json:"weekdays,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		TimeZone    string   `json:"timeZone,omitempty" jsonschema:"omitempty"`
+		ExceptPaths []string `json:"exceptPaths,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		StatusCode  int      `json:"statusCode,omitempty" jsonschema:"omitempty,minimum=400,maximum=599"`
+	}
+
+	serviceHours struct {
+		spec       *ServiceHoursSpec
+		loc        *time.Location
+		start, end time.Duration
+		weekdays   [7]bool
+
+		// now returns the current time, it is replaced in unit tests.
+		now func() time.Time
+	}
+)
+
+// Validate validates ServiceHoursSpec.
+func (spec *ServiceHoursSpec) Validate() error {
+	if _, err := time.LoadLocation(spec.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone %s: %v", spec.TimeZone, err)
+	}
+	for _, d := range spec.Weekdays {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok {
+			return fmt.Errorf("invalid weekday %s", d)
+		}
+	}
+	if spec.Start == spec.End {
+		return fmt.Errorf("start and end of service hours can't be the same")
+	}
+	return nil
+}
+
+func newServiceHours(spec *ServiceHoursSpec) *serviceHours {
+	if spec == nil {
+		return nil
+	}
+
+	sh := &serviceHours{spec: spec, now: fasttime.Now}
+	sh.loc, _ = time.LoadLocation(spec.TimeZone)
+	sh.start = timeOfDay(spec.Start)
+	sh.end = timeOfDay(spec.End)
+
+	for _, d := range spec.Weekdays {
+		sh.weekdays[weekdays[strings.ToLower(d)]] = true
+	}
+	if len(spec.Weekdays) == 0 {
+		sh.weekdays = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	return sh
+}
+
+// timeOfDay converts s in the format of HH:MM to the duration since
+// midnight.
+func timeOfDay(s string) time.Duration {
+	t, _ := time.Parse(timeOfDayLayout, s)
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
+
+// midnight returns the midnight of the day which is days after t.
+func midnight(t time.Time, days int) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+days, 0, 0, 0, 0, t.Location())
+}
+
+// windowStart returns the start of the window beginning on the day which
+// is days after t.
+func (sh *serviceHours) windowStart(t time.Time, days int) time.Time {
+	m := midnight(t, days)
+	return m.Add(sh.start)
+}
+
+// opened returns if the window beginning on the day which is days after t
+// contains t.
+func (sh *serviceHours) opened(t time.Time, days int) bool {
+	start := sh.windowStart(t, days)
+	if !sh.weekdays[start.Weekday()] || t.Before(start) {
+		return false
+	}
+
+	end := midnight(t, days).Add(sh.end)
+	if sh.end < sh.start {
+		end = midnight(t, days+1).Add(sh.end)
+	}
+	return t.Before(end)
+}
+
+// allow returns if the request to path is allowed, and the duration to the
+// start of the next window if it is not. Requests are always allowed if sh
+// is nil.
+func (sh *serviceHours) allow(path string) (bool, time.Duration) {
+	if sh == nil {
+		return true, 0
+	}
+
+	for _, p := range sh.spec.ExceptPaths {
+		if strings.HasPrefix(path, p) {
+			return true, 0
+		}
+	}
+
+	now := sh.now().In(sh.loc)
+
+	// the window beginning yesterday could span midnight.
+	if sh.opened(now, 0) || sh.opened(now, -1) {
+		return true, 0
+	}
+
+	for days := 0; days <= 7; days++ {
+		start := sh.windowStart(now, days)
+		if start.After(now) && sh.weekdays[start.Weekday()] {
+			return false, start.Sub(now)
+		}
+	}
+
+	// never reached, as there is at least one weekday.
+	return false, 0
+}
+
+// statusCode returns the status code for the requests outside the service
+// hours.
+func (sh *serviceHours) statusCode() int {
+	if sh.spec.StatusCode != 0 {
+		return sh.spec.StatusCode
+	}
+	return http.StatusServiceUnavailable
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceHoursAllow(t *testing.T) {
+	assert := assert.New(t)
+
+	var sh *serviceHours
+	ok, _ := sh.allow("/")
+	assert.True(ok)
+
+	spec := &ServiceHoursSpec{
+		Start:       "09:00",
+		End:         "17:30",
+		Weekdays:    []string{"Monday", "tuesday", "Wednesday", "Thursday", "Friday"},
+		TimeZone:    "Asia/Shanghai",
+		ExceptPaths: []string{"/healthz"},
+	}
+	assert.NoError(spec.Validate())
+	sh = newServiceHours(spec)
+	assert.Equal(http.StatusServiceUnavailable, sh.statusCode())
+
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	cases := []struct {
+		now        time.Time
+		ok         bool
+		retryAfter time.Duration
+	}{
+		// Monday
+		{time.Date(2022, 1, 3, 8, 0, 0, 0, loc), false, time.Hour},
+		{time.Date(2022, 1, 3, 9, 0, 0, 0, loc), true, 0},
+		{time.Date(2022, 1, 3, 17, 29, 0, 0, loc), true, 0},
+		{time.Date(2022, 1, 3, 17, 30, 0, 0, loc), false, 15*time.Hour + 30*time.Minute},
+		// the same time in UTC
+		{time.Date(2022, 1, 3, 1, 0, 0, 0, time.UTC), true, 0},
+		// Friday evening to Monday
+		{time.Date(2022, 1, 7, 18, 0, 0, 0, loc), false, 63 * time.Hour},
+		// Saturday
+		{time.Date(2022, 1, 8, 10, 0, 0, 0, loc), false, 47 * time.Hour},
+	}
+	for i, c := range cases {
+		sh.now = func() time.Time { return c.now }
+		ok, retryAfter := sh.allow("/api")
+		assert.Equal(c.ok, ok, "case %d", i)
+		assert.Equal(c.retryAfter, retryAfter, "case %d", i)
+
+		ok, _ = sh.allow("/healthz")
+		assert.True(ok)
+	}
+
+	// the window spans midnight
+	spec = &ServiceHoursSpec{Start: "22:00", End: "02:00", Weekdays: []string{"friday"}, StatusCode: 403}
+	assert.NoError(spec.Validate())
+	sh = newServiceHours(spec)
+	assert.Equal(http.StatusForbidden, sh.statusCode())
+
+	cases = []struct {
+		now        time.Time
+		ok         bool
+		retryAfter time.Duration
+	}{
+		{time.Date(2022, 1, 7, 21, 0, 0, 0, time.UTC), false, time.Hour},
+		{time.Date(2022, 1, 7, 23, 0, 0, 0, time.UTC), true, 0},
+		{time.Date(2022, 1, 8, 1, 0, 0, 0, time.UTC), true, 0},
+		{time.Date(2022, 1, 8, 2, 0, 0, 0, time.UTC), false, 6*24*time.Hour + 20*time.Hour},
+		// Thursday, the window of Thursday is not opened.
+		{time.Date(2022, 1, 6, 23, 0, 0, 0, time.UTC), false, 23 * time.Hour},
+	}
+	for i, c := range cases {
+		sh.now = func() time.Time { return c.now }
+		ok, retryAfter := sh.allow("/api")
+		assert.Equal(c.ok, ok, "case %d", i)
+		assert.Equal(c.retryAfter, retryAfter, "case %d", i)
+	}
+
+	assert.Error((&ServiceHoursSpec{Start: "09:00", End: "17:00", TimeZone: "Mars/Olympus"}).Validate())
+	assert.Error((&ServiceHoursSpec{Start: "09:00", End: "17:00", Weekdays: []string{"someday"}}).Validate())
+	assert.Error((&ServiceHoursSpec{Start: "09:00", End: "09:00"}).Validate())
+}
+
+func TestServiceHours(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+serviceHours:
+  start: "09:00"
+  end: "17:00"
+  exceptPaths: [/healthz]
+rules:
+- paths:
+  - path: /api
+    backend: api-pipeline
+  - path: /healthz
+    backend: health-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, nil)
+
+	now := time.Date(2022, 1, 3, 10, 0, 0, 0, time.UTC)
+	m.inst.Load().(*muxInstance).serviceHours.now = func() time.Time { return now }
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	// inside the service hours
+	assert.Equal(http.StatusOK, serve("/api").Code)
+	assert.Equal(http.StatusOK, serve("/healthz").Code)
+
+	// outside the service hours
+	now = time.Date(2022, 1, 3, 8, 59, 30, 0, time.UTC)
+	stdw := serve("/api")
+	assert.Equal(http.StatusServiceUnavailable, stdw.Code)
+	assert.Equal("30", stdw.Header().Get("Retry-After"))
+	assert.Equal(http.StatusOK, serve("/healthz").Code)
+}
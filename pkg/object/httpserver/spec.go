@@ -29,6 +29,9 @@ import (
 	"github.com/megaease/easegress/pkg/util/ipfilter"
 )
 
+// pathMatchModeLongest selects the most specific path of a rule.
+const pathMatchModeLongest = "longest"
+
 type (
 	// Spec describes the HTTPServer.
 	Spec struct {
@@ -57,17 +60,269 @@ type (
 
 		RouterKind string `json:"routerKind,omitempty" jsonschema:"omitempty,enum=,enum=Ordered,enum=RadixTree"`
 
-		IPFilterSpec *ipfilter.Spec `json:"ipFilter,omitempty" jsonschema:"omitempty"`
-		Rules        routers.Rules  `json:"rules" jsonschema:"omitempty"`
+		IPFilterSpec    *ipfilter.Spec       `json:"ipFilter,omitempty" jsonschema:"omitempty"`
+		UserAgentFilter *UserAgentFilterSpec `json:"userAgentFilter,omitempty" jsonschema:"omitempty"`
+		Rules           routers.Rules        `json:"rules" jsonschema:"omitempty"`
 
 		GlobalFilter string `json:"globalFilter,omitempty" jsonschema:"omitempty"`
 
 		AccessLogFormat string `json:"accessLogFormat" jsonshema:"omitempty"`
+
+		// AutoHead makes paths accepting GET also accept HEAD.
+		AutoHead bool `json:"autoHead,omitempty" jsonschema:"omitempty"`
+
+		Maintenance *MaintenanceSpec `json:"maintenance,omitempty" jsonschema:"omitempty"`
+
+		// StripResponseHeaders are removed from all responses, e.g. the
+		// Server and X-Powered-By headers set by backends.
+		StripResponseHeaders []string `json:"stripResponseHeaders,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+
+		// RequestBodyReadTimeout is the max duration for reading the
+		// request body, slow clients are replied with 408.
+		RequestBodyReadTimeout string `json:"requestBodyReadTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+
+		// MaxPathDepth is the max count of path segments, requests with
+		// deeper paths are replied with 400.
+		MaxPathDepth uint16 `json:"maxPathDepth,omitempty" jsonschema:"omitempty"`
+
+		ErrorResponses []*ErrorResponse `json:"errorResponses,omitempty" jsonschema:"omitempty"`
+
+		// MatchEscapedPath makes routing use the escaped path, so that an
+		// encoded slash like "/a%2Fb" is a single path segment.
+		MatchEscapedPath bool `json:"matchEscapedPath,omitempty" jsonschema:"omitempty"`
+
+		// DefaultErrorBody makes the server reply the status text as the
+		// body of error responses without a body.
+		DefaultErrorBody bool `json:"defaultErrorBody,omitempty" jsonschema:"omitempty"`
+
+		// RequestTimeout is the max duration for handling a request, 504
+		// is replied if it is exceeded, unless TimeoutResponse is set.
+		RequestTimeout  string                   `json:"requestTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		TimeoutResponse *routers.TimeoutResponse `json:"timeoutResponse,omitempty" jsonschema:"omitempty"`
+
+		// IPFilterPolicies are the named IP filters which could be shared
+		// by paths via their ipFilterRef.
+		IPFilterPolicies map[string]*ipfilter.Spec `json:"ipFilterPolicies,omitempty" jsonschema:"omitempty"`
+
+		// RewriteHost rewrites the host of all requests forwarded to the
+		// backends, unless the path has its own RewriteHost.
+		RewriteHost *routers.RewriteHost `json:"rewriteHost,omitempty" jsonschema:"omitempty"`
+
+		// ServiceHours rejects requests outside the service hours, before
+		// routing them.
+		ServiceHours *ServiceHoursSpec `json:"serviceHours,omitempty" jsonschema:"omitempty"`
+
+		// DebugEcho replies the request headers and the real IP to requests
+		// with the X-Eg-Debug-Echo header instead of routing them.
+		DebugEcho bool `json:"debugEcho,omitempty" jsonschema:"omitempty"`
+
+		// MaxConcurrentRequests is the max count of in-flight requests, the
+		// exceeding ones are replied with 503, 0 means no limit.
+		MaxConcurrentRequests uint32 `json:"maxConcurrentRequests,omitempty" jsonschema:"omitempty"`
+
+		// Tarpit holds the requests from blocked IPs for a while before
+		// replying them with 403.
+		Tarpit *TarpitSpec `json:"tarpit,omitempty" jsonschema:"omitempty"`
+
+		// DefaultHost is used as the host of requests without one, which
+		// are rejected with 400 if RejectEmptyHost is true.
+		DefaultHost     string `json:"defaultHost,omitempty" jsonschema:"omitempty"`
+		RejectEmptyHost bool   `json:"rejectEmptyHost,omitempty" jsonschema:"omitempty"`
+
+		// IPBlockEvents fires an event when an IP is blocked for the first
+		// time within a window.
+		IPBlockEvents *IPBlockEventsSpec `json:"ipBlockEvents,omitempty" jsonschema:"omitempty"`
+
+		// HighPriorityReserve is the count of the slots of
+		// MaxConcurrentRequests reserved for paths with positive priority.
+		HighPriorityReserve uint32 `json:"highPriorityReserve,omitempty" jsonschema:"omitempty"`
+
+		// CaseInsensitiveHost makes the host matching of the rules case
+		// insensitive, the host regexps are matched to the lowercased host.
+		CaseInsensitiveHost bool `json:"caseInsensitiveHost,omitempty" jsonschema:"omitempty"`
+
+		// WellKnownFiles are served directly, like favicon.ico and
+		// robots.txt, which are frequently requested by bots.
+		WellKnownFiles *WellKnownFilesSpec `json:"wellKnownFiles,omitempty" jsonschema:"omitempty"`
+
+		// MaxQueryParams is the max count of the query params, requests
+		// with more params are replied with 400 without routing.
+		MaxQueryParams uint32 `json:"maxQueryParams,omitempty" jsonschema:"omitempty"`
+
+		// HandleOptionsAsterisk replies "OPTIONS *" requests with 204 and
+		// the Allow header aggregated from the methods of all paths.
+		HandleOptionsAsterisk bool `json:"handleOptionsAsterisk,omitempty" jsonschema:"omitempty"`
+
+		// ClientCertSoftVerify requests but doesn't require client certs,
+		// they are verified by caCertBase64 for matching clientCertStatus.
+		ClientCertSoftVerify bool `json:"clientCertSoftVerify,omitempty" jsonschema:"omitempty"`
+
+		// AllowedMethods are the methods allowed by the server, requests
+		// with other methods are replied with 405 without routing.
+		AllowedMethods []string `json:"allowedMethods,omitempty" jsonschema:"omitempty,uniqueItems=true,format=httpmethod-array"`
+
+		// SlowRequestThreshold is the duration over which requests are
+		// logged as slow requests, empty means no logging.
+		SlowRequestThreshold string `json:"slowRequestThreshold,omitempty" jsonschema:"omitempty,format=duration"`
+
+		// RequestReceivedAt injects the X-Request-Received-At header, the
+		// epoch milliseconds the request is received, into the requests to
+		// backends, the header set by an upstream proxy is kept.
+		RequestReceivedAt bool `json:"requestReceivedAt,omitempty" jsonschema:"omitempty"`
+
+		// MaxRules and MaxPathsPerRule cap the count of the rules and the
+		// paths of a rule, 0 means no limit.
+		MaxRules        int `json:"maxRules,omitempty" jsonschema:"omitempty,minimum=0"`
+		MaxPathsPerRule int `json:"maxPathsPerRule,omitempty" jsonschema:"omitempty,minimum=0"`
+
+		// RouteConnect routes CONNECT requests to the paths declaring CONNECT
+		// in their methods, CONNECT requests are replied with 405 otherwise.
+		RouteConnect bool `json:"routeConnect,omitempty" jsonschema:"omitempty"`
+
+		// DefaultCacheControl is the Cache-Control header of the responses
+		// from backends without one, like "public, max-age=60".
+		DefaultCacheControl string `json:"defaultCacheControl,omitempty" jsonschema:"omitempty"`
+
+		// StripTrailingSlash trims a single trailing slash from the path of
+		// the requests before routing, except for the root path "/".
+		StripTrailingSlash bool `json:"stripTrailingSlash,omitempty" jsonschema:"omitempty"`
+
+		// AbortOnResponseBodyError aborts the connection if reading the
+		// response body fails after the header is sent, so that clients
+		// don't take the truncated body as a complete one.
+		AbortOnResponseBodyError bool `json:"abortOnResponseBodyError,omitempty" jsonschema:"omitempty"`
+
+		// StripHostTrailingDot strips a single trailing dot of the host
+		// before matching and cache keying, so example.com. is example.com.
+		StripHostTrailingDot bool `json:"stripHostTrailingDot" jsonschema:"omitempty"`
+
+		// ExposeBackendHeader is the response header to carry the name of
+		// the backend serving the request, it is only set for requests
+		// with ExposeBackendDebugHeader if the debug header isn't empty.
+		ExposeBackendHeader      string `json:"exposeBackendHeader,omitempty" jsonschema:"omitempty"`
+		ExposeBackendDebugHeader string `json:"exposeBackendDebugHeader,omitempty" jsonschema:"omitempty"`
+
+		// CacheTTL is the max duration a route stays in the route cache,
+		// so that flapping routes don't serve stale 404s, 0 means forever.
+		CacheTTL string `json:"cacheTTL,omitempty" jsonschema:"omitempty,format=duration"`
+
+		// XForwardedHeaders sets the X-Forwarded-Proto and X-Forwarded-Host
+		// headers, so that the backends know the original scheme and host.
+		XForwardedHeaders *XForwardedHeadersSpec `json:"xForwardedHeaders,omitempty" jsonschema:"omitempty"`
+
+		// TrustedCIDRs are the proxies in front of the server, the real IP
+		// of the requests from them is resolved from X-Forwarded-For by
+		// skipping the trusted hops right-to-left, so it can't be spoofed.
+		TrustedCIDRs []string `json:"trustedCIDRs,omitempty" jsonschema:"omitempty,uniqueItems=true,format=ipcidr-array"`
+
+		// ResponseSpoolThreshold is the max size in bytes of a stream
+		// response body buffered in memory, larger bodies are spooled to a
+		// temporary file before sent to the client, 0 means no spooling.
+		// Spooling releases the backends early, at the cost of streaming:
+		// no header is sent before the whole body is read, which delays
+		// the first byte of every response, and uses disk for large ones.
+		// Streaming responses, like Server-Sent Events, are never spooled.
+		ResponseSpoolThreshold int64 `json:"responseSpoolThreshold,omitempty" jsonschema:"omitempty,minimum=0"`
+
+		// DrainingHeader adds the X-Eg-Draining header to the responses sent
+		// while the server is draining, besides the Connection: close.
+		DrainingHeader bool `json:"drainingHeader,omitempty" jsonschema:"omitempty"`
+
+		// HandleCORSPreflight replies the CORS preflight requests to the
+		// paths not accepting OPTIONS with 204 and the Access-Control-Allow-*
+		// headers, instead of 405. Empty CORSAllowedOrigins allows all.
+		HandleCORSPreflight bool     `json:"handleCORSPreflight,omitempty" jsonschema:"omitempty"`
+		CORSAllowedOrigins  []string `json:"corsAllowedOrigins,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		CORSAllowedHeaders  []string `json:"corsAllowedHeaders,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		CORSMaxAge          uint32   `json:"corsMaxAge,omitempty" jsonschema:"omitempty"`
+
+		// NoCacheMethods are the methods whose routes are never cached, the
+		// requests with them are always routed.
+		NoCacheMethods []string `json:"noCacheMethods,omitempty" jsonschema:"omitempty,uniqueItems=true,format=httpmethod-array"`
+
+		// MaxBodySize is the hard limit of the request body size, requests
+		// with larger bodies are replied with 413 even if the body is
+		// streamed, 0 means unlimited.
+		MaxBodySize int64 `json:"maxBodySize,omitempty" jsonschema:"omitempty,minimum=0"`
+
+		// CachePositiveOnly caches only the matched routes, the not found
+		// and method not allowed results are never cached.
+		CachePositiveOnly bool `json:"cachePositiveOnly,omitempty" jsonschema:"omitempty"`
+
+		// StrictPathRegexp rejects the path regexps which are unanchored
+		// and begin with ".*", they are only warned about by default.
+		StrictPathRegexp bool `json:"strictPathRegexp,omitempty" jsonschema:"omitempty"`
+
+		// PathMatchMode is how the path of a rule is selected by the Ordered
+		// router, "first" selects the first matched path in the declaration
+		// order, and "longest" selects the most specific one, that's an
+		// exact path over the longest prefix over a regexp.
+		PathMatchMode string `json:"pathMatchMode,omitempty" jsonschema:"omitempty,enum=,enum=first,enum=longest"`
+
+		// MaxConcurrentHandshakes is the max count of concurrent TLS
+		// handshakes, the handshakes exceeding it are rejected, 0 means
+		// no limit. It doesn't apply to HTTP3.
+		MaxConcurrentHandshakes uint32 `json:"maxConcurrentHandshakes,omitempty" jsonschema:"omitempty"`
 	}
 )
 
 // Validate validates HTTPServerSpec.
 func (spec *Spec) Validate() error {
+	if spec.MaxRules > 0 && len(spec.Rules) > spec.MaxRules {
+		return fmt.Errorf("%d rules exceed maxRules %d", len(spec.Rules), spec.MaxRules)
+	}
+	if spec.MaxPathsPerRule > 0 {
+		for i, rule := range spec.Rules {
+			if len(rule.Paths) > spec.MaxPathsPerRule {
+				return fmt.Errorf("%d paths of rule %d (host %q) exceed maxPathsPerRule %d",
+					len(rule.Paths), i, rule.Host, spec.MaxPathsPerRule)
+			}
+		}
+	}
+
+	if spec.StrictPathRegexp {
+		for _, rule := range spec.Rules {
+			for _, path := range rule.Paths {
+				if path.IsCatchAllRegexp() {
+					return fmt.Errorf("pathRegexp %s matches any path, anchor it or remove the leading .*", path.PathRegexp)
+				}
+			}
+		}
+	}
+
+	for _, rule := range spec.Rules {
+		for _, path := range rule.Paths {
+			if path.IPFilterRef == "" {
+				continue
+			}
+			if _, ok := spec.IPFilterPolicies[path.IPFilterRef]; !ok {
+				return fmt.Errorf("ip filter policy %s not found", path.IPFilterRef)
+			}
+		}
+	}
+
+	if spec.RouterKind == "RadixTree" && spec.PathMatchMode == pathMatchModeLongest {
+		return fmt.Errorf("pathMatchMode longest is not supported by the RadixTree router")
+	}
+
+	if spec.RouterKind == "RadixTree" {
+		for _, rule := range spec.Rules {
+			for _, path := range rule.Paths {
+				if path.CaseInsensitive {
+					return fmt.Errorf("caseInsensitive of paths is not supported by the RadixTree router")
+				}
+			}
+		}
+	}
+
+	if spec.HighPriorityReserve > 0 && spec.HighPriorityReserve >= spec.MaxConcurrentRequests {
+		return fmt.Errorf("highPriorityReserve must be less than maxConcurrentRequests")
+	}
+
+	if spec.ClientCertSoftVerify && (!spec.HTTPS || spec.CaCertBase64 == "") {
+		return fmt.Errorf("clientCertSoftVerify requires https and caCertBase64")
+	}
+
 	if !spec.HTTPS {
 		if spec.HTTP3 {
 			return fmt.Errorf("https is disabled when http3 enabled")
@@ -142,13 +397,25 @@ func (spec *Spec) tlsConfig() (*tls.Config, error) {
 	// if caCertBase64 configuration is provided, should enable tls.ClientAuth and
 	// add the root cert
 	if len(spec.CaCertBase64) != 0 {
-		rootCertPem, _ := base64.StdEncoding.DecodeString(spec.CaCertBase64)
-		certPool := x509.NewCertPool()
-		certPool.AppendCertsFromPEM(rootCertPem)
-
 		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
-		tlsConf.ClientCAs = certPool
+		tlsConf.ClientCAs = spec.clientCAs()
+	}
+
+	// the client certs are verified when matching the paths.
+	if spec.ClientCertSoftVerify {
+		tlsConf.ClientAuth = tls.RequestClientCert
 	}
 
 	return tlsConf, nil
 }
+
+// clientCAs returns the pool of caCertBase64, nil if it is empty.
+func (spec *Spec) clientCAs() *x509.CertPool {
+	if len(spec.CaCertBase64) == 0 {
+		return nil
+	}
+	rootCertPem, _ := base64.StdEncoding.DecodeString(spec.CaCertBase64)
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(rootCertPem)
+	return certPool
+}
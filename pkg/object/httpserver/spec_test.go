@@ -24,6 +24,7 @@ import (
 	"testing"
 
 	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/httpserver/routers"
 	"github.com/megaease/easegress/pkg/supervisor"
 
 	"github.com/stretchr/testify/assert"
@@ -75,6 +76,90 @@ rules:
 	superSpec, err = supervisor.NewSpec(yamlConfig)
 	assert.True(strings.Contains(err.Error(), "keepAliveTimeout: invalid duration"))
 	assert.Nil(superSpec)
+
+	yamlConfig = `
+name: http-server-test
+kind: HTTPServer
+port: 10080
+rules:
+  - hostWildcard: "*.example.com"
+    paths:
+    - pathPrefix: /api`
+	superSpec, err = supervisor.NewSpec(yamlConfig)
+	assert.Nil(err)
+	assert.NotNil(superSpec)
+
+	yamlConfig = `
+name: http-server-test
+kind: HTTPServer
+port: 10080
+rules:
+  - hostWildcard: "a*.example.com"
+    paths:
+    - pathPrefix: /api`
+	superSpec, err = supervisor.NewSpec(yamlConfig)
+	assert.True(strings.Contains(err.Error(), "hostWildcard"))
+	assert.Nil(superSpec)
+}
+
+func TestValidateMaxRulesAndPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	newSpec := func(rules, paths int) *Spec {
+		spec := &Spec{MaxRules: 2, MaxPathsPerRule: 3}
+		for i := 0; i < rules; i++ {
+			rule := &routers.Rule{Host: fmt.Sprintf("host%d.megaease.com", i)}
+			for j := 0; j < paths; j++ {
+				rule.Paths = append(rule.Paths, &routers.Path{Path: fmt.Sprintf("/p%d", j)})
+			}
+			spec.Rules = append(spec.Rules, rule)
+		}
+		return spec
+	}
+
+	assert.NoError(newSpec(1, 2).Validate())
+	assert.NoError(newSpec(2, 3).Validate())
+
+	err := newSpec(3, 1).Validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), "3 rules exceed maxRules 2")
+
+	err = newSpec(2, 4).Validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), `4 paths of rule 0 (host "host0.megaease.com") exceed maxPathsPerRule 3`)
+
+	// no limits
+	spec := newSpec(3, 4)
+	spec.MaxRules, spec.MaxPathsPerRule = 0, 0
+	assert.NoError(spec.Validate())
+}
+
+func TestValidateStrictPathRegexp(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{Rules: routers.Rules{
+		{Paths: []*routers.Path{{Path: "/api"}, {PathRegexp: ".*"}}},
+	}}
+	assert.NoError(spec.Validate())
+
+	spec.StrictPathRegexp = true
+	err := spec.Validate()
+	assert.Error(err)
+	assert.Contains(err.Error(), "pathRegexp .* matches any path")
+
+	// anchored regexps are fine.
+	spec.Rules[0].Paths[1].PathRegexp = "^/api/.*"
+	assert.NoError(spec.Validate())
+}
+
+func TestValidatePathMatchMode(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{PathMatchMode: "longest"}
+	assert.NoError(spec.Validate())
+
+	spec.RouterKind = "RadixTree"
+	assert.Error(spec.Validate())
 }
 
 func TestTlsConfig(t *testing.T) {
@@ -186,6 +271,14 @@ rules: []`, validSpec: true, mTLSExpected: true,
 
 			if testcase.mTLSExpected {
 				assert.Equal(tlsConf.ClientAuth, tls.RequireAndVerifyClientCert)
+
+				// request but not require client certs
+				spec.ClientCertSoftVerify = true
+				assert.Nil(spec.Validate())
+				tlsConf, err = spec.tlsConfig()
+				assert.Nil(err)
+				assert.Equal(tlsConf.ClientAuth, tls.RequestClientCert)
+				assert.NotNil(spec.clientCAs())
 			}
 		})
 	}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const spoolFilePattern = "easegress-spool-*"
+
+// streamingMediaTypes are the media types of the responses whose data is
+// produced over time, they are never spooled, so that the data reaches
+// the client as soon as it is produced.
+var streamingMediaTypes = []string{
+	eventStreamMediaType,
+	"application/x-ndjson",
+	"application/stream+json",
+	"application/grpc",
+	"multipart/x-mixed-replace",
+}
+
+// spoolBody reads body to the end, the body is kept in memory if it is
+// not larger than threshold, or spooled to a temporary file otherwise.
+// The returned function must be called to remove the file when the
+// returned reader is no longer used.
+func spoolBody(body io.Reader, threshold int64) (io.Reader, func(), error) {
+	nop := func() {}
+
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, body, threshold+1)
+	if err == io.EOF || (err == nil && n <= threshold) {
+		return buf, nop, nil
+	}
+	if err != nil {
+		return nil, nop, err
+	}
+
+	f, err := os.CreateTemp("", spoolFilePattern)
+	if err != nil {
+		return nil, nop, err
+	}
+	cleanup := func() {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			logger.Errorf("remove spool file %s failed: %v", f.Name(), err)
+		}
+	}
+
+	if _, err = buf.WriteTo(f); err == nil {
+		_, err = io.Copy(f, body)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nop, err
+	}
+
+	return f, cleanup, nil
+}
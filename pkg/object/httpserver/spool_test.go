@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func spoolFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, spoolFilePattern))
+	assert.NoError(t, err)
+	return files
+}
+
+func TestSpoolBody(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	// small bodies are kept in memory.
+	r, cleanup, err := spoolBody(strings.NewReader("hello"), 5)
+	assert.NoError(err)
+	assert.IsType(&bytes.Buffer{}, r)
+	assert.Empty(spoolFiles(t, dir))
+	data, _ := io.ReadAll(r)
+	assert.Equal("hello", string(data))
+	cleanup()
+
+	// large bodies are spooled to a file.
+	body := strings.Repeat("abcdefgh", 1024)
+	r, cleanup, err = spoolBody(strings.NewReader(body), 100)
+	assert.NoError(err)
+	assert.IsType(&os.File{}, r)
+	assert.Len(spoolFiles(t, dir), 1)
+	data, _ = io.ReadAll(r)
+	assert.Equal(body, string(data))
+	cleanup()
+	assert.Empty(spoolFiles(t, dir))
+
+	// the file is removed on errors.
+	_, cleanup, err = spoolBody(io.MultiReader(
+		strings.NewReader(body),
+		iotest.ErrReader(fmt.Errorf("connection reset by backend")),
+	), 100)
+	assert.Error(err)
+	cleanup()
+	assert.Empty(spoolFiles(t, dir))
+
+	_, _, err = spoolBody(iotest.ErrReader(fmt.Errorf("connection reset by backend")), 100)
+	assert.Error(err)
+}
+
+func TestResponseSpoolThreshold(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	body := strings.Repeat("abcdefgh", 16*1024)
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		var payload io.Reader = strings.NewReader(body)
+		if name != "test-pipeline" {
+			payload = io.MultiReader(payload, iotest.ErrReader(fmt.Errorf("connection reset by backend")))
+		}
+		if name == "stream-pipeline" {
+			resp.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		resp.SetPayload(payload)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+responseSpoolThreshold: 1024
+rules:
+- paths:
+  - path: /broken
+    backend: broken-pipeline
+  - path: /stream
+    backend: stream-pipeline
+  - pathPrefix: /
+    backend: test-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	stdw := serve("/file")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal(body, stdw.Body.String())
+	assert.Empty(spoolFiles(t, dir))
+
+	// the failure of the backend is replied with 502, as the header is
+	// not sent yet.
+	stdw = serve("/broken")
+	assert.Equal(http.StatusBadGateway, stdw.Code)
+	assert.Empty(spoolFiles(t, dir))
+
+	// streaming responses are not spooled, so the header is sent before
+	// the failure.
+	stdw = serve("/stream")
+	assert.Equal(http.StatusOK, stdw.Code)
+	assert.Equal(body, stdw.Body.String())
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	stdcontext "context"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTarpitMaxConcurrent = 100
+
+type (
+	// TarpitSpec describes the tarpit for the requests from blocked IPs,
+	// which are held for Delay before being replied with 403, to tie up the
+	// resources of abusive clients. At most MaxConcurrent requests are held
+	// at the same time, the others are replied immediately.
+	TarpitSpec struct {
+		Delay         string `json:"delay" jsonschema:"required,format=duration"`
+		MaxConcurrent uint32 `json:"maxConcurrent,omitempty" jsonschema:"omitempty"`
+	}
+
+	tarpit struct {
+		// holding is the count of the requests being held, it is the first
+		// field to guarantee the 64-bit alignment required by atomic.
+		holding int64
+
+		delay         time.Duration
+		maxConcurrent int64
+
+		// sleep waits for d or until ctx is done, it is replaced in
+		// unit tests.
+		sleep func(ctx stdcontext.Context, d time.Duration)
+	}
+)
+
+func newTarpit(spec *TarpitSpec) *tarpit {
+	if spec == nil {
+		return nil
+	}
+
+	tp := &tarpit{
+		maxConcurrent: int64(spec.MaxConcurrent),
+		sleep:         sleepWithContext,
+	}
+	tp.delay, _ = time.ParseDuration(spec.Delay)
+	if tp.maxConcurrent == 0 {
+		tp.maxConcurrent = defaultTarpitMaxConcurrent
+	}
+	return tp
+}
+
+func sleepWithContext(ctx stdcontext.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+	case <-timer.C:
+	}
+}
+
+// hold holds the request for the delay unless ctx is done earlier, it
+// returns immediately if tp is nil or there are already too many requests
+// being held.
+func (tp *tarpit) hold(ctx stdcontext.Context) {
+	if tp == nil || tp.delay <= 0 {
+		return
+	}
+
+	defer atomic.AddInt64(&tp.holding, -1)
+	if atomic.AddInt64(&tp.holding, 1) > tp.maxConcurrent {
+		return
+	}
+
+	tp.sleep(ctx, tp.delay)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	stdcontext "context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarpitHold(t *testing.T) {
+	assert := assert.New(t)
+
+	var tp *tarpit
+	tp.hold(stdcontext.Background())
+
+	tp = newTarpit(&TarpitSpec{Delay: "10s", MaxConcurrent: 1})
+	slept := make(chan time.Duration, 2)
+	release := make(chan struct{})
+	tp.sleep = func(ctx stdcontext.Context, d time.Duration) {
+		slept <- d
+		<-release
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tp.hold(stdcontext.Background())
+		close(done)
+	}()
+	assert.Equal(10*time.Second, <-slept)
+
+	// the cap is reached, the request is not held.
+	tp.hold(stdcontext.Background())
+	assert.Empty(slept)
+
+	close(release)
+	<-done
+	assert.Equal(int64(0), tp.holding)
+
+	// context cancellation aborts the delay.
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	cancel()
+	start := time.Now()
+	sleepWithContext(ctx, time.Hour)
+	assert.Less(time.Since(start), time.Second)
+
+	start = time.Now()
+	sleepWithContext(stdcontext.Background(), 10*time.Millisecond)
+	assert.GreaterOrEqual(time.Since(start), 10*time.Millisecond)
+}
+
+func TestTarpit(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+ipFilter:
+  blockIPs: [192.168.1.1]
+tarpit:
+  delay: 5s
+rules:
+- paths:
+  - pathPrefix: /
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, nil)
+
+	var slept time.Duration
+	m.inst.Load().(*muxInstance).tarpit.sleep = func(ctx stdcontext.Context, d time.Duration) {
+		slept = d
+	}
+
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+	stdr.Header.Set("X-Real-Ip", "192.168.1.1")
+	stdw := httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal(http.StatusForbidden, stdw.Code)
+	assert.Equal(5*time.Second, slept)
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/tracing"
+)
+
+// teeBufferChunks is the max number of chunks buffered for a tee backend,
+// reading of the primary backend is blocked if the buffer is full.
+const teeBufferChunks = 64
+
+// errTeeAborted fails the tee bodies if the primary request is rejected.
+var errTeeAborted = fmt.Errorf("primary request rejected")
+
+type (
+	// teeBody is the request body of a tee backend, it receives a copy of
+	// the data read by the primary backend.
+	teeBody struct {
+		ch   chan []byte
+		err  error
+		buf  []byte
+		done chan struct{}
+		once sync.Once
+	}
+
+	// teeReader replaces the body of the original request, and sends a copy
+	// of the data read from it to all tee bodies.
+	teeReader struct {
+		lock   sync.Mutex
+		r      io.Reader
+		bodies []*teeBody
+		err    error
+	}
+
+	// teeRequests are the requests sent to the tee backends.
+	teeRequests struct {
+		reader *teeReader
+		// maxDrain is the max size of the body drained for the tee
+		// backends, negative means no limit.
+		maxDrain int64
+	}
+)
+
+func newTeeBody() *teeBody {
+	return &teeBody{
+		ch:   make(chan []byte, teeBufferChunks),
+		done: make(chan struct{}),
+	}
+}
+
+// Read implements io.Reader.
+func (tb *teeBody) Read(p []byte) (int, error) {
+	for len(tb.buf) == 0 {
+		b, ok := <-tb.ch
+		if !ok {
+			return 0, tb.err
+		}
+		tb.buf = b
+	}
+
+	n := copy(p, tb.buf)
+	tb.buf = tb.buf[n:]
+	return n, nil
+}
+
+// Close implements io.Closer, data is dropped after the body is closed.
+func (tb *teeBody) Close() error {
+	tb.once.Do(func() { close(tb.done) })
+	return nil
+}
+
+func (tb *teeBody) write(b []byte) {
+	select {
+	case tb.ch <- b:
+	case <-tb.done:
+	}
+}
+
+func (tb *teeBody) finish(err error) {
+	tb.err = err
+	close(tb.ch)
+}
+
+// Read implements io.Reader.
+func (tr *teeReader) Read(p []byte) (int, error) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	if tr.err != nil {
+		return 0, tr.err
+	}
+
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		for _, tb := range tr.bodies {
+			b := make([]byte, n)
+			copy(b, p[:n])
+			tb.write(b)
+		}
+	}
+
+	if err != nil {
+		tr.err = err
+		for _, tb := range tr.bodies {
+			tb.finish(err)
+		}
+	}
+
+	return n, err
+}
+
+// Close implements io.Closer, the original body is closed by the HTTP
+// server, so it does nothing.
+func (tr *teeReader) Close() error {
+	return nil
+}
+
+// abort fails the tee bodies with err if they are not finished.
+func (tr *teeReader) abort(err error) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	if tr.err != nil {
+		return
+	}
+	tr.err = err
+	for _, tb := range tr.bodies {
+		tb.finish(err)
+	}
+}
+
+// startTees sends the request to the tee backends, the body of the request
+// is replaced by a teeReader, so that tee backends receive the same body as
+// the primary backend without buffering the whole body.
+func (mi *muxInstance) startTees(span *tracing.Span, backends []string, req *httpprot.Request, maxBodySize int64) *teeRequests {
+	stdr := req.Std()
+	tees := &teeRequests{reader: &teeReader{r: stdr.Body}, maxDrain: maxBodySize}
+	if maxBodySize == 0 {
+		tees.maxDrain = httpprot.DefaultMaxPayloadSize
+	}
+
+	for _, backend := range backends {
+		handler, ok := mi.muxMapper.GetHandler(backend)
+		if !ok {
+			logger.Errorf("%s: tee backend(Pipeline) %q for [%s %s] not found", mi.superSpec.Name(), backend, req.Method(), req.RequestURI)
+			continue
+		}
+
+		tb := newTeeBody()
+		tees.reader.bodies = append(tees.reader.bodies, tb)
+
+		// the tee requests outlive the original one, whose context is
+		// canceled when it is replied.
+		teeStdr := stdr.Clone(stdcontext.Background())
+		teeStdr.Body = tb
+
+		go func(backend string, handler context.Handler) {
+			defer tb.Close()
+
+			teeSpan := span.NewChild(backend)
+			defer teeSpan.End()
+
+			teeReq, _ := httpprot.NewRequest(teeStdr)
+			ctx := context.New(teeSpan)
+			ctx.SetRequest(context.DefaultNamespace, teeReq)
+			defer ctx.Finish()
+
+			if err := teeReq.FetchPayload(maxBodySize); err != nil {
+				logger.Errorf("%s: failed to read request body for tee backend(Pipeline) %q: %v", mi.superSpec.Name(), backend, err)
+				return
+			}
+			handler.Handle(ctx)
+		}(backend, handler)
+	}
+
+	stdr.Body = tees.reader
+	return tees
+}
+
+// finish makes sure the tee backends receive the whole body, up to the max
+// body size, if the primary request is not rejected with statusCode 4xx,
+// otherwise the tee bodies are aborted. The tee backends complete in the
+// background, so that the connection is not held up.
+func (tees *teeRequests) finish(statusCode int) {
+	if tees == nil {
+		return
+	}
+
+	if statusCode >= http.StatusBadRequest && statusCode < http.StatusInternalServerError {
+		tees.reader.abort(errTeeAborted)
+		return
+	}
+
+	if tees.maxDrain < 0 {
+		io.Copy(io.Discard, tees.reader)
+		return
+	}
+	// the tee backends fail with a larger body.
+	if n, _ := io.CopyN(io.Discard, tees.reader, tees.maxDrain+1); n > tees.maxDrain {
+		tees.reader.abort(httpprot.ErrRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTeeBackends(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	bodies := map[string][]byte{}
+
+	handle := func(name string, ctx *context.Context) {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		r := req.GetPayload()
+		if name == "archive-pipeline" {
+			// the archival backend is slower than the primary one.
+			r = &slowTeeReader{r: r}
+		}
+		data, _ := io.ReadAll(r)
+
+		lock.Lock()
+		bodies[name] = data
+		lock.Unlock()
+
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetStatusCode(http.StatusCreated)
+		resp.SetPayload([]byte(name))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+clientMaxBodySize: %d
+rules:
+- paths:
+  - path: /upload
+    teeBackends: [archive-pipeline]
+    backend: upload-pipeline
+`
+
+	body := make([]byte, 1024*1024)
+	rand.Read(body)
+
+	for _, maxBodySize := range []int{-1, 0} {
+		bodies = map[string][]byte{}
+
+		m := newTestMux(t, fmt.Sprintf(yamlConfig, maxBodySize), handle)
+
+		stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/upload", bytes.NewReader(body))
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+
+		assert.Equal(http.StatusCreated, stdw.Code)
+		assert.Equal("upload-pipeline", stdw.Body.String())
+
+		// the tee backend completes in the background.
+		assert.Eventually(func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return bodies["archive-pipeline"] != nil
+		}, 5*time.Second, 10*time.Millisecond)
+		lock.Lock()
+		assert.Equal(body, bodies["upload-pipeline"])
+		assert.Equal(body, bodies["archive-pipeline"])
+		lock.Unlock()
+	}
+}
+
+func TestTeeBackendsRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	teeErr := make(chan error, 1)
+	handle := func(name string, ctx *context.Context) {
+		if name == "archive-pipeline" {
+			req := ctx.GetInputRequest().(*httpprot.Request)
+			_, err := io.ReadAll(req.GetPayload())
+			teeErr <- err
+			return
+		}
+		// the primary backend rejects the request without reading
+		// the body.
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetStatusCode(http.StatusForbidden)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+clientMaxBodySize: -1
+rules:
+- paths:
+  - path: /upload
+    teeBackends: [archive-pipeline]
+    backend: upload-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	// the body of the tee backend is aborted instead of drained.
+	stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/upload", bytes.NewReader(make([]byte, 1024*1024)))
+	stdw := httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal(http.StatusForbidden, stdw.Code)
+	assert.ErrorIs(<-teeErr, errTeeAborted)
+}
+
+func TestTeeRequestsFinish(t *testing.T) {
+	assert := assert.New(t)
+
+	newTees := func(maxDrain int64) (*teeRequests, *teeBody) {
+		tb := newTeeBody()
+		tr := &teeReader{r: bytes.NewReader([]byte("hello world")), bodies: []*teeBody{tb}}
+		return &teeRequests{reader: tr, maxDrain: maxDrain}, tb
+	}
+
+	tees, tb := newTees(-1)
+	tees.finish(http.StatusOK)
+	data, err := io.ReadAll(tb)
+	assert.NoError(err)
+	assert.Equal("hello world", string(data))
+
+	tees, tb = newTees(int64(len("hello world")))
+	tees.finish(http.StatusBadGateway)
+	data, err = io.ReadAll(tb)
+	assert.NoError(err)
+	assert.Equal("hello world", string(data))
+
+	// the drain is capped at the max body size.
+	tees, tb = newTees(4)
+	tees.finish(http.StatusOK)
+	_, err = io.ReadAll(tb)
+	assert.ErrorIs(err, httpprot.ErrRequestEntityTooLarge)
+
+	tees, tb = newTees(-1)
+	tees.finish(http.StatusRequestEntityTooLarge)
+	data, err = io.ReadAll(tb)
+	assert.ErrorIs(err, errTeeAborted)
+	assert.Empty(data)
+
+	// nil tees are a no-op.
+	tees = nil
+	tees.finish(http.StatusOK)
+}
+
+type slowTeeReader struct {
+	r io.Reader
+}
+
+func (r *slowTeeReader) Read(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return r.r.Read(p)
+}
+
+func TestTeeReader(t *testing.T) {
+	assert := assert.New(t)
+
+	tb1, tb2 := newTeeBody(), newTeeBody()
+	tr := &teeReader{r: bytes.NewReader([]byte("hello world")), bodies: []*teeBody{tb1, tb2}}
+
+	// tb2 stops reading, which should not block the others.
+	tb2.Close()
+
+	var data []byte
+	done := make(chan struct{})
+	go func() {
+		data, _ = io.ReadAll(tb1)
+		close(done)
+	}()
+
+	buf := make([]byte, 1)
+	for {
+		if _, err := tr.Read(buf); err != nil {
+			break
+		}
+	}
+	<-done
+	assert.Equal("hello world", string(data))
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/ipfilter"
+)
+
+// trustedCIDRs resolves the real IP of the requests from the trusted
+// proxies by their X-Forwarded-For header.
+type trustedCIDRs struct {
+	filter *ipfilter.IPFilter
+}
+
+func newTrustedCIDRs(cidrs []string) *trustedCIDRs {
+	if len(cidrs) == 0 {
+		return nil
+	}
+
+	return &trustedCIDRs{
+		filter: ipfilter.New(&ipfilter.Spec{
+			BlockByDefault: true,
+			AllowIPs:       cidrs,
+		}),
+	}
+}
+
+func (tc *trustedCIDRs) trusted(ip string) bool {
+	return net.ParseIP(ip) != nil && tc.filter.Allow(ip)
+}
+
+// trustedPeer returns whether the peer of the request is trusted, so its
+// forwarded headers can be used.
+func (tc *trustedCIDRs) trustedPeer(r *httpprot.Request) bool {
+	if tc == nil {
+		return false
+	}
+
+	ip, _, err := net.SplitHostPort(r.Std().RemoteAddr)
+	if err != nil {
+		ip = r.Std().RemoteAddr
+	}
+	return tc.trusted(ip)
+}
+
+// resolveRealIP sets the real IP of the request. The peer is the real IP
+// unless it is trusted, in which case the X-Forwarded-For chain is walked
+// right-to-left, and the first untrusted hop is the real IP. The leftmost
+// hop is used if all hops are trusted.
+func (tc *trustedCIDRs) resolveRealIP(r *httpprot.Request) {
+	if tc == nil {
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.Std().RemoteAddr)
+	if err != nil {
+		ip = r.Std().RemoteAddr
+	}
+
+	if tc.trusted(ip) {
+		hops := strings.Split(strings.Join(r.HTTPHeader().Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// a malformed hop can't be trusted, stop at the last
+				// valid one.
+				break
+			}
+			ip = hop
+			if !tc.trusted(hop) {
+				break
+			}
+		}
+	}
+
+	r.SetRealIP(ip)
+}
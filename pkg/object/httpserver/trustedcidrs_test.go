@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedCIDRs(t *testing.T) {
+	assert := assert.New(t)
+
+	realIP := func(tc *trustedCIDRs, remoteAddr string, xff ...string) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/foo", nil)
+		stdr.RemoteAddr = remoteAddr
+		for _, v := range xff {
+			stdr.Header.Add("X-Forwarded-For", v)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		tc.resolveRealIP(req)
+		return req.RealIP()
+	}
+
+	// disabled, the real IP is untouched.
+	assert.Nil(newTrustedCIDRs(nil))
+	assert.Equal("8.8.8.8", realIP(nil, "10.0.0.1:1234", "8.8.8.8"))
+
+	tc := newTrustedCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+
+	// the header of untrusted peers is ignored.
+	assert.Equal("1.1.1.1", realIP(tc, "1.1.1.1:1234", "8.8.8.8"))
+	assert.Equal("1.1.1.1", realIP(tc, "1.1.1.1:1234"))
+
+	// the trusted hops are skipped right-to-left.
+	assert.Equal("2.2.2.2", realIP(tc, "10.0.0.1:1234", "8.8.8.8, 2.2.2.2, 192.168.1.1"))
+	assert.Equal("2.2.2.2", realIP(tc, "10.0.0.1:1234", "8.8.8.8", "2.2.2.2,10.1.1.1"))
+
+	// the leftmost hop is used if all hops are trusted.
+	assert.Equal("10.2.2.2", realIP(tc, "10.0.0.1:1234", "10.2.2.2,10.1.1.1"))
+
+	// the peer is used without the header.
+	assert.Equal("10.0.0.1", realIP(tc, "10.0.0.1:1234"))
+
+	// stop at a malformed hop.
+	assert.Equal("10.1.1.1", realIP(tc, "10.0.0.1:1234", "8.8.8.8,bad,10.1.1.1"))
+}
+
+func TestSchemeMatchTrustedCIDRs(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.Header().Set("X-Backend", name)
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+trustedCIDRs: [10.0.0.0/8]
+rules:
+- paths:
+  - path: /foo
+    schemes: [https]
+    backend: https-pipeline
+  - path: /foo
+    backend: http-pipeline
+`
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(remoteAddr, proto string, tlsState *tls.ConnectionState) string {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/foo", http.NoBody)
+		stdr.RemoteAddr = remoteAddr
+		stdr.TLS = tlsState
+		if proto != "" {
+			stdr.Header.Set("X-Forwarded-Proto", proto)
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Header().Get("X-Backend")
+	}
+
+	// the trusted LB terminates TLS, the scheme is in the header.
+	assert.Equal("https-pipeline", serve("10.0.0.1:1234", "https", nil))
+	assert.Equal("https-pipeline", serve("10.0.0.1:1234", "HTTPS, http", nil))
+	assert.Equal("http-pipeline", serve("10.0.0.1:1234", "http", nil))
+	assert.Equal("http-pipeline", serve("10.0.0.1:1234", "", nil))
+
+	// the header spoofed by an untrusted peer is ignored.
+	assert.Equal("http-pipeline", serve("1.1.1.1:1234", "https", nil))
+	assert.Equal("https-pipeline", serve("1.1.1.1:1234", "http", &tls.ConnectionState{}))
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+type (
+	// UserAgentFilterSpec describes the User-Agent filter. A User-Agent
+	// matching any of AllowUserAgents is allowed, otherwise it is blocked
+	// if it matches any of BlockUserAgents.
+	UserAgentFilterSpec struct {
+		AllowUserAgents []string `json:"allowUserAgents,omitempty" jsonschema:"omitempty,uniqueItems=true,format=regexp-array"`
+		BlockUserAgents []string `json:"blockUserAgents,omitempty" jsonschema:"omitempty,uniqueItems=true,format=regexp-array"`
+		BlockEmptyUA    bool     `json:"blockEmptyUA,omitempty" jsonschema:"omitempty"`
+		StatusCode      int      `json:"statusCode,omitempty" jsonschema:"omitempty,minimum=400,maximum=599"`
+	}
+
+	userAgentFilter struct {
+		spec    *UserAgentFilterSpec
+		allowRE []*regexp.Regexp
+		blockRE []*regexp.Regexp
+	}
+)
+
+func newUserAgentFilter(spec *UserAgentFilterSpec) *userAgentFilter {
+	if spec == nil {
+		return nil
+	}
+
+	compile := func(patterns []string) []*regexp.Regexp {
+		var res []*regexp.Regexp
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				logger.Errorf("BUG: compile %s failed: %v", p, err)
+				continue
+			}
+			res = append(res, re)
+		}
+		return res
+	}
+
+	return &userAgentFilter{
+		spec:    spec,
+		allowRE: compile(spec.AllowUserAgents),
+		blockRE: compile(spec.BlockUserAgents),
+	}
+}
+
+// allow returns if the User-Agent is allowed.
+func (f *userAgentFilter) allow(ua string) bool {
+	if f == nil {
+		return true
+	}
+
+	if ua == "" {
+		return !f.spec.BlockEmptyUA
+	}
+
+	for _, re := range f.allowRE {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+
+	for _, re := range f.blockRE {
+		if re.MatchString(ua) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// statusCode returns the status code for blocked requests.
+func (f *userAgentFilter) statusCode() int {
+	if f.spec.StatusCode == 0 {
+		return http.StatusForbidden
+	}
+	return f.spec.StatusCode
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAgentFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	var f *userAgentFilter
+	assert.True(f.allow(""))
+	assert.True(f.allow("curl/7.68.0"))
+
+	f = newUserAgentFilter(&UserAgentFilterSpec{
+		AllowUserAgents: []string{"Googlebot"},
+		BlockUserAgents: []string{"(?i)bot", "^python-requests/"},
+	})
+	assert.True(f.allow("Mozilla/5.0 (compatible; Googlebot/2.1)"))
+	assert.False(f.allow("Mozilla/5.0 (compatible; AhrefsBot/7.0)"))
+	assert.False(f.allow("python-requests/2.28.1"))
+	assert.True(f.allow("curl/7.68.0"))
+	assert.True(f.allow(""))
+	assert.Equal(http.StatusForbidden, f.statusCode())
+
+	f = newUserAgentFilter(&UserAgentFilterSpec{BlockEmptyUA: true, StatusCode: http.StatusTeapot})
+	assert.False(f.allow(""))
+	assert.True(f.allow("curl/7.68.0"))
+	assert.Equal(http.StatusTeapot, f.statusCode())
+}
+
+func TestMuxUserAgentFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+userAgentFilter:
+  blockUserAgents: [Scrapy]
+  blockEmptyUA: true
+rules:
+- paths:
+  - path: /api
+    backend: api-pipeline
+`
+	m := newTestMux(t, yamlConfig, nil)
+
+	serve := func(ua string) int {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/api", http.NoBody)
+		stdr.Header.Set("User-Agent", ua)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusForbidden, serve("Scrapy/2.7.1 (+https://scrapy.org)"))
+	assert.Equal(http.StatusOK, serve("Mozilla/5.0"))
+	assert.Equal(http.StatusForbidden, serve(""))
+}
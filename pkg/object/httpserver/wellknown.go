@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+const (
+	faviconPath = "/favicon.ico"
+	robotsPath  = "/robots.txt"
+
+	defaultRobotsBody          = "User-agent: *\nDisallow:\n"
+	defaultWellKnownFileMaxAge = 86400
+)
+
+type (
+	// WellKnownFilesSpec describes the well-known files served by the
+	// server directly, bypassing the rules. Only the configured files are
+	// served, an empty favicon is replied with 204, and an empty robots.txt
+	// allows all robots.
+	WellKnownFilesSpec struct {
+		Favicon *WellKnownFile `json:"favicon,omitempty" jsonschema:"omitempty"`
+		Robots  *WellKnownFile `json:"robots,omitempty" jsonschema:"omitempty"`
+		// MaxAge is the max-age of the Cache-Control header in seconds,
+		// default is 86400.
+		MaxAge uint32 `json:"maxAge,omitempty" jsonschema:"omitempty"`
+	}
+
+	// WellKnownFile is the content of a well-known file, the body can be
+	// either plain text or base64 encoded for binary content.
+	WellKnownFile struct {
+		Body        string `json:"body,omitempty" jsonschema:"omitempty"`
+		BodyBase64  string `json:"bodyBase64,omitempty" jsonschema:"omitempty,format=base64"`
+		ContentType string `json:"contentType,omitempty" jsonschema:"omitempty"`
+	}
+
+	// wellKnownFiles are the prepared responses of the well-known files,
+	// keyed by their paths.
+	wellKnownFiles map[string]*wellKnownResponse
+
+	wellKnownResponse struct {
+		statusCode   int
+		body         []byte
+		contentType  string
+		cacheControl string
+	}
+)
+
+// Validate validates WellKnownFile.
+func (f *WellKnownFile) Validate() error {
+	if f.Body != "" && f.BodyBase64 != "" {
+		return fmt.Errorf("body and bodyBase64 are mutually exclusive")
+	}
+	return nil
+}
+
+func (f *WellKnownFile) payload() []byte {
+	if f.BodyBase64 != "" {
+		// the body has been validated by the format of the schema.
+		body, _ := base64.StdEncoding.DecodeString(f.BodyBase64)
+		return body
+	}
+	return []byte(f.Body)
+}
+
+func newWellKnownFiles(spec *WellKnownFilesSpec) wellKnownFiles {
+	if spec == nil {
+		return nil
+	}
+
+	maxAge := spec.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultWellKnownFileMaxAge
+	}
+	cacheControl := "public, max-age=" + strconv.Itoa(int(maxAge))
+
+	files := wellKnownFiles{}
+
+	if f := spec.Favicon; f != nil {
+		resp := &wellKnownResponse{
+			statusCode:   http.StatusNoContent,
+			body:         f.payload(),
+			cacheControl: cacheControl,
+		}
+		if len(resp.body) > 0 {
+			resp.statusCode = http.StatusOK
+			resp.contentType = f.ContentType
+			if resp.contentType == "" {
+				resp.contentType = "image/x-icon"
+			}
+		}
+		files[faviconPath] = resp
+	}
+
+	if f := spec.Robots; f != nil {
+		resp := &wellKnownResponse{
+			statusCode:   http.StatusOK,
+			body:         f.payload(),
+			contentType:  f.ContentType,
+			cacheControl: cacheControl,
+		}
+		if len(resp.body) == 0 {
+			resp.body = []byte(defaultRobotsBody)
+		}
+		if resp.contentType == "" {
+			resp.contentType = "text/plain; charset=utf-8"
+		}
+		files[robotsPath] = resp
+	}
+
+	return files
+}
+
+// serve replies the well-known file if the request is a GET or HEAD
+// request to one of the configured files, and returns whether the request
+// is replied.
+func (files wellKnownFiles) serve(ctx *context.Context, req *httpprot.Request) bool {
+	if req.Method() != http.MethodGet && req.Method() != http.MethodHead {
+		return false
+	}
+
+	f := files[req.Path()]
+	if f == nil {
+		return false
+	}
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(f.statusCode)
+	if f.contentType != "" {
+		resp.Header().Set("Content-Type", f.contentType)
+	}
+	resp.Header().Set("Cache-Control", f.cacheControl)
+	resp.SetPayload(f.body)
+	ctx.SetResponse(context.DefaultNamespace, resp)
+	return true
+}
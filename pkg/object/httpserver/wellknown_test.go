@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWellKnownFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	handle := func(name string, ctx *context.Context) {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetPayload([]byte("backend"))
+		ctx.SetOutputResponse(resp)
+	}
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+wellKnownFiles:
+  favicon:
+    bodyBase64: AAABAA==
+  robots: {}
+  maxAge: 3600
+rules:
+- paths:
+  - pathPrefix: /
+    backend: api-pipeline
+`
+
+	m := newTestMux(t, yamlConfig, handle)
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		stdr, _ := http.NewRequest(method, "http://www.megaease.com"+path, http.NoBody)
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw
+	}
+
+	w := serve(http.MethodGet, "/favicon.ico")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal([]byte{0, 0, 1, 0}, w.Body.Bytes())
+	assert.Equal("image/x-icon", w.Header().Get("Content-Type"))
+	assert.Equal("public, max-age=3600", w.Header().Get("Cache-Control"))
+
+	w = serve(http.MethodGet, "/robots.txt")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(defaultRobotsBody, w.Body.String())
+	assert.Equal("text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+
+	// other methods and paths are routed normally
+	w = serve(http.MethodPost, "/robots.txt")
+	assert.Equal("backend", w.Body.String())
+	w = serve(http.MethodGet, "/index.html")
+	assert.Equal("backend", w.Body.String())
+
+	// only the configured files are served
+	yamlConfig = `
+kind: HTTPServer
+name: test
+port: 8080
+keepAlive: true
+https: false
+wellKnownFiles:
+  favicon: {}
+rules:
+- paths:
+  - pathPrefix: /
+    backend: api-pipeline
+`
+	reloadTestMux(t, m, yamlConfig)
+
+	w = serve(http.MethodGet, "/favicon.ico")
+	assert.Equal(http.StatusNoContent, w.Code)
+	assert.Empty(w.Header().Get("Content-Type"))
+	assert.Equal("public, max-age=86400", w.Header().Get("Cache-Control"))
+	w = serve(http.MethodGet, "/robots.txt")
+	assert.Equal("backend", w.Body.String())
+}
+
+func TestWellKnownFileValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&WellKnownFile{Body: "User-agent: *"}).Validate())
+	assert.Error((&WellKnownFile{Body: "a", BodyBase64: "YQ=="}).Validate())
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"net"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/ipfilter"
+)
+
+const (
+	xForwardedProto = "X-Forwarded-Proto"
+	xForwardedHost  = "X-Forwarded-Host"
+)
+
+type (
+	// XForwardedHeadersSpec describes the X-Forwarded-Proto and the
+	// X-Forwarded-Host headers set for the backends. The headers sent by
+	// the client are kept, but if TrustedProxies is not empty, they are
+	// only kept for the requests from the trusted proxies.
+	XForwardedHeadersSpec struct {
+		TrustedProxies []string `json:"trustedProxies,omitempty" jsonschema:"omitempty,uniqueItems=true,format=ipcidr-array"`
+	}
+
+	xForwardedHeaders struct {
+		trustedProxies *ipfilter.IPFilter
+	}
+)
+
+func newXForwardedHeaders(spec *XForwardedHeadersSpec) *xForwardedHeaders {
+	if spec == nil {
+		return nil
+	}
+
+	xfh := &xForwardedHeaders{}
+	if len(spec.TrustedProxies) > 0 {
+		xfh.trustedProxies = ipfilter.New(&ipfilter.Spec{
+			BlockByDefault: true,
+			AllowIPs:       spec.TrustedProxies,
+		})
+	}
+	return xfh
+}
+
+// trusted returns if the X-Forwarded headers sent by the peer of the
+// request are trusted.
+func (xfh *xForwardedHeaders) trusted(r *httpprot.Request) bool {
+	if xfh.trustedProxies == nil {
+		return true
+	}
+
+	ip, _, err := net.SplitHostPort(r.Std().RemoteAddr)
+	if err != nil {
+		ip = r.Std().RemoteAddr
+	}
+	return xfh.trustedProxies.Allow(ip)
+}
+
+// set sets the X-Forwarded-Proto header from the TLS state of the request,
+// and the X-Forwarded-Host header from its host.
+func (xfh *xForwardedHeaders) set(r *httpprot.Request) {
+	if xfh == nil {
+		return
+	}
+
+	proto := "http"
+	if r.Std().TLS != nil {
+		proto = "https"
+	}
+
+	trusted := xfh.trusted(r)
+	if !trusted || r.HTTPHeader().Get(xForwardedProto) == "" {
+		r.Header().Set(xForwardedProto, proto)
+	}
+	if !trusted || r.HTTPHeader().Get(xForwardedHost) == "" {
+		r.Header().Set(xForwardedHost, r.Host())
+	}
+}
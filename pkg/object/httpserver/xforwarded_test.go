@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpserver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXForwardedHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	newReq := func(remoteAddr string, https bool, header map[string]string) *httpprot.Request {
+		stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com:8080/foo", nil)
+		stdr.RemoteAddr = remoteAddr
+		if https {
+			stdr.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range header {
+			stdr.Header.Set(k, v)
+		}
+		req, _ := httpprot.NewRequest(stdr)
+		return req
+	}
+
+	// disabled
+	xfh := newXForwardedHeaders(nil)
+	req := newReq("1.1.1.1:1234", true, nil)
+	xfh.set(req)
+	assert.Empty(req.HTTPHeader().Get(xForwardedProto))
+	assert.Empty(req.HTTPHeader().Get(xForwardedHost))
+
+	xfh = newXForwardedHeaders(&XForwardedHeadersSpec{})
+	req = newReq("1.1.1.1:1234", true, nil)
+	xfh.set(req)
+	assert.Equal("https", req.HTTPHeader().Get(xForwardedProto))
+	assert.Equal("www.megaease.com:8080", req.HTTPHeader().Get(xForwardedHost))
+
+	req = newReq("1.1.1.1:1234", false, nil)
+	xfh.set(req)
+	assert.Equal("http", req.HTTPHeader().Get(xForwardedProto))
+
+	// the headers sent by the client are kept.
+	req = newReq("1.1.1.1:1234", false, map[string]string{
+		xForwardedProto: "https",
+		xForwardedHost:  "example.com",
+	})
+	xfh.set(req)
+	assert.Equal("https", req.HTTPHeader().Get(xForwardedProto))
+	assert.Equal("example.com", req.HTTPHeader().Get(xForwardedHost))
+
+	// only the headers sent by the trusted proxies are kept.
+	xfh = newXForwardedHeaders(&XForwardedHeadersSpec{TrustedProxies: []string{"10.0.0.0/8"}})
+	header := map[string]string{xForwardedProto: "https", xForwardedHost: "example.com"}
+
+	req = newReq("10.1.2.3:1234", false, header)
+	xfh.set(req)
+	assert.Equal("https", req.HTTPHeader().Get(xForwardedProto))
+	assert.Equal("example.com", req.HTTPHeader().Get(xForwardedHost))
+
+	req = newReq("1.1.1.1:1234", false, header)
+	xfh.set(req)
+	assert.Equal("http", req.HTTPHeader().Get(xForwardedProto))
+	assert.Equal("www.megaease.com:8080", req.HTTPHeader().Get(xForwardedHost))
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -45,6 +46,8 @@ type Request struct {
 	stream  *readers.ByteCountReader
 	payload []byte
 	realIP  string
+
+	realIPResolved bool
 }
 
 var (
@@ -295,6 +298,28 @@ func (r *Request) RealIP() string {
 	return r.realIP
 }
 
+// SetRealIP sets the real IP of the request, it is used when the real IP
+// is resolved by the caller, e.g. from the headers set by trusted proxies.
+func (r *Request) SetRealIP(ip string) {
+	r.realIP = ip
+	r.realIPResolved = true
+}
+
+// TrustedIP returns the IP of the client which can't be forged by request
+// headers: the real IP if it is set by SetRealIP, or the IP of the TCP peer
+// otherwise.
+func (r *Request) TrustedIP() string {
+	if r.realIPResolved {
+		return r.realIP
+	}
+
+	ip, _, err := net.SplitHostPort(r.Std().RemoteAddr)
+	if err != nil {
+		return r.Std().RemoteAddr
+	}
+	return ip
+}
+
 // Std returns the underlying http.Request.
 func (r *Request) Std() *http.Request {
 	return r.Request
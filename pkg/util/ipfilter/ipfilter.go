@@ -26,7 +26,18 @@ import (
 	"github.com/megaease/easegress/pkg/logger"
 )
 
+const (
+	// ListAllow is the name of the allow list.
+	ListAllow = "allow"
+	// ListBlock is the name of the block list.
+	ListBlock = "block"
+)
+
 var (
+	// privateCIDRs are the private ranges of RFC 1918 and the unique local
+	// addresses of RFC 4193.
+	privateCIDRs = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
 	allOnesIPv4Mask = net.CIDRMask(net.IPv4len*8, net.IPv4len*8)
 	allOnesIPv6Mask = net.CIDRMask(net.IPv6len*8, net.IPv6len*8)
 )
@@ -35,6 +46,12 @@ type (
 	// Spec describes IPFilter.
 	Spec struct {
 		BlockByDefault bool `json:"blockByDefault" jsonschema:"omitempty"`
+		AllowLoopback  bool `json:"allowLoopback,omitempty" jsonschema:"omitempty"`
+
+		// AllowPrivate and BlockPrivate add the private ranges to AllowIPs
+		// and BlockIPs respectively, without listing them manually.
+		AllowPrivate bool `json:"allowPrivate,omitempty" jsonschema:"omitempty"`
+		BlockPrivate bool `json:"blockPrivate,omitempty" jsonschema:"omitempty"`
 
 		AllowIPs []string `json:"allowIPs" jsonschema:"omitempty,uniqueItems=true,format=ipcidr-array"`
 		BlockIPs []string `json:"blockIPs" jsonschema:"omitempty,uniqueItems=true,format=ipcidr-array"`
@@ -48,6 +65,13 @@ type (
 		blockRanger cidranger.Ranger
 	}
 
+	// cidrEntry is the entry of the ranger, which keeps the configured
+	// ip or cidr.
+	cidrEntry struct {
+		ipNet net.IPNet
+		cidr  string
+	}
+
 	// IPFilters is the wrapper for multiple IPFilters.
 	IPFilters struct {
 		filters []*IPFilter
@@ -71,7 +95,7 @@ func New(spec *Spec) *IPFilter {
 					mask = allOnesIPv6Mask
 				}
 				ipNet := net.IPNet{IP: ip, Mask: mask}
-				ranger.Insert(cidranger.NewBasicRangerEntry(ipNet))
+				ranger.Insert(&cidrEntry{ipNet: ipNet, cidr: ipcidr})
 				continue
 			}
 
@@ -80,28 +104,51 @@ func New(spec *Spec) *IPFilter {
 				logger.Errorf("BUG: %s is an invalid ip or cidr", ipcidr)
 				continue
 			}
-			ranger.Insert(cidranger.NewBasicRangerEntry(*ipNet))
+			ranger.Insert(&cidrEntry{ipNet: *ipNet, cidr: ipcidr})
 		}
 
 		return ranger
 	}
 
+	allowIPs, blockIPs := spec.AllowIPs, spec.BlockIPs
+	if spec.AllowPrivate {
+		allowIPs = append(append([]string(nil), allowIPs...), privateCIDRs...)
+	}
+	if spec.BlockPrivate {
+		blockIPs = append(append([]string(nil), blockIPs...), privateCIDRs...)
+	}
+
 	return &IPFilter{
 		spec: spec,
 
-		allowRanger: rangerFromIPCIDRs(spec.AllowIPs),
-		blockRanger: rangerFromIPCIDRs(spec.BlockIPs),
+		allowRanger: rangerFromIPCIDRs(allowIPs),
+		blockRanger: rangerFromIPCIDRs(blockIPs),
 	}
 }
 
 // Allow return if IPFilter allows the incoming ip.
 func (f *IPFilter) Allow(ipstr string) bool {
+	return f.AllowClient(ipstr, ipstr)
+}
+
+// AllowClient is like Allow, but the loopback exemption of AllowLoopback is
+// decided by trustedIP instead of ipstr. ipstr may come from headers set by
+// the client, trustedIP must not, e.g. it is the IP of the TCP peer.
+func (f *IPFilter) AllowClient(ipstr, trustedIP string) bool {
 	if f == nil {
 		return true
 	}
 
 	defaultResult := !f.spec.BlockByDefault
 
+	// loopback addresses are always allowed regardless of other rules,
+	// so that local probes are never locked out.
+	if f.spec.AllowLoopback {
+		if ip := net.ParseIP(trustedIP); ip != nil && ip.IsLoopback() {
+			return true
+		}
+	}
+
 	ip := net.ParseIP(ipstr)
 	if ip == nil {
 		return defaultResult
@@ -112,7 +159,7 @@ func (f *IPFilter) Allow(ipstr string) bool {
 		return defaultResult
 	}
 	// if AllowIPs is not empty, only allow IPs in AllowIPs
-	if len(f.spec.AllowIPs) > 0 && !allowed {
+	if (len(f.spec.AllowIPs) > 0 || f.spec.AllowPrivate) && !allowed {
 		return false
 	}
 
@@ -133,6 +180,50 @@ func (f *IPFilter) Allow(ipstr string) bool {
 	}
 }
 
+// Network implements cidranger.RangerEntry.
+func (e *cidrEntry) Network() net.IPNet {
+	return e.ipNet
+}
+
+// MatchingCIDR returns the configured ip or cidr matching the incoming ip,
+// and the list it comes from, ListAllow or ListBlock. The allow list is
+// checked first, and the most specific entry is returned if several entries
+// of the list match. Empty strings are returned if no entry matches.
+func (f *IPFilter) MatchingCIDR(ipstr string) (cidr string, list string) {
+	if f == nil {
+		return "", ""
+	}
+
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return "", ""
+	}
+
+	if cidr = mostSpecificEntry(f.allowRanger, ip); cidr != "" {
+		return cidr, ListAllow
+	}
+	if cidr = mostSpecificEntry(f.blockRanger, ip); cidr != "" {
+		return cidr, ListBlock
+	}
+	return "", ""
+}
+
+func mostSpecificEntry(ranger cidranger.Ranger, ip net.IP) string {
+	entries, err := ranger.ContainingNetworks(ip)
+	if err != nil {
+		return ""
+	}
+
+	cidr, maxOnes := "", -1
+	for _, entry := range entries {
+		ones, _ := entry.Network().Mask.Size()
+		if ones > maxOnes {
+			cidr, maxOnes = entry.(*cidrEntry).cidr, ones
+		}
+	}
+	return cidr
+}
+
 // NewIPFilters creates an IPFilters
 func NewIPFilters(filters ...*IPFilter) *IPFilters {
 	return &IPFilters{filters: filters}
@@ -55,3 +55,96 @@ func TestAllowIP(t *testing.T) {
 	assert.True(filter.Allow("192.168.1.1"))
 	assert.False(filter.Allow("192.168.2.1"))
 }
+
+func TestAllowLoopback(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := New(&Spec{
+		BlockByDefault: true,
+		AllowLoopback:  true,
+		BlockIPs:       []string{"127.0.0.1", "::1"},
+	})
+	assert.True(filter.Allow("127.0.0.1"))
+	assert.True(filter.Allow("127.1.2.3"))
+	assert.True(filter.Allow("::1"))
+	assert.False(filter.Allow("192.168.1.1"))
+
+	// the loopback exemption is decided by the trusted IP only.
+	assert.False(filter.AllowClient("127.0.0.1", "203.0.113.7"))
+	assert.True(filter.AllowClient("203.0.113.7", "127.0.0.1"))
+
+	filter = New(&Spec{BlockByDefault: true})
+	assert.False(filter.Allow("127.0.0.1"))
+	assert.False(filter.Allow("::1"))
+}
+
+func TestPrivateRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := New(&Spec{BlockPrivate: true})
+	assert.False(filter.Allow("10.1.2.3"))
+	assert.False(filter.Allow("172.20.0.1"))
+	assert.False(filter.Allow("192.168.1.1"))
+	assert.False(filter.Allow("fd00::1"))
+	assert.True(filter.Allow("8.8.8.8"))
+	assert.True(filter.Allow("172.32.0.1"))
+	assert.True(filter.Allow("2001:db8::1"))
+
+	// composed with the explicit lists
+	filter = New(&Spec{BlockPrivate: true, BlockIPs: []string{"8.8.8.8"}})
+	assert.False(filter.Allow("10.1.2.3"))
+	assert.False(filter.Allow("8.8.8.8"))
+	assert.True(filter.Allow("8.8.4.4"))
+
+	filter = New(&Spec{AllowPrivate: true})
+	assert.True(filter.Allow("10.1.2.3"))
+	assert.True(filter.Allow("fd00::1"))
+	assert.False(filter.Allow("8.8.8.8"))
+
+	filter = New(&Spec{AllowPrivate: true, AllowIPs: []string{"8.8.8.8"}, BlockIPs: []string{"10.0.0.1"}})
+	assert.True(filter.Allow("10.1.2.3"))
+	assert.True(filter.Allow("8.8.8.8"))
+	assert.False(filter.Allow("8.8.4.4"))
+
+	cidr, list := filter.MatchingCIDR("192.168.1.1")
+	assert.Equal("192.168.0.0/16", cidr)
+	assert.Equal(ListAllow, list)
+}
+
+func TestMatchingCIDR(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := New(&Spec{
+		AllowIPs: []string{"192.168.0.0/16", "192.168.1.0/24"},
+		BlockIPs: []string{"10.0.0.0/8", "172.16.1.1"},
+	})
+
+	cidr, list := filter.MatchingCIDR("192.168.1.10")
+	assert.Equal("192.168.1.0/24", cidr)
+	assert.Equal(ListAllow, list)
+
+	cidr, list = filter.MatchingCIDR("192.168.2.10")
+	assert.Equal("192.168.0.0/16", cidr)
+	assert.Equal(ListAllow, list)
+
+	cidr, list = filter.MatchingCIDR("10.1.2.3")
+	assert.Equal("10.0.0.0/8", cidr)
+	assert.Equal(ListBlock, list)
+
+	cidr, list = filter.MatchingCIDR("172.16.1.1")
+	assert.Equal("172.16.1.1", cidr)
+	assert.Equal(ListBlock, list)
+
+	cidr, list = filter.MatchingCIDR("8.8.8.8")
+	assert.Empty(cidr)
+	assert.Empty(list)
+
+	cidr, list = filter.MatchingCIDR("invalid")
+	assert.Empty(cidr)
+	assert.Empty(list)
+
+	var nilFilter *IPFilter
+	cidr, list = nilFilter.MatchingCIDR("10.1.2.3")
+	assert.Empty(cidr)
+	assert.Empty(list)
+}
@@ -197,6 +197,33 @@ func (rl *RateLimiter) AcquireNPermission(n int) (bool, time.Duration) {
 	return rl.acquirePermission(n)
 }
 
+// RetryAfter returns the duration after which the rate limiter could
+// permit a request again, it is zero if a request could be permitted now.
+func (rl *RateLimiter) RetryAfter() time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.state == StateDisabled {
+		return 0
+	}
+
+	now := nowFunc()
+
+	maxTokens := rl.policy.LimitForPeriod
+	maxTokens *= int(rl.policy.TimeoutDuration/rl.policy.LimitRefreshPeriod) + 1
+
+	cycle := int(now.Sub(rl.startTime) / rl.policy.LimitRefreshPeriod)
+	tokens := rl.tokens - (cycle-rl.cycle)*rl.policy.LimitForPeriod
+	if tokens < maxTokens {
+		return 0
+	}
+
+	// the first cycle in which the permitted tokens are less than maxTokens
+	cycle = rl.cycle + (rl.tokens-maxTokens)/rl.policy.LimitForPeriod + 1
+	d := rl.policy.LimitRefreshPeriod * time.Duration(cycle)
+	return rl.startTime.Add(d).Sub(now)
+}
+
 // WaitPermission waits a permission from the rate limiter
 // returns true if the request is permitted and false if timed out
 func (rl *RateLimiter) WaitPermission() bool {
@@ -244,3 +244,41 @@ func TestRateLimiterN(t *testing.T) {
 	}
 	limiter.SetState(StateDisabled)
 }
+
+func TestRetryAfter(t *testing.T) {
+	policy := NewPolicy(0, time.Second, 2)
+	limiter := New(policy)
+
+	if d := limiter.RetryAfter(); d != 0 {
+		t.Errorf("retry after should be zero: %s", d.String())
+	}
+	for i := 0; i < 2; i++ {
+		if permitted, _ := limiter.AcquirePermission(); !permitted {
+			t.Errorf("AcquirePermission should succeed: %d", i)
+		}
+	}
+	if permitted, _ := limiter.AcquirePermission(); permitted {
+		t.Errorf("AcquirePermission should fail")
+	}
+
+	// the retry after duration decreases as time advances toward refill
+	expected := []time.Duration{time.Second, 600 * time.Millisecond, 200 * time.Millisecond}
+	for _, e := range expected {
+		if d := limiter.RetryAfter(); d != e {
+			t.Errorf("retry after should be %s, but is %s", e.String(), d.String())
+		}
+		now = now.Add(400 * time.Millisecond)
+	}
+
+	if d := limiter.RetryAfter(); d != 0 {
+		t.Errorf("retry after should be zero: %s", d.String())
+	}
+	if permitted, _ := limiter.AcquirePermission(); !permitted {
+		t.Errorf("AcquirePermission should succeed")
+	}
+
+	limiter.SetState(StateDisabled)
+	if d := limiter.RetryAfter(); d != 0 {
+		t.Errorf("retry after of disabled rate limiter should be zero: %s", d.String())
+	}
+}
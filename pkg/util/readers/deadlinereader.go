@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package readers
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrDeadlineExceeded is returned by DeadlineReader if the deadline exceeded
+// before the reading completes.
+var ErrDeadlineExceeded = errors.New("read deadline exceeded")
+
+const (
+	deadlineActive = iota
+	deadlineExpired
+	deadlineStopped
+)
+
+// DeadlineReader wraps an io.Reader and fails the reading with
+// ErrDeadlineExceeded if it does not complete before the deadline.
+//
+// The underlying io.Reader is read in the caller's goroutine, abort is
+// called when the deadline exceeded to unblock the pending read, e.g. by
+// setting the read deadline of the connection, or closing the body. The
+// deadline is stopped when the reading completes, or by Stop, after which
+// abort is never called.
+type DeadlineReader struct {
+	r     io.Reader
+	timer *time.Timer
+
+	lock  sync.Mutex
+	state int
+}
+
+// NewDeadlineReader wraps an io.Reader to DeadlineReader, whose deadline is
+// timeout from now.
+func NewDeadlineReader(r io.Reader, timeout time.Duration, abort func()) *DeadlineReader {
+	dr := &DeadlineReader{r: r}
+	dr.timer = time.AfterFunc(timeout, func() {
+		dr.lock.Lock()
+		defer dr.lock.Unlock()
+		if dr.state == deadlineActive {
+			dr.state = deadlineExpired
+			abort()
+		}
+	})
+	return dr
+}
+
+func (r *DeadlineReader) expired() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.state == deadlineExpired
+}
+
+// Read implements io.Reader.
+func (r *DeadlineReader) Read(p []byte) (int, error) {
+	if r.expired() {
+		return 0, ErrDeadlineExceeded
+	}
+
+	n, err := r.r.Read(p)
+	if err != nil {
+		// the error is caused by abort.
+		if r.expired() {
+			return n, ErrDeadlineExceeded
+		}
+		r.Stop()
+	}
+	return n, err
+}
+
+// Stop stops the deadline, it is a no-op if the deadline exceeded.
+func (r *DeadlineReader) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state == deadlineActive {
+		r.state = deadlineStopped
+		r.timer.Stop()
+	}
+}
+
+// Close implements io.Closer, it stops the deadline and closes the
+// underlying io.Reader if it is an io.Closer.
+func (r *DeadlineReader) Close() error {
+	r.Stop()
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
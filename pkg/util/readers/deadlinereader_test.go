@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package readers
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type blockingReader struct {
+	unblock chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.unblock
+	return 0, io.ErrClosedPipe
+}
+
+func TestDeadlineReader(t *testing.T) {
+	assert := assert.New(t)
+
+	aborted := false
+	dr := NewDeadlineReader(io.NopCloser(strings.NewReader("123")), 10*time.Millisecond, func() {
+		aborted = true
+	})
+	data, err := io.ReadAll(dr)
+	assert.Nil(err)
+	assert.Equal("123", string(data))
+	assert.Nil(dr.Close())
+
+	// abort is not called after the reading completes.
+	time.Sleep(20 * time.Millisecond)
+	assert.False(aborted)
+
+	// abort unblocks the pending read.
+	br := &blockingReader{unblock: make(chan struct{})}
+	dr = NewDeadlineReader(br, 10*time.Millisecond, func() {
+		close(br.unblock)
+	})
+	data, err = io.ReadAll(dr)
+	assert.Equal(ErrDeadlineExceeded, err)
+	assert.Empty(data)
+
+	// the error is sticky
+	_, err = dr.Read(make([]byte, 10))
+	assert.Equal(ErrDeadlineExceeded, err)
+
+	// abort is not called after stop.
+	dr = NewDeadlineReader(br, 10*time.Millisecond, func() {
+		aborted = true
+	})
+	dr.Stop()
+	time.Sleep(20 * time.Millisecond)
+	assert.False(aborted)
+}
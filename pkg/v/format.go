@@ -40,6 +40,7 @@ var (
 		"ipcidr-array":     ipcidrArray,
 		"hostport":         hostport,
 		"regexp":           _regexp,
+		"regexp-array":     regexpArray,
 		"base64":           _base64,
 		"url":              _url,
 	}
@@ -188,6 +189,17 @@ func _regexp(v interface{}) error {
 	return nil
 }
 
+func regexpArray(v interface{}) error {
+	for _, s := range v.([]string) {
+		err := _regexp(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func _base64(v interface{}) error {
 	s := v.(string)
 	_, err := base64.StdEncoding.DecodeString(s)